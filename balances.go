@@ -116,8 +116,8 @@ func CreateAccountWithBalance(context context.Context, dbSvc *dynamodb.Client, t
 		"mobile_number":       &types.AttributeValueMemberS{Value: ""},
 		"id_number":           &types.AttributeValueMemberS{Value: ""},
 		"pic_id_card":         &types.AttributeValueMemberS{Value: ""},
-		"amount":              &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", amount)},
-		"currency":            &types.AttributeValueMemberS{Value: "SDG"},
+		"amount":              amountNumber(DefaultCurrency, amount),
+		"currency":            &types.AttributeValueMemberS{Value: DefaultCurrency},
 		"Version":             &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
 		"TenantID":            &types.AttributeValueMemberS{Value: tenantId},
 	}
@@ -140,6 +140,9 @@ func CreateAccount(context context.Context, dbSvc *dynamodb.Client, tenantId str
 	if tenantId == "" {
 		tenantId = "nil"
 	}
+	if user.Currency == "" {
+		user.Currency = DefaultCurrency
+	}
 	item := map[string]types.AttributeValue{
 		"AccountID":           &types.AttributeValueMemberS{Value: user.AccountID},
 		"full_name":           &types.AttributeValueMemberS{Value: user.FullName},
@@ -157,8 +160,8 @@ func CreateAccount(context context.Context, dbSvc *dynamodb.Client, tenantId str
 		"mobile_number":       &types.AttributeValueMemberS{Value: user.MobileNumber},
 		"id_number":           &types.AttributeValueMemberS{Value: user.IDNumber},
 		"pic_id_card":         &types.AttributeValueMemberS{Value: user.PicIDCard},
-		"amount":              &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", user.Amount)},
-		"currency":            &types.AttributeValueMemberS{Value: "SDG"},
+		"amount":              amountNumber(user.Currency, user.Amount),
+		"currency":            &types.AttributeValueMemberS{Value: user.Currency},
 		"Version":             &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
 		"TenantID":            &types.AttributeValueMemberS{Value: tenantId},
 	}
@@ -205,6 +208,26 @@ func GetAccount(ctx context.Context, dbSvc *dynamodb.Client, trEntry Transaction
 	return &user, nil
 }
 
+// GetAccountBalance is GetAccount for callers that need the whole balance:
+// the Amount of a sharded account also includes the balances of its shards.
+// GetAccount returns the account item alone, which is enough to check that an
+// account exists or to read its currency.
+func GetAccountBalance(ctx context.Context, dbSvc *dynamodb.Client, trEntry TransactionEntry) (*User, error) {
+	user, err := GetAccount(ctx, dbSvc, trEntry)
+	if err != nil {
+		return nil, err
+	}
+	if trEntry.TenantID == "" {
+		trEntry.TenantID = "nil"
+	}
+	shardBalance, err := GetShardedBalance(ctx, dbSvc, trEntry.TenantID, trEntry.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	user.Amount += shardBalance
+	return user, nil
+}
+
 // InquireBalance inquires the balance of a given user account.
 // It takes a DynamoDB client and an account ID, returning the balance
 // as a float64 and an error if the inquiry fails or the user does not exist.
@@ -230,7 +253,11 @@ func InquireBalance(context context.Context, dbSvc *dynamodb.Client, tenantId, A
 	if err != nil {
 		return 0, fmt.Errorf("failed to unmarshal user balance for user %s: %v", AccountID, err)
 	}
-	return userBalance.Amount, nil
+	shardBalance, err := GetShardedBalance(context, dbSvc, tenantId, AccountID)
+	if err != nil {
+		return 0, err
+	}
+	return userBalance.Amount + shardBalance, nil
 }
 
 // TransferCredits transfers a specified amount from one account to another.
@@ -264,7 +291,7 @@ func TransferCredits(context context.Context, dbSvc *dynamodb.Client, trEntry Tr
 	}
 
 	// Fetch sender account
-	sender, err := GetAccount(context, dbSvc, trEntry)
+	sender, err := GetAccountBalance(context, dbSvc, trEntry)
 	if err != nil || sender == nil {
 		SaveToTransactionTable(dbSvc, trEntry.TenantID, transaction, transactionStatus)
 		response = NilResponse{
@@ -300,6 +327,57 @@ func TransferCredits(context context.Context, dbSvc *dynamodb.Client, trEntry Tr
 		return response, err
 	}
 
+	if sender.AccountCurrency() != receiver.AccountCurrency() {
+		SaveToTransactionTable(dbSvc, trEntry.TenantID, transaction, transactionStatus)
+		response = NilResponse{
+			Status:    "error",
+			Code:      "currency_mismatch",
+			Message:   "Sender and receiver accounts hold different currencies.",
+			Details:   fmt.Sprintf("%s holds %s but %s holds %s, use a conversion transfer.", sender.AccountID, sender.AccountCurrency(), receiver.AccountID, receiver.AccountCurrency()),
+			Timestamp: trEntry.Timestamp,
+			Data: data{
+				UUID:       trEntry.InitiatorUUID,
+				SignedUUID: trEntry.SignedUUID,
+			},
+		}
+		return response, errors.New("currency mismatch")
+	}
+
+	if err := ValidateCurrencyAmount(sender.AccountCurrency(), trEntry.Amount); err != nil {
+		SaveToTransactionTable(dbSvc, trEntry.TenantID, transaction, transactionStatus)
+		response = NilResponse{
+			Status:    "error",
+			Code:      "invalid_amount",
+			Message:   "Invalid amount for the account currency.",
+			Details:   err.Error(),
+			Timestamp: trEntry.Timestamp,
+			Data: data{
+				UUID:       trEntry.InitiatorUUID,
+				SignedUUID: trEntry.SignedUUID,
+			},
+		}
+		return response, err
+	}
+
+	if err := checkTenantTransfer(context, dbSvc, trEntry.TenantID, trEntry.TenantID, trEntry.Amount); err != nil {
+		if !errors.Is(err, ErrTenantInactive) && !errors.Is(err, ErrTenantLimit) {
+			return response, err
+		}
+		SaveToTransactionTable(dbSvc, trEntry.TenantID, transaction, transactionStatus)
+		response = NilResponse{
+			Status:    "error",
+			Code:      tenantTransferCode(err),
+			Message:   "The tenant does not allow this transfer.",
+			Details:   err.Error(),
+			Timestamp: trEntry.Timestamp,
+			Data: data{
+				UUID:       trEntry.InitiatorUUID,
+				SignedUUID: trEntry.SignedUUID,
+			},
+		}
+		return response, err
+	}
+
 	if trEntry.Amount > sender.Amount {
 		SaveToTransactionTable(dbSvc, trEntry.TenantID, transaction, transactionStatus)
 		response = NilResponse{
@@ -344,10 +422,14 @@ func TransferCredits(context context.Context, dbSvc *dynamodb.Client, trEntry Tr
 		return response, fmt.Errorf("failed to marshal ledger entry: %v", err)
 	}
 
+	debitShard, err := pickDebitShard(context, dbSvc, trEntry.TenantID, trEntry.FromAccount, trEntry.Amount)
+	if err != nil {
+		return response, err
+	}
 	debitInput := &dynamodb.TransactWriteItemsInput{
 		TransactItems: []types.TransactWriteItem{
 			{
-				Update: &types.Update{
+				Update: shardDebitUpdate(&types.Update{
 					TableName: aws.String(NilUsers),
 					Key: map[string]types.AttributeValue{
 						"TenantID":  &types.AttributeValueMemberS{Value: trEntry.TenantID},
@@ -356,11 +438,11 @@ func TransferCredits(context context.Context, dbSvc *dynamodb.Client, trEntry Tr
 					UpdateExpression:    aws.String("SET amount = amount - :amount, Version = :newVersion"),
 					ConditionExpression: aws.String("attribute_not_exists(Version) OR Version = :oldVersion"),
 					ExpressionAttributeValues: map[string]types.AttributeValue{
-						":amount":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", trEntry.Amount)},
+						":amount":     amountNumber(sender.AccountCurrency(), trEntry.Amount),
 						":oldVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(sender.Version, 10)},
 						":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
 					},
-				},
+				}, trEntry.TenantID, trEntry.FromAccount, sender.AccountCurrency(), trEntry.Amount, debitShard),
 			},
 			{Put: &types.Put{
 				TableName: aws.String(LedgerTable),
@@ -392,7 +474,7 @@ func TransferCredits(context context.Context, dbSvc *dynamodb.Client, trEntry Tr
 	creditInput := &dynamodb.TransactWriteItemsInput{
 		TransactItems: []types.TransactWriteItem{
 			{
-				Update: &types.Update{
+				Update: shardBalanceUpdate(&types.Update{
 					TableName: aws.String(NilUsers),
 					Key: map[string]types.AttributeValue{
 						"TenantID":  &types.AttributeValueMemberS{Value: trEntry.TenantID},
@@ -401,11 +483,11 @@ func TransferCredits(context context.Context, dbSvc *dynamodb.Client, trEntry Tr
 					UpdateExpression:    aws.String("SET amount = amount + :amount, Version = :newVersion"),
 					ConditionExpression: aws.String("attribute_exists(AccountID) AND TenantID = :tenantID"),
 					ExpressionAttributeValues: map[string]types.AttributeValue{
-						":amount":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", trEntry.Amount)},
+						":amount":     amountNumber(sender.AccountCurrency(), trEntry.Amount),
 						":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
 						":tenantID":   &types.AttributeValueMemberS{Value: trEntry.TenantID},
 					},
-				},
+				}, trEntry.TenantID, trEntry.ToAccount, sender.AccountCurrency(), trEntry.Amount),
 			},
 			{Put: &types.Put{
 				TableName: aws.String(LedgerTable),
@@ -425,12 +507,13 @@ func TransferCredits(context context.Context, dbSvc *dynamodb.Client, trEntry Tr
 			UpdateExpression:    aws.String("SET amount = amount + :amount, Version = :newVersion"),
 			ConditionExpression: aws.String("attribute_not_exists(Version) OR Version = :oldVersion"),
 			ExpressionAttributeValues: map[string]types.AttributeValue{
-				":amount":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", trEntry.Amount)},
+				":amount":     amountNumber(sender.AccountCurrency(), trEntry.Amount),
 				":oldVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(sender.Version, 10)},
 				":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
 			},
 		}
 
+		rollbackInput = shardBalanceUpdateItem(rollbackInput, trEntry.TenantID, trEntry.FromAccount, sender.AccountCurrency(), trEntry.Amount)
 		_, rollbackErr := dbSvc.UpdateItem(context, rollbackInput)
 		if rollbackErr != nil {
 			panic(fmt.Errorf("failed to rollback debit for user %s: %v", trEntry.FromAccount, rollbackErr))
@@ -466,7 +549,7 @@ func TransferCredits(context context.Context, dbSvc *dynamodb.Client, trEntry Tr
 		Data: data{
 			TransactionID: uid,
 			Amount:        trEntry.Amount,
-			Currency:      "SDG",
+			Currency:      sender.AccountCurrency(),
 			UUID:          trEntry.InitiatorUUID,
 			SignedUUID:    trEntry.SignedUUID,
 		},
@@ -0,0 +1,247 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// DefaultCashoutProvider is used when an escrow request does not name one: the
+// escrowed amount is released into another nil wallet.
+const DefaultCashoutProvider = "nil"
+
+// HoldCashoutProvider keeps the funds in escrow until they are paid out with
+// ReleaseEscrow or returned with RefundEscrowRemainder.
+const HoldCashoutProvider = "hold"
+
+// nilPayoutActor identifies NilCashoutProvider payouts in escrow transition
+// histories.
+const nilPayoutActor = "nil_cashout_provider"
+
+// ErrUnknownCashoutProvider is returned when no provider is registered under a name.
+var ErrUnknownCashoutProvider = errors.New("unknown cashout provider")
+
+// ErrPayoutNotCancellable is returned by providers that cannot cancel a payout.
+var ErrPayoutNotCancellable = errors.New("payout cannot be cancelled")
+
+// ErrEscrowPayoutQueued is returned when an escrow would be paid out inside the
+// ledger while a service provider may still pay it out as well.
+var ErrEscrowPayoutQueued = errors.New("escrow payout is queued with a service provider")
+
+// CashoutProvider releases escrowed funds to a beneficiary. Implementations that
+// settle synchronously finalize the escrow in InitiatePayout, conditioned on it
+// still being InProgress, and return its final status; the others return
+// StatusInProgress and finalize the escrow later, typically through
+// ConfirmEscrowPayout.
+type CashoutProvider interface {
+	// Name is the value stored in EscrowTransaction.CashoutProvider.
+	Name() string
+	// ValidateBeneficiary rejects escrows the provider could never pay out. It is
+	// called before any funds are moved into escrow.
+	ValidateBeneficiary(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) error
+	// InitiatePayout starts releasing an InProgress escrow and reports the
+	// status the escrow is in afterwards. ErrEscrowStateConflict means another
+	// writer settled the escrow first.
+	InitiatePayout(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) (Status, error)
+	// PayoutStatus reports the provider's view of a payout.
+	PayoutStatus(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) (Status, error)
+	// CancelPayout asks the provider to stop a payout that has not been
+	// settled yet. It moves no money and leaves the escrow's status alone; the
+	// caller refunds the escrow once the payout is cancelled.
+	CancelPayout(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) error
+}
+
+var (
+	cashoutProvidersMu sync.RWMutex
+	cashoutProviders   = map[string]CashoutProvider{}
+)
+
+func init() {
+	RegisterCashoutProvider(NilCashoutProvider{})
+	RegisterCashoutProvider(HoldingCashoutProvider{})
+	RegisterCashoutProvider(WebhookCashoutProvider{ProviderName: "bok"})
+}
+
+// RegisterCashoutProvider makes a provider available under its Name, replacing
+// any provider previously registered under the same name.
+func RegisterCashoutProvider(provider CashoutProvider) {
+	cashoutProvidersMu.Lock()
+	defer cashoutProvidersMu.Unlock()
+	cashoutProviders[provider.Name()] = provider
+}
+
+// GetCashoutProvider returns the provider registered under name. An empty name
+// resolves to DefaultCashoutProvider.
+func GetCashoutProvider(name string) (CashoutProvider, error) {
+	if name == "" {
+		name = DefaultCashoutProvider
+	}
+	cashoutProvidersMu.RLock()
+	defer cashoutProvidersMu.RUnlock()
+	provider, ok := cashoutProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCashoutProvider, name)
+	}
+	return provider, nil
+}
+
+// CashoutProviders lists the names of all registered providers.
+func CashoutProviders() []string {
+	cashoutProvidersMu.RLock()
+	defer cashoutProvidersMu.RUnlock()
+	names := make([]string, 0, len(cashoutProviders))
+	for name := range cashoutProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// payoutQueued reports whether the cashout provider of es hands the payout to a
+// service provider, which may pay it out until the payout is cancelled.
+func payoutQueued(es EscrowTransaction) (CashoutProvider, bool, error) {
+	provider, err := GetCashoutProvider(es.CashoutProvider)
+	if err != nil {
+		return nil, false, err
+	}
+	_, queued := provider.(WebhookCashoutProvider)
+	return provider, queued, nil
+}
+
+// NilCashoutProvider pays out into a nil wallet identified by the escrow's
+// ToAccount and ToTenantID. Payouts settle synchronously.
+type NilCashoutProvider struct{}
+
+func (NilCashoutProvider) Name() string { return DefaultCashoutProvider }
+
+// ValidateBeneficiary checks that the receiving wallet exists.
+func (NilCashoutProvider) ValidateBeneficiary(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) error {
+	if es.ToAccount == "" {
+		return errors.New("to_account is required for nil cashout")
+	}
+	receiver, err := GetAccount(ctx, dbSvc, TransactionEntry{AccountID: es.ToAccount, FromAccount: es.ToAccount, TenantID: es.ToTenantID})
+	if err != nil || receiver == nil {
+		return fmt.Errorf("receiver %s not found in tenant %s: %v", es.ToAccount, es.ToTenantID, err)
+	}
+	return nil
+}
+
+// InitiatePayout pays the remaining escrowed amount to the receiver and
+// completes the escrow in one transaction, conditioned on the escrow still
+// being InProgress, so the payout is claimed and made at once and cannot run
+// twice. If the payout cannot be made the amount is returned to the sender and
+// the escrow fails instead.
+func (NilCashoutProvider) InitiatePayout(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) (Status, error) {
+	latest, err := reloadEscrow(ctx, dbSvc, es)
+	if err != nil {
+		return es.Status, err
+	}
+	if latest.Status != StatusInProgress {
+		return latest.Status, fmt.Errorf("%w: escrow %s is %s", ErrEscrowStateConflict, es.SystemTransactionID, latest.Status)
+	}
+
+	remaining := latest.RemainingAmount()
+	payout := escrowLeg{ToAccount: latest.ToAccount, ToTenantID: latest.ToTenantID, Amount: remaining}
+	err = finalizeEscrow(ctx, dbSvc, *latest, StatusCompleted, "ReleasedAmount", payout, nilPayoutActor, "released to beneficiary")
+	if err == nil {
+		return StatusCompleted, nil
+	}
+	if errors.Is(err, ErrEscrowStateConflict) {
+		return StatusInProgress, err
+	}
+	if refundErr := finalizeEscrow(ctx, dbSvc, *latest, StatusFailed, "RefundedAmount", refundLeg(*latest, remaining),
+		nilPayoutActor, "release failed, funds returned to sender"); refundErr != nil {
+		return StatusInProgress, fmt.Errorf("payout failed (%v) and refund failed: %w", err, refundErr)
+	}
+	return StatusFailed, fmt.Errorf("payout failed, funds returned to sender: %w", err)
+}
+
+// PayoutStatus returns the escrow's own status; nil payouts have no external state.
+func (NilCashoutProvider) PayoutStatus(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) (Status, error) {
+	return es.Status, nil
+}
+
+// CancelPayout always fails: nil payouts settle as soon as they are initiated.
+func (NilCashoutProvider) CancelPayout(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) error {
+	return fmt.Errorf("%w: nil payouts settle immediately", ErrPayoutNotCancellable)
+}
+
+// WebhookCashoutProvider hands payouts to an external service provider through
+// the ServiceProviderTransactions table. The provider reports the outcome with
+// ConfirmEscrowPayout.
+type WebhookCashoutProvider struct {
+	ProviderName string
+}
+
+func (p WebhookCashoutProvider) Name() string { return p.ProviderName }
+
+// ValidateBeneficiary requires a service provider to deliver the payout and a
+// beneficiary account for it to pay into.
+func (p WebhookCashoutProvider) ValidateBeneficiary(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) error {
+	if es.ServiceProvider == "" {
+		return fmt.Errorf("service_provider is required for %s cashout", p.ProviderName)
+	}
+	if es.Beneficiary.AccountID == "" {
+		return fmt.Errorf("beneficiary account is required for %s cashout", p.ProviderName)
+	}
+	return nil
+}
+
+// InitiatePayout queues the escrow for the service provider.
+func (p WebhookCashoutProvider) InitiatePayout(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) (Status, error) {
+	if err := StoreLocalWebhooks(ctx, dbSvc, es.ServiceProvider, es); err != nil {
+		return StatusInProgress, err
+	}
+	return StatusInProgress, nil
+}
+
+// PayoutStatus reads the escrow, which ConfirmEscrowPayout keeps up to date.
+func (p WebhookCashoutProvider) PayoutStatus(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) (Status, error) {
+	latest, err := GetEscrowTransactionBySystemID(ctx, dbSvc, es.SystemTransactionID)
+	if err != nil {
+		return es.Status, err
+	}
+	return latest.Status, nil
+}
+
+// CancelPayout marks the payout queued for the service provider as failed, so
+// it is no longer picked up. A confirmation arriving after the escrow is
+// refunded is rejected with ErrEscrowAlreadyFinalized.
+func (p WebhookCashoutProvider) CancelPayout(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) error {
+	cancelled := es
+	cancelled.Status = StatusFailed
+	return StoreLocalWebhooks(ctx, dbSvc, es.ServiceProvider, cancelled)
+}
+
+// HoldingCashoutProvider holds escrows for marketplaces that release funds in
+// stages or across several beneficiaries. Beneficiaries are named at release
+// time, so nothing is validated up front.
+type HoldingCashoutProvider struct{}
+
+func (HoldingCashoutProvider) Name() string { return HoldCashoutProvider }
+
+func (HoldingCashoutProvider) ValidateBeneficiary(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) error {
+	return nil
+}
+
+// InitiatePayout leaves the escrow InProgress for ReleaseEscrow.
+func (HoldingCashoutProvider) InitiatePayout(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) (Status, error) {
+	return StatusInProgress, nil
+}
+
+func (HoldingCashoutProvider) PayoutStatus(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) (Status, error) {
+	latest, err := GetEscrowTransactionBySystemID(ctx, dbSvc, es.SystemTransactionID)
+	if err != nil {
+		return es.Status, err
+	}
+	return latest.Status, nil
+}
+
+// CancelPayout has nothing to stop: held funds only move on ReleaseEscrow.
+func (HoldingCashoutProvider) CancelPayout(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) error {
+	return nil
+}
@@ -0,0 +1,113 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// MockCashoutProvider is a CashoutProvider whose behaviour is scripted with testify/mock.
+type MockCashoutProvider struct {
+	mock.Mock
+	ProviderName string
+}
+
+func (m *MockCashoutProvider) Name() string { return m.ProviderName }
+
+func (m *MockCashoutProvider) ValidateBeneficiary(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) error {
+	return m.Called(es).Error(0)
+}
+
+func (m *MockCashoutProvider) InitiatePayout(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) (Status, error) {
+	args := m.Called(es)
+	return args.Get(0).(Status), args.Error(1)
+}
+
+func (m *MockCashoutProvider) PayoutStatus(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) (Status, error) {
+	args := m.Called(es)
+	return args.Get(0).(Status), args.Error(1)
+}
+
+func (m *MockCashoutProvider) CancelPayout(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) error {
+	return m.Called(es).Error(0)
+}
+
+func TestCashoutProviderRegistry(t *testing.T) {
+	mockProvider := &MockCashoutProvider{ProviderName: "mock"}
+	RegisterCashoutProvider(mockProvider)
+	defer func() {
+		cashoutProvidersMu.Lock()
+		delete(cashoutProviders, "mock")
+		cashoutProvidersMu.Unlock()
+	}()
+
+	tests := []struct {
+		name     string
+		provider string
+		want     string
+		wantErr  error
+	}{
+		{"default", "", DefaultCashoutProvider, nil},
+		{"nil", "nil", DefaultCashoutProvider, nil},
+		{"bok", "bok", "bok", nil},
+		{"hold", HoldCashoutProvider, HoldCashoutProvider, nil},
+		{"registered mock", "mock", "mock", nil},
+		{"unknown", "unknown", "", ErrUnknownCashoutProvider},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetCashoutProvider(tt.provider)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got.Name())
+		})
+	}
+
+	assert.Contains(t, CashoutProviders(), "mock")
+
+	es := EscrowTransaction{SystemTransactionID: "tx-1", Amount: 10}
+	mockProvider.On("InitiatePayout", es).Return(StatusInProgress, nil)
+	provider, err := GetCashoutProvider("mock")
+	assert.NoError(t, err)
+	status, err := provider.InitiatePayout(context.TODO(), nil, es)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusInProgress, status)
+	mockProvider.AssertExpectations(t)
+}
+
+func TestWebhookCashoutProviderValidateBeneficiary(t *testing.T) {
+	provider := WebhookCashoutProvider{ProviderName: "bok"}
+	tests := []struct {
+		name    string
+		es      EscrowTransaction
+		wantErr bool
+	}{
+		{"valid", EscrowTransaction{ServiceProvider: "sp@example.com", Beneficiary: Beneficiary{AccountID: "123"}}, false},
+		{"missing service provider", EscrowTransaction{Beneficiary: Beneficiary{AccountID: "123"}}, true},
+		{"missing beneficiary", EscrowTransaction{ServiceProvider: "sp@example.com"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := provider.ValidateBeneficiary(context.TODO(), nil, tt.es)
+			assert.Equal(t, tt.wantErr, err != nil, "error: %v", err)
+		})
+	}
+}
+
+func TestNilCashoutProviderCancelPayout(t *testing.T) {
+	err := NilCashoutProvider{}.CancelPayout(context.TODO(), nil, EscrowTransaction{})
+	assert.ErrorIs(t, err, ErrPayoutNotCancellable)
+}
+
+func TestHoldingCashoutProviderCancelPayout(t *testing.T) {
+	// held funds only move on release, so there is nothing to stop and no
+	// database access
+	err := HoldingCashoutProvider{}.CancelPayout(context.TODO(), nil, EscrowTransaction{Amount: 10})
+	assert.NoError(t, err)
+}
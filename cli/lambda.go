@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 
 	_ "embed"
@@ -107,87 +108,39 @@ func handleRequest(ctx context.Context, event events.DynamoDBEvent) {
 				continue
 			}
 			log.Printf("the transaction entry is: %+v", transaction)
-			if transaction.Status == ledger.StatusCompleted || transaction.Status == ledger.StatusFailed { // both are final states
+			if transaction.Status.IsFinal() {
 				continue
 			}
-			if transaction.CashoutProvider == "nil" { // this is guaranteed to be populated
-
-				esTransaction := ledger.EscrowTransaction{
-					FromAccount:         transaction.TransientAccount,
-					FromTenantID:        transaction.TransientTenant,
-					ToAccount:           transaction.ToAccount,
-					ToTenantID:          transaction.ToTenantID,
-					Amount:              transaction.Amount,
-					Comment:             transaction.Comment,
-					InitiatorUUID:       transaction.InitiatorUUID,
-					Timestamp:           transaction.Timestamp,
-					SystemTransactionID: transaction.SystemTransactionID,
-					CashoutProvider:     transaction.CashoutProvider,
-					TransientAccount:    transaction.TransientAccount,
-					TransientTenant:     transaction.TransientTenant,
-					ServiceProvider:     transaction.ServiceProvider,
-					TransactionDate:     transaction.TransactionDate,
-					PaymentReference:    transaction.PaymentReference,
-					Beneficiary:         transaction.Beneficiary,
-				}
-
-				esTransaction.Status = ledger.StatusCompleted
-				if _, err := ledger.EscrowTransferCredits(context.TODO(), _dbSvc, esTransaction); err != nil {
-					log.Printf("the error in sending transaction is: %v", err)
-					esTransaction.Status = ledger.StatusFailed
-					// You should reverse operation here!
-					reversedTrans := ledger.EscrowTransaction{
-						FromAccount:         transaction.TransientAccount,
-						FromTenantID:        transaction.TransientTenant,
-						ToAccount:           transaction.FromAccount,
-						ToTenantID:          transaction.FromTenantID,
-						Amount:              transaction.Amount,
-						InitiatorUUID:       transaction.InitiatorUUID,
-						SystemTransactionID: transaction.SystemTransactionID,
-					}
-					log.Printf("the reverse request is: %+v", reversedTrans)
-					if _, err := ledger.EscrowTransferCredits(context.TODO(), _dbSvc, reversedTrans); err != nil {
-						log.Printf("WE should fix this: %v", err)
-					}
-
-				}
-				log.Printf("the request we're sending to sns is: %+v", esTransaction)
-				// In handleRequest function, after updating the transaction
-
-				if err := publishToSNSTopic(esTransaction); err != nil {
-					log.Printf("failed to publish to SNS topic: %v", err)
-				}
-
-				// Now, i want to amend that table again to make the status as completed.
-				updateItem(context.TODO(), _dbSvc, esTransaction)
-			} else {
-				log.Println("im unable to hit the cashout provider")
-				log.Printf("log for saving transaction is: %+v", ledger.StoreLocalWebhooks(context.TODO(), _dbSvc, transaction.ServiceProvider, transaction))
+			provider, err := ledger.GetCashoutProvider(transaction.CashoutProvider)
+			if err != nil {
+				log.Printf("cannot pay out escrow %s: %v", transaction.SystemTransactionID, err)
+				continue
 			}
 
-		}
-	}
-}
-
-func updateItem(ctx context.Context, dbSvc *dynamodb.Client, transaction ledger.EscrowTransaction) {
-	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String(ledger.EscrowTransactionsTable),
-		Key: map[string]types.AttributeValue{
-			"UUID":          &types.AttributeValueMemberS{Value: transaction.InitiatorUUID},
-			"TransactionID": &types.AttributeValueMemberS{Value: transaction.SystemTransactionID},
-		},
-		UpdateExpression: aws.String("SET #ts = :status"),
-		ExpressionAttributeNames: map[string]string{
-			"#ts": "TransactionStatus",
-		},
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":status": &types.AttributeValueMemberS{Value: transaction.Status.String()},
-		},
-	}
+			// synchronous providers claim and settle the escrow in one conditional
+			// write, so a replayed stream record cannot pay it out twice
+			status, err := provider.InitiatePayout(context.TODO(), _dbSvc, transaction)
+			if errors.Is(err, ledger.ErrEscrowStateConflict) {
+				log.Printf("escrow %s was already settled: %v", transaction.SystemTransactionID, err)
+				continue
+			}
+			if err != nil {
+				log.Printf("the error in initiating payout with %s is: %v", provider.Name(), err)
+			}
+			if !status.IsFinal() {
+				// the provider settles asynchronously and confirms through ConfirmEscrowPayout
+				continue
+			}
 
-	_, err := dbSvc.UpdateItem(ctx, input)
-	if err != nil {
-		log.Printf("failed to update item in DynamoDB: %v", err)
+			esTransaction := transaction
+			esTransaction.FromAccount = transaction.TransientAccount
+			esTransaction.FromTenantID = transaction.TransientTenant
+			esTransaction.Status = status
+			log.Printf("the request we're sending to sns is: %+v", esTransaction)
+			if err := publishToSNSTopic(esTransaction); err != nil {
+				log.Printf("failed to publish to SNS topic: %v", err)
+			}
+		}
 	}
 }
 
@@ -2,10 +2,13 @@ package ledger
 
 import (
 	"crypto"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -75,3 +78,32 @@ func VerifySignature(publicKeyStr, message, signatureStr string) bool {
 	err = rsa.VerifyPKCS1v15(rsaPubKey, crypto.SHA256, hashed, sigBytes)
 	return err == nil
 }
+
+// VerifyPublicKeySignature checks a base64 signature over message with a base64
+// PKIX public key. RSA keys use PKCS#1 v1.5 with SHA-256 like VerifySignature;
+// Ed25519 keys sign the message directly. Unlike VerifySignature it reports
+// malformed input as an error, so it is safe to use on data from partners.
+func VerifyPublicKeySignature(publicKeyStr, message, signatureStr string) error {
+	pub, err := parsePublicKey(publicKeyStr)
+	if err != nil {
+		return err
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(signatureStr)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %v", err)
+	}
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		hashed := sha256.Sum256([]byte(message))
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], sigBytes)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, []byte(message), sigBytes) {
+			return errors.New("ed25519: verification error")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
@@ -0,0 +1,187 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	ErrUnsupportedCurrency = errors.New("unsupported currency")
+	ErrAmountPrecision     = errors.New("amount has more decimals than the currency allows")
+	ErrAmountBelowMinimum  = errors.New("amount is below the currency's minimum transfer")
+)
+
+// RoundingMode decides how amounts are rounded to a currency's minor unit.
+type RoundingMode int
+
+const (
+	// RoundHalfUp rounds halves away from zero.
+	RoundHalfUp RoundingMode = iota
+	// RoundHalfEven rounds halves to the nearest even minor unit.
+	RoundHalfEven
+	// RoundDown truncates towards zero.
+	RoundDown
+)
+
+// Currency describes a supported currency.
+type Currency struct {
+	// Code is the ISO 4217 alpha code, e.g. "SDG".
+	Code string `json:"code"`
+	// Exponent is the number of minor-unit decimals, 2 for cents.
+	Exponent    int          `json:"exponent"`
+	Rounding    RoundingMode `json:"rounding"`
+	Symbol      string       `json:"symbol"`
+	MinTransfer float64      `json:"min_transfer"`
+}
+
+var (
+	currenciesMu sync.RWMutex
+	currencies   = map[string]Currency{
+		"SDG": {Code: "SDG", Exponent: 2, Rounding: RoundHalfUp, Symbol: "SDG", MinTransfer: 1},
+		"USD": {Code: "USD", Exponent: 2, Rounding: RoundHalfEven, Symbol: "$", MinTransfer: 0.01},
+		"EUR": {Code: "EUR", Exponent: 2, Rounding: RoundHalfEven, Symbol: "€", MinTransfer: 0.01},
+		"SAR": {Code: "SAR", Exponent: 2, Rounding: RoundHalfUp, Symbol: "SAR", MinTransfer: 0.01},
+		"AED": {Code: "AED", Exponent: 2, Rounding: RoundHalfUp, Symbol: "AED", MinTransfer: 0.01},
+		"EGP": {Code: "EGP", Exponent: 2, Rounding: RoundHalfUp, Symbol: "E£", MinTransfer: 0.01},
+	}
+)
+
+// RegisterCurrency adds or replaces a supported currency.
+func RegisterCurrency(c Currency) error {
+	if len(c.Code) != 3 || strings.ToUpper(c.Code) != c.Code {
+		return fmt.Errorf("invalid ISO currency code %q", c.Code)
+	}
+	if c.Exponent < 0 || c.Exponent > 4 {
+		return fmt.Errorf("invalid exponent %d for %s", c.Exponent, c.Code)
+	}
+	if c.MinTransfer < 0 {
+		return fmt.Errorf("minimum transfer of %s must not be negative", c.Code)
+	}
+	currenciesMu.Lock()
+	defer currenciesMu.Unlock()
+	currencies[c.Code] = c
+	return nil
+}
+
+// GetCurrency returns a supported currency. An empty code is DefaultCurrency.
+func GetCurrency(code string) (Currency, error) {
+	if code == "" {
+		code = DefaultCurrency
+	}
+	currenciesMu.RLock()
+	defer currenciesMu.RUnlock()
+	c, ok := currencies[code]
+	if !ok {
+		return Currency{}, fmt.Errorf("%w: %s", ErrUnsupportedCurrency, code)
+	}
+	return c, nil
+}
+
+// Currencies returns the supported currencies ordered by code.
+func Currencies() []Currency {
+	currenciesMu.RLock()
+	defer currenciesMu.RUnlock()
+	list := make([]Currency, 0, len(currencies))
+	for _, c := range currencies {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Code < list[j].Code })
+	return list
+}
+
+// Round rounds amount to the currency's minor unit using its rounding mode.
+func (c Currency) Round(amount float64) float64 {
+	scale := math.Pow10(c.Exponent)
+	// scaled amounts carry float noise such as 1.005*100 = 100.49999999999999
+	scaled, _ := strconv.ParseFloat(strconv.FormatFloat(amount*scale, 'f', 6, 64), 64)
+	switch c.Rounding {
+	case RoundHalfEven:
+		scaled = math.RoundToEven(scaled)
+	case RoundDown:
+		scaled = math.Trunc(scaled)
+	default:
+		scaled = math.Round(scaled)
+	}
+	return scaled / scale
+}
+
+// ValidateAmount checks that amount is positive, representable in the
+// currency's minor unit and not below its minimum transfer.
+func (c Currency) ValidateAmount(amount float64) error {
+	if amount <= 0 {
+		return fmt.Errorf("amount must be greater than zero")
+	}
+	if math.Abs(amount-c.Round(amount)) > amountEpsilon {
+		return fmt.Errorf("%w: %s allows %d", ErrAmountPrecision, c.Code, c.Exponent)
+	}
+	if amount+amountEpsilon < c.MinTransfer {
+		return fmt.Errorf("%w: minimum %s", ErrAmountBelowMinimum, c.Format(c.MinTransfer))
+	}
+	return nil
+}
+
+// Format renders amount with the currency's symbol, minor-unit decimals and
+// thousands separators, e.g. "$1,234.50".
+func (c Currency) Format(amount float64) string {
+	s := strconv.FormatFloat(math.Abs(c.Round(amount)), 'f', c.Exponent, 64)
+	whole, fraction, _ := strings.Cut(s, ".")
+	for i := len(whole) - 3; i > 0; i -= 3 {
+		whole = whole[:i] + "," + whole[i:]
+	}
+	if fraction != "" {
+		whole += "." + fraction
+	}
+
+	sign := ""
+	if amount < 0 && c.Round(amount) != 0 {
+		sign = "-"
+	}
+	if len([]rune(c.Symbol)) > 2 {
+		// alphabetic symbols read better apart from the number
+		return sign + c.Symbol + " " + whole
+	}
+	return sign + c.Symbol + whole
+}
+
+// ValidateCurrencyAmount validates amount against the registered currency code.
+func ValidateCurrencyAmount(code string, amount float64) error {
+	c, err := GetCurrency(code)
+	if err != nil {
+		return err
+	}
+	return c.ValidateAmount(amount)
+}
+
+// FormatAmount formats amount in currency code, falling back to two decimals
+// and the bare code for unregistered currencies.
+func FormatAmount(code string, amount float64) string {
+	c, err := GetCurrency(code)
+	if err != nil {
+		return fmt.Sprintf("%s %.2f", code, amount)
+	}
+	return c.Format(amount)
+}
+
+// FormatMinorUnits renders amount, rounded to the minor unit of currency code,
+// as a plain decimal with exactly the currency's number of decimals, e.g.
+// "1.250" for KWD. Unregistered currencies use two decimals.
+func FormatMinorUnits(code string, amount float64) string {
+	c, err := GetCurrency(code)
+	if err != nil {
+		return strconv.FormatFloat(amount, 'f', 2, 64)
+	}
+	return strconv.FormatFloat(c.Round(amount), 'f', c.Exponent, 64)
+}
+
+// amountNumber is amount in currency code as a DynamoDB number, the way
+// balances and ledger entries store it.
+func amountNumber(code string, amount float64) *types.AttributeValueMemberN {
+	return &types.AttributeValueMemberN{Value: FormatMinorUnits(code, amount)}
+}
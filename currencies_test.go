@@ -0,0 +1,135 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCurrencyRound(t *testing.T) {
+	tests := []struct {
+		name     string
+		currency Currency
+		amount   float64
+		want     float64
+	}{
+		{"half up", Currency{Exponent: 2, Rounding: RoundHalfUp}, 1.005, 1.01},
+		{"half even down", Currency{Exponent: 2, Rounding: RoundHalfEven}, 1.125, 1.12},
+		{"half even up", Currency{Exponent: 2, Rounding: RoundHalfEven}, 1.135, 1.14},
+		{"down", Currency{Exponent: 2, Rounding: RoundDown}, 1.999, 1.99},
+		{"no minor unit", Currency{Exponent: 0, Rounding: RoundHalfUp}, 12.5, 13},
+		{"three decimals", Currency{Exponent: 3, Rounding: RoundHalfUp}, 1.2345, 1.235},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.want, tt.currency.Round(tt.amount), 1e-9)
+		})
+	}
+}
+
+func TestCurrencyValidateAmount(t *testing.T) {
+	sdg, err := GetCurrency(DefaultCurrency)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		amount  float64
+		wantErr error
+		anyErr  bool
+	}{
+		{"valid", 10.5, nil, false},
+		{"minimum", 1, nil, false},
+		{"float noise", 0.1 + 0.2 + 1, nil, false},
+		{"zero", 0, nil, true},
+		{"negative", -5, nil, true},
+		{"too precise", 10.555, ErrAmountPrecision, true},
+		{"below minimum", 0.5, ErrAmountBelowMinimum, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sdg.ValidateAmount(tt.amount)
+			if !tt.anyErr {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Error(t, err)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+
+	assert.ErrorIs(t, ValidateCurrencyAmount("XXX", 10), ErrUnsupportedCurrency)
+}
+
+func TestCurrencyFormat(t *testing.T) {
+	tests := []struct {
+		code   string
+		amount float64
+		want   string
+	}{
+		{"USD", 1234.5, "$1,234.50"},
+		{"USD", -0.5, "-$0.50"},
+		{"SDG", 1000000, "SDG 1,000,000.00"},
+		{"SDG", 12, "SDG 12.00"},
+		{"XXX", 3.14159, "XXX 3.14"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			assert.Equal(t, tt.want, FormatAmount(tt.code, tt.amount))
+		})
+	}
+}
+
+// registerTestCurrency registers c for the duration of the test.
+func registerTestCurrency(t *testing.T, c Currency) {
+	t.Helper()
+	previous, err := GetCurrency(c.Code)
+	existed := err == nil
+	t.Cleanup(func() {
+		currenciesMu.Lock()
+		defer currenciesMu.Unlock()
+		if existed {
+			currencies[c.Code] = previous
+		} else {
+			delete(currencies, c.Code)
+		}
+	})
+	assert.NoError(t, RegisterCurrency(c))
+}
+
+func TestRegisterCurrency(t *testing.T) {
+	assert.Error(t, RegisterCurrency(Currency{Code: "usd", Exponent: 2}))
+	assert.Error(t, RegisterCurrency(Currency{Code: "KWD", Exponent: -1}))
+	assert.Error(t, RegisterCurrency(Currency{Code: "KWD", Exponent: 3, MinTransfer: -1}))
+
+	registerTestCurrency(t, Currency{Code: "KWD", Exponent: 3, Rounding: RoundHalfUp, Symbol: "KWD", MinTransfer: 0.001})
+	kwd, err := GetCurrency("KWD")
+	assert.NoError(t, err)
+	assert.Equal(t, "KWD 1.235", kwd.Format(1.2345))
+	assert.Contains(t, Currencies(), kwd)
+}
+
+func TestFormatMinorUnits(t *testing.T) {
+	registerTestCurrency(t, Currency{Code: "KWD", Exponent: 3, Rounding: RoundHalfUp, Symbol: "KWD", MinTransfer: 0.001})
+	registerTestCurrency(t, Currency{Code: "JPY", Exponent: 0, Rounding: RoundHalfUp, Symbol: "¥", MinTransfer: 1})
+
+	tests := []struct {
+		code   string
+		amount float64
+		want   string
+	}{
+		{"SDG", 10, "10.00"},
+		{"SDG", 0.1 + 0.2, "0.30"},
+		{"KWD", 1.25, "1.250"},
+		{"KWD", 0.001, "0.001"},
+		{"JPY", 1500, "1500"},
+		{"SDG", -2.5, "-2.50"},
+		{"XXX", 3.14159, "3.14"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code+" "+tt.want, func(t *testing.T) {
+			assert.Equal(t, tt.want, FormatMinorUnits(tt.code, tt.amount))
+		})
+	}
+}
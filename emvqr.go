@@ -0,0 +1,318 @@
+package ledger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// EMVCo merchant-presented mode data object IDs used by the ledger.
+const (
+	emvPayloadFormatIndicator = "00"
+	emvPointOfInitiation      = "01"
+	emvMerchantAccountInfo    = "26"
+	emvMerchantCategoryCode   = "52"
+	emvTransactionCurrency    = "53"
+	emvTransactionAmount      = "54"
+	emvCountryCode            = "58"
+	emvMerchantName           = "59"
+	emvMerchantCity           = "60"
+	emvAdditionalData         = "62"
+	emvCRC                    = "63"
+)
+
+// Sub-tags inside the merchant account information template (ID 26).
+const (
+	emvMerchantGUI       = "00"
+	emvMerchantTenantID  = "01"
+	emvMerchantPaymentID = "02"
+	emvMerchantAccountID = "03"
+)
+
+// Sub-tags inside the additional data field template (ID 62).
+const (
+	emvReferenceLabel = "05"
+)
+
+const (
+	// EMVMerchantGUI is the globally unique identifier written in the merchant
+	// account information template so that payer apps can recognise nil codes.
+	EMVMerchantGUI = "sd.nil"
+	// EMVStaticQR marks a reusable code where the payer enters the amount.
+	EMVStaticQR = "11"
+	// EMVDynamicQR marks a single-use code with a fixed amount.
+	EMVDynamicQR = "12"
+
+	emvDefaultCountry = "SD"
+	emvDefaultCity    = "Khartoum"
+	emvDefaultMCC     = "0000"
+)
+
+// emvCurrencyCodes maps ISO 4217 alpha codes to the numeric codes EMVCo expects.
+var emvCurrencyCodes = map[string]string{
+	"SDG": "938",
+	"USD": "840",
+	"EUR": "978",
+	"SAR": "682",
+	"AED": "784",
+	"EGP": "818",
+}
+
+// EncodeEMVQR encodes a QR payment request into an EMVCo merchant-presented
+// TLV string terminated with its CRC.
+func EncodeEMVQR(qr QRPaymentRequest) (string, error) {
+	if qr.TenantID == "" || qr.PaymentID == "" {
+		return "", errors.New("tenant id and payment id are required to encode a QR payment")
+	}
+	currency := qr.Currency
+	if currency == "" {
+		currency = "SDG"
+	}
+	numericCurrency, ok := emvCurrencyCodes[currency]
+	if !ok {
+		return "", fmt.Errorf("currency %s has no EMV numeric code", currency)
+	}
+
+	merchantInfo, err := emvTLV(
+		emvField{emvMerchantGUI, EMVMerchantGUI},
+		emvField{emvMerchantTenantID, qr.TenantID},
+		emvField{emvMerchantPaymentID, qr.PaymentID},
+		emvField{emvMerchantAccountID, qr.AccountID},
+	)
+	if err != nil {
+		return "", err
+	}
+	additionalData, err := emvTLV(emvField{emvReferenceLabel, qr.PaymentID})
+	if err != nil {
+		return "", err
+	}
+
+	initiation := EMVDynamicQR
+	if qr.Amount <= 0 {
+		initiation = EMVStaticQR
+	}
+	var amount string
+	if qr.Amount > 0 {
+		amount = strconv.FormatFloat(qr.Amount, 'f', 2, 64)
+	}
+
+	merchantName := qr.AccountID
+	if merchantName == "" {
+		merchantName = qr.TenantID
+	}
+
+	payload, err := emvTLV(
+		emvField{emvPayloadFormatIndicator, "01"},
+		emvField{emvPointOfInitiation, initiation},
+		emvField{emvMerchantAccountInfo, merchantInfo},
+		emvField{emvMerchantCategoryCode, emvDefaultMCC},
+		emvField{emvTransactionCurrency, numericCurrency},
+		emvField{emvTransactionAmount, amount},
+		emvField{emvCountryCode, emvDefaultCountry},
+		emvField{emvMerchantName, merchantName},
+		emvField{emvMerchantCity, emvDefaultCity},
+		emvField{emvAdditionalData, additionalData},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return appendEMVCRC(payload), nil
+}
+
+// ParseEMVQR validates the CRC of an EMVCo payload and extracts the nil tenant,
+// payment ID, account and amount from it.
+func ParseEMVQR(payload string) (*QRPaymentRequest, error) {
+	body, err := stripEMVCRC(payload)
+	if err != nil {
+		return nil, err
+	}
+	return parseEMVBody(body)
+}
+
+// parseEMVBody decodes the TLV body of a payload, without its CRC field.
+func parseEMVBody(body string) (*QRPaymentRequest, error) {
+	fields, err := parseEMVTLV(body)
+	if err != nil {
+		return nil, err
+	}
+	if fields[emvPayloadFormatIndicator] != "01" {
+		return nil, fmt.Errorf("unsupported payload format indicator %q", fields[emvPayloadFormatIndicator])
+	}
+
+	merchantInfo, err := parseEMVTLV(fields[emvMerchantAccountInfo])
+	if err != nil {
+		return nil, fmt.Errorf("invalid merchant account information: %w", err)
+	}
+	if merchantInfo[emvMerchantGUI] != EMVMerchantGUI {
+		return nil, fmt.Errorf("QR payload is not issued by %s", EMVMerchantGUI)
+	}
+
+	qr := QRPaymentRequest{
+		TenantID:  merchantInfo[emvMerchantTenantID],
+		PaymentID: merchantInfo[emvMerchantPaymentID],
+		AccountID: merchantInfo[emvMerchantAccountID],
+		UUID:      merchantInfo[emvMerchantPaymentID],
+		ToAccount: merchantInfo[emvMerchantAccountID],
+	}
+	if qr.TenantID == "" || qr.PaymentID == "" {
+		return nil, errors.New("QR payload is missing tenant id or payment id")
+	}
+
+	for alpha, numeric := range emvCurrencyCodes {
+		if numeric == fields[emvTransactionCurrency] {
+			qr.Currency = alpha
+			break
+		}
+	}
+
+	if amount := fields[emvTransactionAmount]; amount != "" {
+		qr.Amount, err = strconv.ParseFloat(amount, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transaction amount %q: %w", amount, err)
+		}
+	}
+
+	return &qr, nil
+}
+
+// QRCodePNG renders the payload as a PNG image of size x size pixels.
+func QRCodePNG(payload string, size int) ([]byte, error) {
+	png, err := qrcode.Encode(payload, qrcode.Medium, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render QR code: %v", err)
+	}
+	return png, nil
+}
+
+// QRCodeSVG renders the payload as an SVG document of size x size pixels.
+func QRCodeSVG(payload string, size int) ([]byte, error) {
+	code, err := qrcode.New(payload, qrcode.Medium)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render QR code: %v", err)
+	}
+	bitmap := code.Bitmap()
+	modules := len(bitmap)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, modules, modules)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#ffffff"/><path fill="#000000" d="`, modules, modules)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes(), nil
+}
+
+type emvField struct {
+	id    string
+	value string
+}
+
+// emvTLV serializes fields as ID + two digit length + value, skipping empty values.
+func emvTLV(fields ...emvField) (string, error) {
+	var sb strings.Builder
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		if len(f.value) > 99 {
+			return "", fmt.Errorf("EMV field %s is too long (%d characters)", f.id, len(f.value))
+		}
+		fmt.Fprintf(&sb, "%s%02d%s", f.id, len(f.value), f.value)
+	}
+	return sb.String(), nil
+}
+
+// parseEMVTLV splits a TLV string into a map keyed by data object ID.
+func parseEMVTLV(s string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for i := 0; i < len(s); {
+		if i+4 > len(s) {
+			return nil, fmt.Errorf("truncated EMV field at offset %d", i)
+		}
+		id := s[i : i+2]
+		length, err := strconv.Atoi(s[i+2 : i+4])
+		if err != nil {
+			return nil, fmt.Errorf("invalid length for EMV field %s: %w", id, err)
+		}
+		i += 4
+		if i+length > len(s) {
+			return nil, fmt.Errorf("EMV field %s overflows the payload", id)
+		}
+		if _, ok := fields[id]; ok {
+			// a repeated field could override a signed value
+			return nil, fmt.Errorf("duplicate EMV field %s", id)
+		}
+		fields[id] = s[i : i+length]
+		i += length
+	}
+	return fields, nil
+}
+
+// emvFieldOffset returns the offset at which the top-level field id starts in a
+// TLV body, or -1 if the field is absent.
+func emvFieldOffset(body, id string) (int, error) {
+	for i := 0; i < len(body); {
+		if i+4 > len(body) {
+			return 0, fmt.Errorf("truncated EMV field at offset %d", i)
+		}
+		if body[i:i+2] == id {
+			return i, nil
+		}
+		length, err := strconv.Atoi(body[i+2 : i+4])
+		if err != nil {
+			return 0, fmt.Errorf("invalid length for EMV field %s: %w", body[i:i+2], err)
+		}
+		i += 4 + length
+	}
+	return -1, nil
+}
+
+// appendEMVCRC terminates a TLV body with the CRC data object.
+func appendEMVCRC(body string) string {
+	body += emvCRC + "04"
+	return body + fmt.Sprintf("%04X", crc16CCITT([]byte(body)))
+}
+
+// stripEMVCRC validates the trailing CRC of a payload and returns the TLV body
+// that precedes it.
+func stripEMVCRC(payload string) (string, error) {
+	if len(payload) < 8 {
+		return "", errors.New("QR payload is too short")
+	}
+	crcStart := len(payload) - 8
+	if payload[crcStart:crcStart+4] != emvCRC+"04" {
+		return "", errors.New("QR payload does not end with a CRC field")
+	}
+	expected := fmt.Sprintf("%04X", crc16CCITT([]byte(payload[:crcStart+4])))
+	if !strings.EqualFold(expected, payload[crcStart+4:]) {
+		return "", fmt.Errorf("QR payload CRC mismatch: got %s, want %s", payload[crcStart+4:], expected)
+	}
+	return payload[:crcStart], nil
+}
+
+// crc16CCITT computes CRC-16/CCITT-FALSE (poly 0x1021, init 0xFFFF) as
+// mandated by EMVCo for the payload checksum.
+func crc16CCITT(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,73 @@
+package ledger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCRC16CCITT(t *testing.T) {
+	// Standard check value for CRC-16/CCITT-FALSE.
+	assert.Equal(t, uint16(0x29B1), crc16CCITT([]byte("123456789")))
+}
+
+func TestEncodeParseEMVQR(t *testing.T) {
+	tests := []struct {
+		name    string
+		qr      QRPaymentRequest
+		wantErr bool
+	}{
+		{"dynamic code", QRPaymentRequest{TenantID: "nil", PaymentID: "2hdIAOLMzFJIElMoPZ3R9DGR3DQ", AccountID: "0111493885", Amount: 100.5}, false},
+		{"static code", QRPaymentRequest{TenantID: "nonil", PaymentID: "2hdIAOLMzFJIElMoPZ3R9DGR3DR", AccountID: "0965256869"}, false},
+		{"usd code", QRPaymentRequest{TenantID: "nil", PaymentID: "abc", AccountID: "0111493885", Amount: 3, Currency: "USD"}, false},
+		{"missing payment id", QRPaymentRequest{TenantID: "nil", AccountID: "0111493885", Amount: 1}, true},
+		{"unknown currency", QRPaymentRequest{TenantID: "nil", PaymentID: "abc", Amount: 1, Currency: "XYZ"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := EncodeEMVQR(tt.qr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EncodeEMVQR() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			assert.True(t, strings.HasPrefix(payload, "000201"))
+
+			got, err := ParseEMVQR(payload)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.qr.TenantID, got.TenantID)
+			assert.Equal(t, tt.qr.PaymentID, got.PaymentID)
+			assert.Equal(t, tt.qr.AccountID, got.AccountID)
+			assert.Equal(t, tt.qr.Amount, got.Amount)
+		})
+	}
+}
+
+func TestParseEMVQRRejectsTampering(t *testing.T) {
+	payload, err := EncodeEMVQR(QRPaymentRequest{TenantID: "nil", PaymentID: "abc", AccountID: "0111493885", Amount: 10})
+	assert.NoError(t, err)
+
+	tampered := strings.Replace(payload, "540510.00", "540590.00", 1)
+	assert.NotEqual(t, payload, tampered)
+	_, err = ParseEMVQR(tampered)
+	assert.Error(t, err)
+
+	_, err = ParseEMVQR(payload[:len(payload)-8])
+	assert.Error(t, err)
+}
+
+func TestQRCodeRendering(t *testing.T) {
+	payload, err := EncodeEMVQR(QRPaymentRequest{TenantID: "nil", PaymentID: "abc", AccountID: "0111493885", Amount: 10})
+	assert.NoError(t, err)
+
+	png, err := QRCodePNG(payload, 256)
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(png, []byte("\x89PNG")))
+
+	svg, err := QRCodeSVG(payload, 256)
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(svg, []byte("<svg")))
+}
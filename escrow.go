@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"slices"
 	"strconv"
 	"time"
 
@@ -12,58 +13,167 @@ import (
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/davecgh/go-spew/spew"
 	"github.com/segmentio/ksuid"
 )
 
-// Optional: Implement MarshalDynamoDBAttributeValue for consistency
-// func (s Status) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
-// 	str, ok := statusEnumToString[s]
-// 	if !ok {
-// 		return nil, fmt.Errorf("unknown status: %d", s)
-// 	}
-
-// 	return &types.AttributeValueMemberS{Value: str}, nil
-// }
-
 const EscrowTransactionsTable = "EscrowTransactions"
 const ESCROW_ACCOUNT = "NIL_ESCROW_ACCOUNT"
 const ESCROW_TENANT = "ESCROW_TENANT"
 const ServiceProvidersTransactions = "ServiceProviderTransactions"
+const EscrowIdempotencyTable = "EscrowIdempotencyKeys"
 
+// escrowIdempotencyKey maps a request UUID to the escrow it created.
+type escrowIdempotencyKey struct {
+	UUID          string `dynamodbav:"UUID"`
+	TransactionID string `dynamodbav:"TransactionID"`
+	CreatedAt     string `dynamodbav:"CreatedAt"`
+}
+
+// EscrowRequest holds esEntry.Amount in escrow and records the escrow, see
+// CreateEscrow. Repeating a request with the same UUID returns the stored
+// escrow's transaction instead of escrowing the amount again.
 func EscrowRequest(context context.Context, dbSvc *dynamodb.Client, esEntry EscrowEntry) (NilResponse, error) {
 	log.Printf("the escrow request is %+v", esEntry)
-	var response NilResponse
 
-	timestamp := getCurrentTimestamp()
-	transactionStatus := StatusPending
+	es, replayed, err := CreateEscrow(context, dbSvc, esEntry)
+	if err != nil {
+		var escrowErr *EscrowCreationError
+		if errors.As(err, &escrowErr) {
+			return NilResponse{
+				Status:    "error",
+				Code:      escrowErr.Code,
+				Message:   escrowErr.Message,
+				Details:   escrowErr.Err.Error(),
+				Timestamp: esEntry.Timestamp,
+				Data: data{
+					UUID:       esEntry.InitiatorUUID,
+					SignedUUID: esEntry.SignedUUID,
+				},
+			}, err
+		}
+		return NilResponse{}, err
+	}
 
-	uid := ksuid.New().String()
+	message := "Transaction initiated successfully."
+	if replayed {
+		message = "Escrow already exists for this uuid."
+	}
+	return NilResponse{
+		Status:    "success",
+		Code:      "successful_transaction",
+		Message:   message,
+		Timestamp: es.Timestamp,
+		Data: data{
+			FromAccount:   es.FromAccount,
+			TransactionID: es.SystemTransactionID,
+			Amount:        es.Amount,
+			Currency:      es.EscrowCurrency(),
+			UUID:          es.InitiatorUUID,
+			SignedUUID:    esEntry.SignedUUID,
+		},
+	}, nil
+}
+
+// ErrEscrowCurrency is returned for escrows in a currency other than
+// DefaultCurrency. Every escrow is held in the one ESCROW_ACCOUNT balance,
+// which cannot keep other currencies apart.
+var ErrEscrowCurrency = errors.New("escrows can only be held in " + DefaultCurrency)
 
-	es := EscrowTransaction{
-		FromAccount:      esEntry.FromAccount,
-		FromTenantID:     esEntry.FromTenantID,
-		ToAccount:        ESCROW_ACCOUNT, // We need to make sure that ESCROW_ACCOUNT is an exception
-		ToTenantID:       ESCROW_TENANT,
-		Amount:           esEntry.Amount,
-		InitiatorUUID:    esEntry.InitiatorUUID,
-		PaymentReference: esEntry.PaymentReference,
+// EscrowCreationError carries the NilResponse code for a rejected escrow request.
+type EscrowCreationError struct {
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *EscrowCreationError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Code, e.Err)
+}
+
+func (e *EscrowCreationError) Unwrap() error {
+	return e.Err
+}
+
+// CreateEscrow debits the sender, credits the escrow account and stores the
+// EscrowTransaction in a single DynamoDB transaction, so either all of it
+// happens or none of it does. The request UUID is the idempotency key: when an
+// escrow was already created for it, the stored escrow is returned with
+// replayed set and nothing is written. Reusing a UUID for a different request
+// fails with ErrEscrowIdempotencyConflict.
+func CreateEscrow(ctx context.Context, dbSvc *dynamodb.Client, esEntry EscrowEntry) (es *EscrowTransaction, replayed bool, err error) {
+	if esEntry.InitiatorUUID == "" {
+		return nil, false, &EscrowCreationError{"missing_uuid", "A uuid is required to create an escrow.", errors.New("uuid is required")}
+	}
+	if esEntry.FromAccount == "" {
+		return nil, false, &EscrowCreationError{"user_not_found", "Error in retrieving sender.", errors.New("from_account is required")}
 	}
 
-	if _, err := EscrowTransferCredits(context, dbSvc, es); err != nil {
-		return NilResponse{}, err
+	if stored, err := getEscrowByIdempotencyKey(ctx, dbSvc, esEntry.InitiatorUUID); err != nil {
+		return nil, false, err
+	} else if stored != nil {
+		return replayedEscrow(stored, esEntry)
 	}
 
-	es.Status = transactionStatus
-	es.SystemTransactionID = uid
-	es.TransactionDate = timestamp
+	if taken, err := paymentReferenceTaken(ctx, dbSvc, esEntry.ServiceProvider, esEntry.PaymentReference); err != nil {
+		return nil, false, err
+	} else if taken {
+		return nil, false, duplicateReferenceError(esEntry)
+	}
 
-	// HERE we are supposed to ensure that from and to are actually matches what we want
-	// Now, after you have done that, you should write these to Table
-	// What we need here is a fully fledged EscrowTransaction
-	cashOutProvider := "nil"
-	if esEntry.CashoutProvider != "" {
-		cashOutProvider = esEntry.CashoutProvider
+	cashoutProvider, err := GetCashoutProvider(esEntry.CashoutProvider)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := cashoutProvider.ValidateBeneficiary(ctx, dbSvc, EscrowTransaction{
+		ToAccount:       esEntry.ToAccount,
+		ToTenantID:      esEntry.ToTenantID,
+		Beneficiary:     esEntry.Beneficiary,
+		ServiceProvider: esEntry.ServiceProvider,
+	}); err != nil {
+		return nil, false, &EscrowCreationError{"user_not_found", "Error in retrieving receiver.", fmt.Errorf("invalid beneficiary: %w", err)}
+	}
+	if err := checkServiceProviderActive(ctx, dbSvc, esEntry.ServiceProvider); errors.Is(err, ErrServiceProviderInactive) {
+		return nil, false, &EscrowCreationError{"service_provider_inactive", "Service provider is not accepting escrows.", err}
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	sender, err := GetAccountBalance(ctx, dbSvc, TransactionEntry{AccountID: esEntry.FromAccount, FromAccount: esEntry.FromAccount, TenantID: esEntry.FromTenantID})
+	if err != nil || sender == nil {
+		return nil, false, &EscrowCreationError{"user_not_found", "Error in retrieving sender.", fmt.Errorf("error in retrieving sender: %v", err)}
+	}
+	if err := ValidateCurrencyAmount(sender.AccountCurrency(), esEntry.Amount); err != nil {
+		return nil, false, &EscrowCreationError{EscrowCodeInvalidAmount, "Invalid amount for the account currency.", err}
+	}
+	if sender.AccountCurrency() != DefaultCurrency {
+		return nil, false, &EscrowCreationError{"unsupported_currency", "Escrow is not available for this account currency.",
+			fmt.Errorf("%w: account %s holds %s", ErrEscrowCurrency, esEntry.FromAccount, sender.AccountCurrency())}
+	}
+	if err := ValidateEscrowCorridor(ctx, dbSvc, esEntry.FromTenantID, esEntry.ToTenantID, esEntry.Amount, sender.AccountCurrency()); err != nil {
+		var policyErr *EscrowPolicyError
+		if errors.As(err, &policyErr) {
+			return nil, false, &EscrowCreationError{policyErr.Code, "Escrow is not allowed for this corridor.", err}
+		}
+		return nil, false, err
+	}
+	if err := checkTenantTransfer(ctx, dbSvc, esEntry.FromTenantID, esEntry.ToTenantID, esEntry.Amount); errors.Is(err, ErrTenantInactive) || errors.Is(err, ErrTenantLimit) {
+		return nil, false, &EscrowCreationError{tenantTransferCode(err), "The tenant does not allow this escrow.", err}
+	} else if err != nil {
+		return nil, false, err
+	}
+	fee, feeSplit, err := escrowFeeSplit(ctx, dbSvc, esEntry.FromTenantID, esEntry.ToTenantID, esEntry.Amount, sender.AccountCurrency())
+	if err != nil {
+		return nil, false, err
+	}
+	if esEntry.Amount+fee > sender.Amount {
+		return nil, false, &EscrowCreationError{"insufficient_balance", "Insufficient balance to complete the transaction.", errors.New("insufficient balance")}
+	}
+
+	timestamp := getCurrentTimestamp()
+	uid := ksuid.New().String()
+	var expiresAt int64
+	if timeout := EscrowTimeout(cashoutProvider.Name()); timeout > 0 {
+		expiresAt = time.Now().Add(timeout).Unix()
 	}
 	esTransaction := EscrowTransaction{
 		FromAccount:         esEntry.FromAccount,
@@ -71,7 +181,8 @@ func EscrowRequest(context context.Context, dbSvc *dynamodb.Client, esEntry Escr
 		FromTenantID:        esEntry.FromTenantID,
 		ToTenantID:          esEntry.ToTenantID,
 		Amount:              esEntry.Amount,
-		InitiatorUUID:       es.InitiatorUUID,
+		Comment:             esEntry.Comment,
+		InitiatorUUID:       esEntry.InitiatorUUID,
 		SystemTransactionID: uid,
 		TransactionDate:     timestamp,
 		Timestamp:           getCurrentTimeZone(),
@@ -79,29 +190,224 @@ func EscrowRequest(context context.Context, dbSvc *dynamodb.Client, esEntry Escr
 		Beneficiary:         esEntry.Beneficiary,
 		TransientAccount:    ESCROW_ACCOUNT,
 		TransientTenant:     ESCROW_TENANT,
-		CashoutProvider:     cashOutProvider,
+		CashoutProvider:     cashoutProvider.Name(),
 		ServiceProvider:     esEntry.ServiceProvider,
 		PaymentReference:    esEntry.PaymentReference,
+		Currency:            sender.AccountCurrency(),
+		History: []EscrowTransition{{
+			From:      StatusPending,
+			To:        StatusInProgress,
+			Actor:     esEntry.FromTenantID,
+			Reason:    "funds held in escrow",
+			Timestamp: getCurrentTimeZone(),
+		}},
+		ExpiresAt: expiresAt,
+	}
+	if fee > 0 {
+		esTransaction.Fee = fee
+		esTransaction.FeeSplit = &feeSplit
 	}
 
-	item, err := attributevalue.MarshalMap(esTransaction)
+	items, err := escrowCreationItems(esTransaction, sender.Version)
 	if err != nil {
-		// reverse the transfer here if fails!
-		return NilResponse{}, fmt.Errorf("failed to marshal transaction: %w", err)
+		return nil, false, err
+	}
+	_, err = dbSvc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 &&
+			aws.ToString(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			// a concurrent request with the same uuid won the race
+			stored, getErr := getEscrowByIdempotencyKey(ctx, dbSvc, esEntry.InitiatorUUID)
+			if getErr != nil {
+				return nil, false, getErr
+			}
+			if stored != nil {
+				return replayedEscrow(stored, esEntry)
+			}
+		}
+		if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 1 && items[1].Put != nil &&
+			aws.ToString(items[1].Put.TableName) == EscrowReferencesTable &&
+			aws.ToString(canceled.CancellationReasons[1].Code) == "ConditionalCheckFailed" {
+			return nil, false, duplicateReferenceError(esEntry)
+		}
+		return nil, false, &EscrowCreationError{"debit_failed", fmt.Sprintf("Failed to debit from balance for user %s", esEntry.FromAccount), err}
 	}
 
-	input := &dynamodb.PutItemInput{
-		TableName: aws.String(EscrowTransactionsTable), // save it in escrow transactions table
-		Item:      item,
+	transactionStatus := 0
+	status := &transactionStatus
+	if err := SaveToTransactionTable(dbSvc, esEntry.FromTenantID+":"+ESCROW_TENANT, TransactionEntry{
+		AccountID:           esEntry.FromAccount,
+		SystemTransactionID: uid,
+		FromAccount:         esEntry.FromAccount,
+		ToAccount:           ESCROW_ACCOUNT,
+		Amount:              esEntry.Amount,
+		Comment:             "Transfer credits",
+		TransactionDate:     timestamp,
+		Status:              status,
+		InitiatorUUID:       esEntry.InitiatorUUID,
+		Currency:            esTransaction.EscrowCurrency(),
+	}, transactionStatus); err != nil {
+		log.Printf("escrow %s created but its transaction record failed: %v", uid, err)
 	}
 
-	if _, err := dbSvc.PutItem(context, input); err != nil {
-		spew.Dump(item)
-		// reverse the transfer here if fails!
-		return NilResponse{}, fmt.Errorf("failed to put item into DynamoDB: %w - the payload is: %+v", err, item)
+	return &esTransaction, false, nil
+}
+
+// ErrEscrowIdempotencyConflict is returned when a UUID that already created an
+// escrow is sent again with a different request.
+var ErrEscrowIdempotencyConflict = errors.New("uuid was already used for a different escrow")
+
+// replayedEscrow answers a request whose UUID already created stored: the
+// stored escrow if the request is the same, a conflict otherwise.
+func replayedEscrow(stored *EscrowTransaction, esEntry EscrowEntry) (*EscrowTransaction, bool, error) {
+	if mismatch := escrowRequestMismatch(*stored, esEntry); mismatch != "" {
+		return nil, false, &EscrowCreationError{"idempotency_conflict", "This uuid was already used for a different escrow.",
+			fmt.Errorf("%w: %s differs from escrow %s", ErrEscrowIdempotencyConflict, mismatch, stored.SystemTransactionID)}
 	}
+	return stored, true, nil
+}
 
-	return response, nil
+// escrowRequestMismatch names the first field in which esEntry differs from the
+// escrow it is compared with, or returns "" if it would create the same escrow.
+func escrowRequestMismatch(es EscrowTransaction, esEntry EscrowEntry) string {
+	cashoutProvider := esEntry.CashoutProvider
+	if cashoutProvider == "" {
+		cashoutProvider = DefaultCashoutProvider
+	}
+	switch {
+	case es.FromAccount != esEntry.FromAccount || es.FromTenantID != esEntry.FromTenantID:
+		return "from_account"
+	case es.ToAccount != esEntry.ToAccount || es.ToTenantID != esEntry.ToTenantID:
+		return "to_account"
+	case es.Amount != esEntry.Amount:
+		return "amount"
+	case es.Beneficiary != esEntry.Beneficiary:
+		return "beneficiary"
+	case es.ServiceProvider != esEntry.ServiceProvider:
+		return "service_provider"
+	case es.PaymentReference != esEntry.PaymentReference:
+		return "service_provider_transaction_id"
+	case es.CashoutProvider != "" && es.CashoutProvider != cashoutProvider:
+		return "cashout_provider"
+	}
+	return ""
+}
+
+// escrowCreationItems are the writes that create an escrow: the idempotency
+// key, the sender debit and the escrow account credit with their ledger
+// entries, and the escrow record itself. The idempotency key comes first so a
+// duplicate is recognisable from the cancellation reasons, followed by the
+// service provider's payment reference when there is one. The sender is debited
+// es.Fee on top of the escrowed amount, credited to the fee shares last.
+func escrowCreationItems(es EscrowTransaction, senderVersion int64) ([]types.TransactWriteItem, error) {
+	debitEntry := LedgerEntry{
+		TenantID:            es.FromTenantID,
+		AccountID:           es.FromAccount,
+		Amount:              es.Amount + es.Fee,
+		SystemTransactionID: es.SystemTransactionID,
+		Type:                "debit",
+		Time:                es.TransactionDate,
+		InitiatorUUID:       es.InitiatorUUID,
+	}
+	creditEntry := LedgerEntry{
+		TenantID:            ESCROW_TENANT,
+		AccountID:           ESCROW_ACCOUNT,
+		Amount:              es.Amount,
+		SystemTransactionID: es.SystemTransactionID,
+		Type:                "credit",
+		Time:                es.TransactionDate,
+		InitiatorUUID:       es.InitiatorUUID,
+	}
+
+	avDebit, err := attributevalue.MarshalMap(debitEntry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ledger entry: %v", err)
+	}
+	avCredit, err := attributevalue.MarshalMap(creditEntry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal ledger entry: %v", err)
+	}
+	avEscrow, err := attributevalue.MarshalMap(es)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal transaction: %w", err)
+	}
+	avKey, err := attributevalue.MarshalMap(escrowIdempotencyKey{
+		UUID:          es.InitiatorUUID,
+		TransactionID: es.SystemTransactionID,
+		CreatedAt:     es.Timestamp,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal idempotency key: %w", err)
+	}
+
+	amount := amountNumber(es.EscrowCurrency(), es.Amount)
+	debit := amountNumber(es.EscrowCurrency(), es.Amount+es.Fee)
+	newVersion := &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)}
+
+	refPut, err := escrowReferencePut(es)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []types.TransactWriteItem{
+		{Put: &types.Put{
+			TableName:           aws.String(EscrowIdempotencyTable),
+			Item:                avKey,
+			ConditionExpression: aws.String("attribute_not_exists(#uuid)"),
+			ExpressionAttributeNames: map[string]string{
+				"#uuid": "UUID",
+			},
+		}},
+		{Update: shardBalanceUpdate(&types.Update{
+			TableName: aws.String(NilUsers),
+			Key: map[string]types.AttributeValue{
+				"TenantID":  &types.AttributeValueMemberS{Value: es.FromTenantID},
+				"AccountID": &types.AttributeValueMemberS{Value: es.FromAccount},
+			},
+			UpdateExpression:    aws.String("SET amount = amount - :amount, Version = :newVersion"),
+			ConditionExpression: aws.String("attribute_not_exists(Version) OR Version = :oldVersion"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":amount":     debit,
+				":oldVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(senderVersion, 10)},
+				":newVersion": newVersion,
+			},
+		}, es.FromTenantID, es.FromAccount, es.EscrowCurrency(), -(es.Amount + es.Fee))},
+		{Put: &types.Put{
+			TableName: aws.String(LedgerTable),
+			Item:      avDebit,
+		}},
+		{Update: shardBalanceUpdate(&types.Update{
+			TableName: aws.String(NilUsers),
+			Key: map[string]types.AttributeValue{
+				"TenantID":  &types.AttributeValueMemberS{Value: ESCROW_TENANT},
+				"AccountID": &types.AttributeValueMemberS{Value: ESCROW_ACCOUNT},
+			},
+			UpdateExpression:    aws.String("SET amount = amount + :amount, Version = :newVersion"),
+			ConditionExpression: aws.String("attribute_exists(AccountID)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":amount":     amount,
+				":newVersion": newVersion,
+			},
+		}, ESCROW_TENANT, ESCROW_ACCOUNT, es.EscrowCurrency(), es.Amount)},
+		{Put: &types.Put{
+			TableName: aws.String(LedgerTable),
+			Item:      avCredit,
+		}},
+		{Put: &types.Put{
+			TableName: aws.String(EscrowTransactionsTable),
+			Item:      avEscrow,
+		}},
+	}
+	if refPut != nil {
+		// second, so a reused reference is recognisable as well
+		items = slices.Insert(items, 1, types.TransactWriteItem{Put: refPut})
+	}
+	feeItems, err := feeShareItems(es)
+	if err != nil {
+		return nil, err
+	}
+	return append(items, feeItems...), nil
 }
 
 func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEntry EscrowTransaction) (NilResponse, error) {
@@ -130,7 +436,7 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 	}
 
 	// Fetch sender account - sender here is the escrow account
-	sender, err := GetAccount(context, dbSvc, TransactionEntry{AccountID: trEntry.FromAccount, FromAccount: trEntry.FromAccount, TenantID: trEntry.FromTenantID})
+	sender, err := GetAccountBalance(context, dbSvc, TransactionEntry{AccountID: trEntry.FromAccount, FromAccount: trEntry.FromAccount, TenantID: trEntry.FromTenantID})
 	if err != nil || sender == nil {
 		SaveToTransactionTable(dbSvc, combinedTenants, transaction, transactionStatus)
 		response = NilResponse{
@@ -146,11 +452,15 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 		}
 		return response, err
 	}
+	transaction.Currency = trEntry.EscrowCurrency()
 
-	// here it might be the case where by the output is for bankak or any other provider..
-	if trEntry.CashoutProvider == "bok" {
-		receiver, err := GetAccount(context, dbSvc, TransactionEntry{AccountID: trEntry.ToAccount, FromAccount: trEntry.ToAccount, TenantID: trEntry.ToTenantID})
-		if err != nil || receiver == nil {
+	// payout legs name their cashout provider, which knows how to validate the receiver
+	if trEntry.CashoutProvider != "" {
+		provider, err := GetCashoutProvider(trEntry.CashoutProvider)
+		if err == nil {
+			err = provider.ValidateBeneficiary(context, dbSvc, trEntry)
+		}
+		if err != nil {
 			SaveToTransactionTable(dbSvc, combinedTenants, transaction, transactionStatus)
 			response = NilResponse{
 				Status:    "error",
@@ -212,10 +522,14 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 		return response, fmt.Errorf("failed to marshal ledger entry: %v", err)
 	}
 
+	debitShard, err := pickDebitShard(context, dbSvc, trEntry.FromTenantID, trEntry.FromAccount, trEntry.Amount)
+	if err != nil {
+		return response, err
+	}
 	debitInput := &dynamodb.TransactWriteItemsInput{
 		TransactItems: []types.TransactWriteItem{
 			{
-				Update: &types.Update{
+				Update: shardDebitUpdate(&types.Update{
 					TableName: aws.String(NilUsers),
 					Key: map[string]types.AttributeValue{
 						"TenantID":  &types.AttributeValueMemberS{Value: trEntry.FromTenantID}, // use old tenant you got
@@ -224,11 +538,11 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 					UpdateExpression:    aws.String("SET amount = amount - :amount, Version = :newVersion"),
 					ConditionExpression: aws.String("attribute_not_exists(Version) OR Version = :oldVersion"),
 					ExpressionAttributeValues: map[string]types.AttributeValue{
-						":amount":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", trEntry.Amount)},
+						":amount":     amountNumber(trEntry.EscrowCurrency(), trEntry.Amount),
 						":oldVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(sender.Version, 10)},
 						":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
 					},
-				},
+				}, trEntry.FromTenantID, trEntry.FromAccount, trEntry.EscrowCurrency(), trEntry.Amount, debitShard),
 			},
 			{Put: &types.Put{
 				TableName: aws.String(LedgerTable),
@@ -260,7 +574,7 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 	creditInput := &dynamodb.TransactWriteItemsInput{
 		TransactItems: []types.TransactWriteItem{
 			{
-				Update: &types.Update{
+				Update: shardBalanceUpdate(&types.Update{
 					TableName: aws.String(NilUsers),
 					Key: map[string]types.AttributeValue{
 						"TenantID":  &types.AttributeValueMemberS{Value: trEntry.ToTenantID},
@@ -269,11 +583,11 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 					UpdateExpression:    aws.String("SET amount = amount + :amount, Version = :newVersion"),
 					ConditionExpression: aws.String("attribute_exists(AccountID) AND TenantID = :tenantID"),
 					ExpressionAttributeValues: map[string]types.AttributeValue{
-						":amount":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", trEntry.Amount)},
+						":amount":     amountNumber(trEntry.EscrowCurrency(), trEntry.Amount),
 						":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
 						":tenantID":   &types.AttributeValueMemberS{Value: trEntry.ToTenantID},
 					},
-				},
+				}, trEntry.ToTenantID, trEntry.ToAccount, trEntry.EscrowCurrency(), trEntry.Amount),
 			},
 			{Put: &types.Put{
 				TableName: aws.String(LedgerTable),
@@ -293,12 +607,13 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 			UpdateExpression:    aws.String("SET amount = amount + :amount, Version = :newVersion"),
 			ConditionExpression: aws.String("attribute_not_exists(Version) OR Version = :oldVersion"),
 			ExpressionAttributeValues: map[string]types.AttributeValue{
-				":amount":     &types.AttributeValueMemberN{Value: fmt.Sprintf("%.2f", trEntry.Amount)},
+				":amount":     amountNumber(trEntry.EscrowCurrency(), trEntry.Amount),
 				":oldVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(sender.Version, 10)},
 				":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
 			},
 		}
 
+		rollbackInput = shardBalanceUpdateItem(rollbackInput, trEntry.FromTenantID, trEntry.FromAccount, trEntry.EscrowCurrency(), trEntry.Amount)
 		_, rollbackErr := dbSvc.UpdateItem(context, rollbackInput)
 		if rollbackErr != nil {
 			panic(fmt.Errorf("failed to rollback debit for user %s: %v", trEntry.FromAccount, rollbackErr))
@@ -345,7 +660,7 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 		Data: data{
 			TransactionID: uid,
 			Amount:        trEntry.Amount,
-			Currency:      "SDG",
+			Currency:      trEntry.EscrowCurrency(),
 			UUID:          trEntry.InitiatorUUID,
 			SignedUUID:    trEntry.SignedUUID,
 		},
@@ -354,35 +669,26 @@ func EscrowTransferCredits(context context.Context, dbSvc *dynamodb.Client, trEn
 	return response, nil
 }
 
+// GetEscrowTransactions returns every escrow sent from tenantID, newest first.
 func GetEscrowTransactions(ctx context.Context, dbSvc *dynamodb.Client, tenantID string) ([]EscrowTransaction, error) {
-	indexName := "FromTenantIDIndex"
-	input := &dynamodb.QueryInput{
-		TableName: aws.String("EscrowTransactions"),
-		IndexName: aws.String(indexName), // Use the appropriate GSI
-		KeyConditions: map[string]types.Condition{
-			"FromTenantID": {
-				ComparisonOperator: types.ComparisonOperatorEq,
-				AttributeValueList: []types.AttributeValue{
-					&types.AttributeValueMemberS{Value: tenantID},
-				},
-			},
-		},
-	}
-
-	result, err := dbSvc.Query(ctx, input)
-	if err != nil {
-		return nil, fmt.Errorf("failed to query transactions: %w", err)
-	}
-
+	filter := EscrowFilter{FromTenantID: tenantID, Limit: 100}
 	var transactions []EscrowTransaction
-	if err := attributevalue.UnmarshalListOfMaps(result.Items, &transactions); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal transactions: %w", err)
+	for {
+		page, err := ListEscrowTransactions(ctx, dbSvc, filter)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, page.Escrows...)
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
 	}
-
-	log.Printf("the items are: %+v", transactions)
 	return transactions, nil
 }
 
+// CreateServiceProvider registers a service provider with a new webhook
+// signing key, unless it brings its own; GetServiceProvider returns the key.
 func CreateServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, serviceProvider ServiceProvider) error {
 	// Marshal the ServiceProvider struct into a DynamoDB item
 	if serviceProvider.Email == "" {
@@ -392,7 +698,14 @@ func CreateServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, serviceP
 		return fmt.Errorf("tenantID and escrowAccount are required")
 	}
 	if serviceProvider.Currency == "" {
-		serviceProvider.Currency = "SDG"
+		serviceProvider.Currency = DefaultCurrency
+	}
+	if serviceProvider.WebhookSigningKey == "" {
+		key, err := newWebhookSigningKey()
+		if err != nil {
+			return err
+		}
+		serviceProvider.WebhookSigningKey = key
 	}
 
 	serviceProvider.LastAccessed = time.Now().Format(time.RFC3339)
@@ -403,7 +716,7 @@ func CreateServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, serviceP
 
 	// Create the PutItem input with a condition expression to ensure TenantID is unique
 	input := &dynamodb.PutItemInput{
-		TableName:           aws.String("ServiceProviders"),
+		TableName:           aws.String(ServiceProvidersTable),
 		Item:                item,
 		ConditionExpression: aws.String("attribute_not_exists(Email)"), // Ensure TenantID is unique
 	}
@@ -423,7 +736,7 @@ func CreateServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, serviceP
 
 func GetServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, email string) (*ServiceProvider, error) {
 	input := &dynamodb.GetItemInput{
-		TableName: aws.String("ServiceProviders"),
+		TableName: aws.String(ServiceProvidersTable),
 		Key: map[string]types.AttributeValue{
 			"Email": &types.AttributeValueMemberS{Value: email},
 		},
@@ -435,7 +748,7 @@ func GetServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, email strin
 	}
 
 	if result.Item == nil {
-		return nil, fmt.Errorf("service provider with Email %s not found", email)
+		return nil, fmt.Errorf("%w: %s", ErrServiceProviderNotFound, email)
 	}
 
 	var serviceProvider ServiceProvider
@@ -482,7 +795,7 @@ func UpdateServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, email st
 
 	// Create the update item input with the dynamically built expression
 	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String("ServiceProviders"),
+		TableName: aws.String(ServiceProvidersTable),
 		Key: map[string]types.AttributeValue{
 			"Email": &types.AttributeValueMemberS{Value: email},
 		},
@@ -644,6 +957,47 @@ func GetEscrowTransactionByUUID(ctx context.Context, svc *dynamodb.Client, uuid
 	return transactions, nil
 }
 
+// getEscrowByIdempotencyKey returns the escrow created for uuid, or nil if none was.
+func getEscrowByIdempotencyKey(ctx context.Context, dbSvc *dynamodb.Client, uuid string) (*EscrowTransaction, error) {
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(EscrowIdempotencyTable),
+		Key:            map[string]types.AttributeValue{"UUID": &types.AttributeValueMemberS{Value: uuid}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	var key escrowIdempotencyKey
+	if err := attributevalue.UnmarshalMap(result.Item, &key); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal idempotency key: %w", err)
+	}
+
+	stored, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(EscrowTransactionsTable),
+		Key: map[string]types.AttributeValue{
+			"UUID":          &types.AttributeValueMemberS{Value: key.UUID},
+			"TransactionID": &types.AttributeValueMemberS{Value: key.TransactionID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get escrow transaction: %w", err)
+	}
+	if stored.Item == nil {
+		return nil, fmt.Errorf("escrow %s for uuid %s not found", key.TransactionID, uuid)
+	}
+	var es EscrowTransaction
+	if err := attributevalue.UnmarshalMap(stored.Item, &es); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal escrow transaction: %w", err)
+	}
+	return &es, nil
+}
+
+// IsDuplicateEscrowTransaction reports whether an escrow already exists for uuid.
+// CreateEscrow enforces this atomically; use this only for early feedback.
 func IsDuplicateEscrowTransaction(ctx context.Context, svc *dynamodb.Client, uuid string) bool {
 	// Prepare the Query input
 	input := &dynamodb.QueryInput{
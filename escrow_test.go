@@ -39,7 +39,8 @@ func TestEscrowRequest(t *testing.T) {
 			CashoutProvider: "bok",
 			FromAccount:     "0111493885", ToAccount: "0965256869",
 			ServiceProvider: "oss@pynil.com",
-			Amount:          2, ToTenantID: "nil", FromTenantID: "nonil", InitiatorUUID: "fff"},
+			Beneficiary:     Beneficiary{AccountID: "0965256869", FullName: "Nil Beneficiary"},
+			Amount:          2, ToTenantID: "nil", FromTenantID: "nonil", InitiatorUUID: "ffg"},
 		},
 			NilResponse{}, false},
 	}
@@ -308,3 +309,96 @@ func TestIsDuplicateEscrowTransaction(t *testing.T) {
 		})
 	}
 }
+
+func TestEscrowCreationItems(t *testing.T) {
+	es := EscrowTransaction{
+		SystemTransactionID: "tx-1",
+		FromAccount:         "0111493885",
+		FromTenantID:        "nonil",
+		ToAccount:           "0965256869",
+		ToTenantID:          "nil",
+		Amount:              12.5,
+		InitiatorUUID:       "uuid-1",
+		Status:              StatusInProgress,
+	}
+	items, err := escrowCreationItems(es, 42)
+	assert.NoError(t, err)
+	assert.Len(t, items, 6)
+
+	// the idempotency key must come first so a replay is recognisable from
+	// the first cancellation reason
+	key := items[0].Put
+	assert.NotNil(t, key)
+	assert.Equal(t, EscrowIdempotencyTable, *key.TableName)
+	assert.Equal(t, "attribute_not_exists(#uuid)", *key.ConditionExpression)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "uuid-1"}, key.Item["UUID"])
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "tx-1"}, key.Item["TransactionID"])
+
+	debit := items[1].Update
+	assert.NotNil(t, debit)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "0111493885"}, debit.Key["AccountID"])
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "42"}, debit.ExpressionAttributeValues[":oldVersion"])
+
+	// the escrow account is sharded, so its credit lands on a shard
+	credit := items[3].Update
+	assert.NotNil(t, credit)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: ESCROW_ACCOUNT}, credit.ExpressionAttributeValues[":account"])
+
+	record := items[5].Put
+	assert.NotNil(t, record)
+	assert.Equal(t, EscrowTransactionsTable, *record.TableName)
+	var stored EscrowTransaction
+	assert.NoError(t, attributevalue.UnmarshalMap(record.Item, &stored))
+	assert.Equal(t, es.SystemTransactionID, stored.SystemTransactionID)
+	assert.Equal(t, es.Amount, stored.Amount)
+}
+
+func TestEscrowRequestMismatch(t *testing.T) {
+	stored := EscrowTransaction{
+		FromAccount:      "0111493885",
+		FromTenantID:     "nonil",
+		ToAccount:        "0965256869",
+		ToTenantID:       "nil",
+		Amount:           2,
+		Beneficiary:      Beneficiary{AccountID: "0965256869"},
+		ServiceProvider:  "oss@pynil.com",
+		PaymentReference: "1234567890",
+		CashoutProvider:  DefaultCashoutProvider,
+	}
+	same := EscrowEntry{
+		FromAccount:      "0111493885",
+		FromTenantID:     "nonil",
+		ToAccount:        "0965256869",
+		ToTenantID:       "nil",
+		Amount:           2,
+		Beneficiary:      Beneficiary{AccountID: "0965256869"},
+		ServiceProvider:  "oss@pynil.com",
+		PaymentReference: "1234567890",
+		Comment:          "comments are not compared",
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*EscrowEntry)
+		want   string
+	}{
+		{"same request", func(e *EscrowEntry) {}, ""},
+		{"different amount", func(e *EscrowEntry) { e.Amount = 20 }, "amount"},
+		{"different sender", func(e *EscrowEntry) { e.FromAccount = "0999999999" }, "from_account"},
+		{"different receiving tenant", func(e *EscrowEntry) { e.ToTenantID = "bok" }, "to_account"},
+		{"different beneficiary", func(e *EscrowEntry) { e.Beneficiary.AccountID = "0999999999" }, "beneficiary"},
+		{"different provider", func(e *EscrowEntry) { e.ServiceProvider = "ops@bok.example" }, "service_provider"},
+		{"different cashout provider", func(e *EscrowEntry) { e.CashoutProvider = "bok" }, "cashout_provider"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := same
+			tt.modify(&entry)
+			assert.Equal(t, tt.want, escrowRequestMismatch(stored, entry))
+		})
+	}
+
+	_, replayed, err := replayedEscrow(&stored, EscrowEntry{Amount: 3})
+	assert.False(t, replayed)
+	assert.ErrorIs(t, err, ErrEscrowIdempotencyConflict)
+}
@@ -0,0 +1,193 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Payout outcomes a cashout provider can report.
+const (
+	PayoutConfirmed = "confirmed"
+	PayoutRejected  = "rejected"
+)
+
+// ErrInvalidProviderSignature is returned when a payout confirmation is not
+// signed by the service provider's registered public key.
+var ErrInvalidProviderSignature = errors.New("invalid service provider signature")
+
+// ErrEscrowAlreadyFinalized is returned when a provider reports an outcome that
+// contradicts the escrow's final status.
+var ErrEscrowAlreadyFinalized = errors.New("escrow already finalized with a different outcome")
+
+// PayoutConfirmation is the callback a service provider sends once it has paid
+// out (or refused to pay out) an escrow. The escrow is identified by
+// SystemTransactionID or, failing that, by the provider's PaymentReference.
+type PayoutConfirmation struct {
+	ServiceProvider     string `json:"service_provider"`
+	SystemTransactionID string `json:"transaction_id,omitempty"`
+	PaymentReference    string `json:"service_provider_transaction_id,omitempty"`
+	Outcome             string `json:"outcome"`
+	ProviderReference   string `json:"provider_reference,omitempty"`
+	Reason              string `json:"reason,omitempty"`
+	Signature           string `json:"signature"`
+}
+
+// SignedMessage is the string the provider signs with its private key:
+// transaction_id|service_provider_transaction_id|outcome|provider_reference.
+func (c PayoutConfirmation) SignedMessage() string {
+	return strings.Join([]string{c.SystemTransactionID, c.PaymentReference, c.Outcome, c.ProviderReference}, "|")
+}
+
+// ConfirmEscrowPayout finalizes an InProgress escrow from a provider callback.
+// A confirmed payout completes the escrow and settles the held amount to the
+// provider's escrow account; a rejected payout fails the escrow and refunds the
+// sender. Repeating a callback that was already applied returns the escrow
+// without moving money again.
+func ConfirmEscrowPayout(ctx context.Context, dbSvc *dynamodb.Client, confirmation PayoutConfirmation) (*EscrowTransaction, error) {
+	var target Status
+	switch confirmation.Outcome {
+	case PayoutConfirmed:
+		target = StatusCompleted
+	case PayoutRejected:
+		target = StatusFailed
+	default:
+		return nil, fmt.Errorf("unknown payout outcome %q", confirmation.Outcome)
+	}
+
+	provider, err := GetServiceProvider(ctx, dbSvc, confirmation.ServiceProvider)
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyPublicKeySignature(provider.PublicKey, confirmation.SignedMessage(), confirmation.Signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProviderSignature, err)
+	}
+
+	es, err := findEscrowForConfirmation(ctx, dbSvc, confirmation)
+	if err != nil {
+		return nil, err
+	}
+	if es.ServiceProvider != provider.Email {
+		return nil, fmt.Errorf("escrow %s does not belong to service provider %s", es.SystemTransactionID, provider.Email)
+	}
+
+	if es.Status.IsFinal() || es.Status == StatusDisputed {
+		return replayedConfirmation(es, target)
+	}
+
+	reason := fmt.Sprintf("payout %s by provider", confirmation.Outcome)
+	if confirmation.ProviderReference != "" {
+		reason += " (ref " + confirmation.ProviderReference + ")"
+	}
+	if confirmation.Reason != "" {
+		reason += ": " + confirmation.Reason
+	}
+
+	if es.Status == StatusPending {
+		// nothing has been escrowed yet, so there is nothing to settle
+		if err := TransitionEscrow(ctx, dbSvc, es.InitiatorUUID, es.SystemTransactionID, es.Status, target, provider.Email, reason); err != nil {
+			return confirmationConflict(ctx, dbSvc, es, target, err)
+		}
+		es.Status = target
+		return es, nil
+	}
+
+	// the status change and the settlement are written together: a failed
+	// settlement leaves the escrow InProgress, so the provider can retry
+	es, err = reloadEscrow(ctx, dbSvc, *es)
+	if err != nil {
+		return nil, err
+	}
+	if es.Status != StatusInProgress {
+		return replayedConfirmation(es, target)
+	}
+	attribute, leg := "ReleasedAmount", escrowLeg{
+		ToAccount:  provider.EscrowAccount,
+		ToTenantID: provider.TenantID,
+		Amount:     es.RemainingAmount(),
+	}
+	if target == StatusFailed {
+		attribute, leg = "RefundedAmount", refundLeg(*es, es.RemainingAmount())
+	}
+	if err := finalizeEscrow(ctx, dbSvc, *es, target, attribute, leg, provider.Email, reason); err != nil {
+		return confirmationConflict(ctx, dbSvc, es, target, err)
+	}
+	es.Status = target
+	if target == StatusFailed {
+		es.RefundedAmount += leg.Amount
+	} else {
+		es.ReleasedAmount += leg.Amount
+	}
+	return es, nil
+}
+
+// confirmationConflict turns the error of finalizing es into the answer to the
+// callback. When another callback or the sweeper finalized the escrow first,
+// the callback is treated as a replay.
+func confirmationConflict(ctx context.Context, dbSvc *dynamodb.Client, es *EscrowTransaction, target Status, err error) (*EscrowTransaction, error) {
+	if !errors.Is(err, ErrEscrowStateConflict) {
+		return es, err
+	}
+	latest, getErr := reloadEscrow(ctx, dbSvc, *es)
+	if getErr != nil {
+		return nil, getErr
+	}
+	if latest.Status == StatusInProgress || latest.Status == StatusPending {
+		// only the amounts moved, e.g. a partial release; the provider retries
+		return latest, err
+	}
+	return replayedConfirmation(latest, target)
+}
+
+// replayedConfirmation answers a callback for an escrow that is already final
+// or frozen by a dispute.
+func replayedConfirmation(es *EscrowTransaction, target Status) (*EscrowTransaction, error) {
+	if es.Status == StatusDisputed {
+		return es, fmt.Errorf("%w: escrow %s", ErrEscrowDisputed, es.SystemTransactionID)
+	}
+	if es.Status == target {
+		return es, nil
+	}
+	return es, fmt.Errorf("%w: escrow %s is %s", ErrEscrowAlreadyFinalized, es.SystemTransactionID, es.Status)
+}
+
+func findEscrowForConfirmation(ctx context.Context, dbSvc *dynamodb.Client, confirmation PayoutConfirmation) (*EscrowTransaction, error) {
+	if confirmation.SystemTransactionID != "" {
+		return GetEscrowTransactionBySystemID(ctx, dbSvc, confirmation.SystemTransactionID)
+	}
+	if confirmation.PaymentReference != "" {
+		return GetEscrowTransactionByPaymentReference(ctx, dbSvc, confirmation.ServiceProvider, confirmation.PaymentReference)
+	}
+	return nil, errors.New("either transaction_id or service_provider_transaction_id is required")
+}
+
+// GetEscrowTransactionBySystemID fetches an escrow by its SystemTransactionID.
+func GetEscrowTransactionBySystemID(ctx context.Context, dbSvc *dynamodb.Client, transactionID string) (*EscrowTransaction, error) {
+	result, err := dbSvc.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(EscrowTransactionsTable),
+		IndexName:              aws.String("SystemID"),
+		KeyConditionExpression: aws.String("TransactionID = :transactionID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":transactionID": &types.AttributeValueMemberS{Value: transactionID},
+		},
+		Limit: aws.Int32(1),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query escrow transaction: %w", err)
+	}
+	if len(result.Items) == 0 {
+		return nil, fmt.Errorf("escrow transaction %s not found", transactionID)
+	}
+
+	var es EscrowTransaction
+	if err := attributevalue.UnmarshalMap(result.Items[0], &es); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal escrow transaction: %w", err)
+	}
+	return &es, nil
+}
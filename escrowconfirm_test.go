@@ -0,0 +1,96 @@
+package ledger
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayoutConfirmationSignedMessage(t *testing.T) {
+	conf := PayoutConfirmation{
+		ServiceProvider:     "provider@example.com",
+		SystemTransactionID: "tx-1",
+		PaymentReference:    "ref-1",
+		Outcome:             PayoutConfirmed,
+		ProviderReference:   "bank-99",
+		Reason:              "not signed",
+		Signature:           "not signed either",
+	}
+	assert.Equal(t, "tx-1|ref-1|confirmed|bank-99", conf.SignedMessage())
+}
+
+func TestVerifyPublicKeySignature(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	encodePub := func(pub crypto.PublicKey) string {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		assert.NoError(t, err)
+		return base64.StdEncoding.EncodeToString(der)
+	}
+
+	message := PayoutConfirmation{SystemTransactionID: "tx-1", Outcome: PayoutRejected}.SignedMessage()
+	hashed := sha256.Sum256([]byte(message))
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hashed[:])
+	assert.NoError(t, err)
+	edSig := ed25519.Sign(edKey, []byte(message))
+
+	tests := []struct {
+		name      string
+		publicKey string
+		message   string
+		signature string
+		wantErr   bool
+	}{
+		{"rsa valid", encodePub(&rsaKey.PublicKey), message, base64.StdEncoding.EncodeToString(rsaSig), false},
+		{"ed25519 valid", encodePub(edPub), message, base64.StdEncoding.EncodeToString(edSig), false},
+		{"rsa tampered message", encodePub(&rsaKey.PublicKey), message + "x", base64.StdEncoding.EncodeToString(rsaSig), true},
+		{"ed25519 tampered message", encodePub(edPub), message + "x", base64.StdEncoding.EncodeToString(edSig), true},
+		{"wrong key", encodePub(edPub), message, base64.StdEncoding.EncodeToString(rsaSig), true},
+		{"malformed signature", encodePub(edPub), message, "%%%", true},
+		{"malformed key", "not-a-key", message, base64.StdEncoding.EncodeToString(edSig), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyPublicKeySignature(tt.publicKey, tt.message, tt.signature)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestReplayedConfirmation(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  Status
+		target  Status
+		wantErr error
+	}{
+		{"same outcome", StatusCompleted, StatusCompleted, nil},
+		{"contradicting outcome", StatusFailed, StatusCompleted, ErrEscrowAlreadyFinalized},
+		{"expired", StatusExpired, StatusFailed, ErrEscrowAlreadyFinalized},
+		{"disputed", StatusDisputed, StatusCompleted, ErrEscrowDisputed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := replayedConfirmation(&EscrowTransaction{SystemTransactionID: "tx-1", Status: tt.status}, tt.target)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
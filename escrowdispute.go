@@ -0,0 +1,405 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+const EscrowDisputesTable = "EscrowDisputes"
+
+// Dispute statuses.
+const (
+	DisputeOpen     = "OPEN"
+	DisputeResolved = "RESOLVED"
+)
+
+// Dispute outcomes.
+const (
+	DisputeRelease = "release" // pay the remaining escrow to its ToAccount
+	DisputeRefund  = "refund"  // return the remaining escrow to the sender
+	DisputeSplit   = "split"   // release the given splits, refund the rest
+)
+
+// Actions recorded in a dispute's trail.
+const (
+	DisputeActionOpened   = "opened"
+	DisputeActionAssigned = "assigned"
+	DisputeActionEvidence = "evidence_added"
+	DisputeActionResolved = "resolved"
+)
+
+// ErrEscrowDisputed is returned when an escrow cannot be settled because a
+// dispute against it is open.
+var ErrEscrowDisputed = errors.New("escrow is under dispute")
+
+// ErrDisputeNotOpen is returned when changing a dispute that is already resolved.
+var ErrDisputeNotOpen = errors.New("dispute is not open")
+
+// DisputeEvent is one entry in a dispute's decision trail.
+type DisputeEvent struct {
+	Action    string   `dynamodbav:"Action" json:"action"`
+	Actor     string   `dynamodbav:"Actor" json:"actor"`
+	Note      string   `dynamodbav:"Note" json:"note,omitempty"`
+	Evidence  []string `dynamodbav:"Evidence,omitempty" json:"evidence,omitempty"`
+	Timestamp string   `dynamodbav:"Timestamp" json:"timestamp"`
+}
+
+// EscrowDispute freezes an InProgress escrow until it is resolved. Evidence
+// holds references (document IDs, URLs) rather than the documents themselves.
+type EscrowDispute struct {
+	TransactionID string         `dynamodbav:"TransactionID" json:"transaction_id"`
+	DisputeID     string         `dynamodbav:"DisputeID" json:"dispute_id"`
+	EscrowUUID    string         `dynamodbav:"EscrowUUID" json:"escrow_uuid"`
+	DisputeStatus string         `dynamodbav:"DisputeStatus" json:"status"`
+	OpenedBy      string         `dynamodbav:"OpenedBy" json:"opened_by"`
+	Reason        string         `dynamodbav:"Reason" json:"reason"`
+	Evidence      []string       `dynamodbav:"Evidence,omitempty" json:"evidence,omitempty"`
+	AssignedTo    string         `dynamodbav:"AssignedTo,omitempty" json:"assigned_to,omitempty"`
+	Outcome       string         `dynamodbav:"Outcome,omitempty" json:"outcome,omitempty"`
+	Splits        []EscrowSplit  `dynamodbav:"Splits,omitempty" json:"splits,omitempty"`
+	Trail         []DisputeEvent `dynamodbav:"Trail" json:"trail"`
+	CreatedAt     string         `dynamodbav:"CreatedAt" json:"created_at"`
+	ResolvedAt    string         `dynamodbav:"ResolvedAt,omitempty" json:"resolved_at,omitempty"`
+}
+
+// DisputeResolution is the decision that closes a dispute. Splits are only used
+// with DisputeSplit.
+type DisputeResolution struct {
+	Outcome string        `json:"outcome"`
+	Splits  []EscrowSplit `json:"splits,omitempty"`
+	Note    string        `json:"note,omitempty"`
+}
+
+// OpenEscrowDispute moves an InProgress escrow to Disputed, which stops
+// releases, provider confirmations and expiry until ResolveEscrowDispute.
+func OpenEscrowDispute(ctx context.Context, dbSvc *dynamodb.Client, transactionID, openedBy, reason string, evidence []string) (*EscrowDispute, error) {
+	if openedBy == "" || reason == "" {
+		return nil, errors.New("opened_by and reason are required to open a dispute")
+	}
+	es, err := GetEscrowTransactionBySystemID(ctx, dbSvc, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	if es.Status == StatusDisputed {
+		return nil, fmt.Errorf("%w: escrow %s", ErrEscrowDisputed, transactionID)
+	}
+
+	if err := TransitionEscrow(ctx, dbSvc, es.InitiatorUUID, es.SystemTransactionID, es.Status, StatusDisputed, openedBy, reason); err != nil {
+		return nil, err
+	}
+
+	now := getCurrentTimeZone()
+	dispute := EscrowDispute{
+		TransactionID: es.SystemTransactionID,
+		DisputeID:     ksuid.New().String(),
+		EscrowUUID:    es.InitiatorUUID,
+		DisputeStatus: DisputeOpen,
+		OpenedBy:      openedBy,
+		Reason:        reason,
+		Evidence:      evidence,
+		Trail: []DisputeEvent{{
+			Action:    DisputeActionOpened,
+			Actor:     openedBy,
+			Note:      reason,
+			Evidence:  evidence,
+			Timestamp: now,
+		}},
+		CreatedAt: now,
+	}
+
+	item, err := attributevalue.MarshalMap(dispute)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal dispute: %w", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(EscrowDisputesTable),
+		Item:      item,
+	})
+	if err != nil {
+		// unfreeze the escrow, there is no dispute record to resolve it with
+		if undoErr := TransitionEscrow(ctx, dbSvc, es.InitiatorUUID, es.SystemTransactionID, StatusDisputed, StatusInProgress,
+			openedBy, "dispute could not be recorded"); undoErr != nil {
+			return nil, fmt.Errorf("failed to store dispute (%v) and escrow %s remains disputed: %w", err, transactionID, undoErr)
+		}
+		return nil, fmt.Errorf("failed to store dispute: %w", err)
+	}
+	return &dispute, nil
+}
+
+// AssignEscrowDispute sets who is handling an open dispute.
+func AssignEscrowDispute(ctx context.Context, dbSvc *dynamodb.Client, transactionID, disputeID, assignee, actor string) (*EscrowDispute, error) {
+	if assignee == "" {
+		return nil, errors.New("assignee is required")
+	}
+	return updateOpenDispute(ctx, dbSvc, transactionID, disputeID, DisputeEvent{
+		Action: DisputeActionAssigned,
+		Actor:  actor,
+		Note:   assignee,
+	}, "#assigned = :assignee", map[string]types.AttributeValue{
+		":assignee": &types.AttributeValueMemberS{Value: assignee},
+	}, map[string]string{"#assigned": "AssignedTo"})
+}
+
+// AddDisputeEvidence attaches further evidence references to an open dispute.
+func AddDisputeEvidence(ctx context.Context, dbSvc *dynamodb.Client, transactionID, disputeID, actor string, evidence []string) (*EscrowDispute, error) {
+	if len(evidence) == 0 {
+		return nil, errors.New("evidence is required")
+	}
+	refs, err := attributevalue.Marshal(evidence)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal evidence: %w", err)
+	}
+	return updateOpenDispute(ctx, dbSvc, transactionID, disputeID, DisputeEvent{
+		Action:   DisputeActionEvidence,
+		Actor:    actor,
+		Evidence: evidence,
+	}, "#evidence = list_append(if_not_exists(#evidence, :empty), :refs)", map[string]types.AttributeValue{
+		":refs": refs,
+	}, map[string]string{"#evidence": "Evidence"})
+}
+
+// ResolveEscrowDispute closes an open dispute and settles the escrow as decided:
+// release it, refund it, or release the given splits and refund the rest. A
+// payout queued with a service provider is cancelled first whatever the
+// outcome, which is safe because the disputed escrow cannot be confirmed
+// meanwhile. The settlement, the escrow leaving Disputed for its final status
+// and the dispute being marked resolved are then written in one transaction,
+// so the decision is applied exactly once or not at all.
+func ResolveEscrowDispute(ctx context.Context, dbSvc *dynamodb.Client, transactionID, disputeID string, resolution DisputeResolution, actor string) (*EscrowDispute, *EscrowTransaction, error) {
+	switch resolution.Outcome {
+	case DisputeRelease, DisputeRefund:
+	case DisputeSplit:
+		if len(resolution.Splits) == 0 {
+			return nil, nil, errors.New("a split resolution needs at least one split")
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown dispute outcome %q", resolution.Outcome)
+	}
+
+	es, err := GetEscrowTransactionBySystemID(ctx, dbSvc, transactionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if es, err = reloadEscrow(ctx, dbSvc, *es); err != nil {
+		return nil, nil, err
+	}
+	if es.Status != StatusDisputed {
+		return nil, es, fmt.Errorf("%w: escrow %s is %s", ErrEscrowStateConflict, transactionID, es.Status)
+	}
+	change, err := disputeChange(*es, resolution, actor)
+	if err != nil {
+		return nil, es, err
+	}
+	change.Reason = fmt.Sprintf("dispute %s resolved: %s", disputeID, resolution.Outcome)
+
+	resolved, err := resolveDisputeUpdate(transactionID, disputeID, resolution, actor)
+	if err != nil {
+		return nil, es, err
+	}
+	if err := cancelEscrowPayout(ctx, dbSvc, *es); err != nil {
+		return nil, es, err
+	}
+
+	if err := applyEscrowChange(ctx, dbSvc, *es, change, types.TransactWriteItem{Update: resolved}); err != nil {
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 &&
+			aws.ToString(canceled.CancellationReasons[len(canceled.CancellationReasons)-1].Code) == "ConditionalCheckFailed" {
+			return nil, es, fmt.Errorf("%w: %s", ErrDisputeNotOpen, disputeID)
+		}
+		return nil, es, err
+	}
+	change.applyTo(es)
+
+	dispute, err := GetEscrowDispute(ctx, dbSvc, transactionID, disputeID)
+	if err != nil {
+		return nil, es, err
+	}
+	return dispute, es, nil
+}
+
+// disputeChange settles the disputed es as resolution decides. Whatever is not
+// released is refunded to the sender.
+func disputeChange(es EscrowTransaction, resolution DisputeResolution, actor string) (escrowChange, error) {
+	change := escrowChange{From: StatusDisputed, Actor: actor}
+	var err error
+	switch resolution.Outcome {
+	case DisputeRelease:
+		change, err = releaseChange(es, StatusDisputed, nil, actor)
+	case DisputeSplit:
+		change, err = releaseChange(es, StatusDisputed, resolution.Splits, actor)
+	}
+	if err != nil {
+		return escrowChange{}, err
+	}
+
+	var released float64
+	for _, leg := range change.Released {
+		released += leg.Amount
+	}
+	if rest := es.RemainingAmount() - released; rest >= amountEpsilon {
+		change.Refund = refundLeg(es, rest)
+	}
+	change.To = StatusCompleted
+	if es.ReleasedAmount+released == 0 {
+		change.To = StatusFailed
+	}
+	return change, nil
+}
+
+// resolveDisputeUpdate marks an open dispute resolved with resolution.
+func resolveDisputeUpdate(transactionID, disputeID string, resolution DisputeResolution, actor string) (*types.Update, error) {
+	splits, err := attributevalue.Marshal(resolution.Splits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal splits: %w", err)
+	}
+	if resolution.Splits == nil {
+		splits = &types.AttributeValueMemberL{Value: []types.AttributeValue{}}
+	}
+	return openDisputeUpdate(transactionID, disputeID, DisputeEvent{
+		Action: DisputeActionResolved,
+		Actor:  actor,
+		Note:   resolution.Outcome + ": " + resolution.Note,
+	}, "#ds = :resolved, #outcome = :outcome, #splits = :splits, #resolvedAt = :now", map[string]types.AttributeValue{
+		":resolved": &types.AttributeValueMemberS{Value: DisputeResolved},
+		":outcome":  &types.AttributeValueMemberS{Value: resolution.Outcome},
+		":splits":   splits,
+		":now":      &types.AttributeValueMemberS{Value: getCurrentTimeZone()},
+	}, map[string]string{"#outcome": "Outcome", "#splits": "Splits", "#resolvedAt": "ResolvedAt"})
+}
+
+// cancelEscrowPayout stops a payout of es queued with a service provider, so
+// the provider cannot pay out what the dispute settles.
+func cancelEscrowPayout(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) error {
+	provider, queued, err := payoutQueued(es)
+	if err != nil || !queued {
+		return err
+	}
+	if err := provider.CancelPayout(ctx, dbSvc, es); err != nil {
+		return fmt.Errorf("failed to cancel payout of escrow %s: %w", es.SystemTransactionID, err)
+	}
+	return nil
+}
+
+// GetEscrowDispute fetches a single dispute.
+func GetEscrowDispute(ctx context.Context, dbSvc *dynamodb.Client, transactionID, disputeID string) (*EscrowDispute, error) {
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(EscrowDisputesTable),
+		Key:            disputeKey(transactionID, disputeID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dispute: %w", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("dispute %s not found for escrow %s", disputeID, transactionID)
+	}
+
+	var dispute EscrowDispute
+	if err := attributevalue.UnmarshalMap(result.Item, &dispute); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dispute: %w", err)
+	}
+	return &dispute, nil
+}
+
+// ListEscrowDisputes returns every dispute raised against an escrow, oldest first.
+func ListEscrowDisputes(ctx context.Context, dbSvc *dynamodb.Client, transactionID string) ([]EscrowDispute, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(EscrowDisputesTable),
+		KeyConditionExpression: aws.String("TransactionID = :transactionID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":transactionID": &types.AttributeValueMemberS{Value: transactionID},
+		},
+	}
+
+	var disputes []EscrowDispute
+	for {
+		result, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query disputes: %w", err)
+		}
+		var page []EscrowDispute
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal disputes: %w", err)
+		}
+		disputes = append(disputes, page...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	return disputes, nil
+}
+
+// updateOpenDispute applies set to a dispute that is still open and appends
+// event to its trail.
+func updateOpenDispute(ctx context.Context, dbSvc *dynamodb.Client, transactionID, disputeID string, event DisputeEvent,
+	set string, values map[string]types.AttributeValue, names map[string]string) (*EscrowDispute, error) {
+	update, err := openDisputeUpdate(transactionID, disputeID, event, set, values, names)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 update.TableName,
+		Key:                       update.Key,
+		UpdateExpression:          update.UpdateExpression,
+		ConditionExpression:       update.ConditionExpression,
+		ExpressionAttributeNames:  update.ExpressionAttributeNames,
+		ExpressionAttributeValues: update.ExpressionAttributeValues,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var conditionalCheckFailedErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionalCheckFailedErr) {
+			return nil, fmt.Errorf("%w: %s", ErrDisputeNotOpen, disputeID)
+		}
+		return nil, fmt.Errorf("failed to update dispute: %w", err)
+	}
+
+	var dispute EscrowDispute
+	if err := attributevalue.UnmarshalMap(result.Attributes, &dispute); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dispute: %w", err)
+	}
+	return &dispute, nil
+}
+
+// openDisputeUpdate builds the update of updateOpenDispute, so it can also be
+// written as part of a transaction.
+func openDisputeUpdate(transactionID, disputeID string, event DisputeEvent,
+	set string, values map[string]types.AttributeValue, names map[string]string) (*types.Update, error) {
+	event.Timestamp = getCurrentTimeZone()
+	entry, err := attributevalue.Marshal([]DisputeEvent{event})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal dispute event: %w", err)
+	}
+
+	values[":open"] = &types.AttributeValueMemberS{Value: DisputeOpen}
+	values[":entry"] = entry
+	values[":empty"] = &types.AttributeValueMemberL{Value: []types.AttributeValue{}}
+	names["#ds"] = "DisputeStatus"
+	names["#trail"] = "Trail"
+
+	return &types.Update{
+		TableName:                 aws.String(EscrowDisputesTable),
+		Key:                       disputeKey(transactionID, disputeID),
+		UpdateExpression:          aws.String("SET " + set + ", #trail = list_append(if_not_exists(#trail, :empty), :entry)"),
+		ConditionExpression:       aws.String("#ds = :open"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}, nil
+}
+
+func disputeKey(transactionID, disputeID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"TransactionID": &types.AttributeValueMemberS{Value: transactionID},
+		"DisputeID":     &types.AttributeValueMemberS{Value: disputeID},
+	}
+}
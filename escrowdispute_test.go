@@ -0,0 +1,59 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDisputeChange(t *testing.T) {
+	es := EscrowTransaction{
+		SystemTransactionID: "tx-1",
+		FromAccount:         "0912141679",
+		FromTenantID:        "nil",
+		ToAccount:           "0911111111",
+		ToTenantID:          "nil",
+		Amount:              100,
+		Status:              StatusDisputed,
+	}
+	partlyReleased := es
+	partlyReleased.ReleasedAmount = 30
+
+	tests := []struct {
+		name         string
+		es           EscrowTransaction
+		resolution   DisputeResolution
+		wantTo       Status
+		wantReleased float64
+		wantRefund   float64
+	}{
+		{"release", es, DisputeResolution{Outcome: DisputeRelease}, StatusCompleted, 100, 0},
+		{"refund", es, DisputeResolution{Outcome: DisputeRefund}, StatusFailed, 0, 100},
+		{"refund after a release", partlyReleased, DisputeResolution{Outcome: DisputeRefund}, StatusCompleted, 0, 70},
+		{"split refunds the rest", es, DisputeResolution{Outcome: DisputeSplit, Splits: []EscrowSplit{{Amount: 60}}}, StatusCompleted, 60, 40},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			change, err := disputeChange(tt.es, tt.resolution, "ops")
+			assert.NoError(t, err)
+			assert.Equal(t, StatusDisputed, change.From)
+			assert.Equal(t, tt.wantTo, change.To)
+
+			var released float64
+			for _, leg := range change.Released {
+				released += leg.Amount
+			}
+			assert.InDelta(t, tt.wantReleased, released, amountEpsilon)
+			assert.InDelta(t, tt.wantRefund, change.Refund.Amount, amountEpsilon)
+			if tt.wantRefund > 0 {
+				assert.Equal(t, tt.es.FromAccount, change.Refund.ToAccount)
+			}
+
+			_, err = escrowChangeItems(tt.es, change, noShard, 1700000000)
+			assert.NoError(t, err)
+		})
+	}
+
+	_, err := disputeChange(es, DisputeResolution{Outcome: DisputeSplit, Splits: []EscrowSplit{{Amount: 120}}}, "ops")
+	assert.ErrorIs(t, err, ErrInsufficientEscrowBalance)
+}
@@ -0,0 +1,112 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DefaultEscrowTimeout is how long an escrow handed to an external cashout
+// provider may stay InProgress before the sweeper refunds it.
+var DefaultEscrowTimeout = 24 * time.Hour
+
+// EscrowTimeouts overrides DefaultEscrowTimeout per cashout provider. A zero
+// duration disables expiry for that provider.
+var EscrowTimeouts = map[string]time.Duration{
+	DefaultCashoutProvider: 0, // settled synchronously by the stream processor
+	HoldCashoutProvider:    30 * 24 * time.Hour,
+}
+
+// EscrowTimeout returns the configured timeout for a cashout provider.
+func EscrowTimeout(cashoutProvider string) time.Duration {
+	if timeout, ok := EscrowTimeouts[cashoutProvider]; ok {
+		return timeout
+	}
+	return DefaultEscrowTimeout
+}
+
+// ExpiredEscrows returns the InProgress escrows whose ExpiresAt is at or before now.
+func ExpiredEscrows(ctx context.Context, dbSvc *dynamodb.Client, now time.Time) ([]EscrowTransaction, error) {
+	inProgress, err := StatusInProgress.MarshalDynamoDBAttributeValue()
+	if err != nil {
+		return nil, err
+	}
+
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(EscrowTransactionsTable),
+		FilterExpression: aws.String("(#ts = :inProgress OR #ts = :legacyInProgress) AND #exp BETWEEN :one AND :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#ts":  "TransactionStatus",
+			"#exp": "ExpiresAt",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":inProgress":       inProgress,
+			":legacyInProgress": &types.AttributeValueMemberN{Value: strconv.Itoa(int(StatusInProgress))},
+			":one":              &types.AttributeValueMemberN{Value: "1"},
+			":now":              &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	}
+
+	var expired []EscrowTransaction
+	for {
+		result, err := dbSvc.Scan(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan escrow transactions: %w", err)
+		}
+
+		var page []EscrowTransaction
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal escrow transactions: %w", err)
+		}
+		expired = append(expired, page...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	return expired, nil
+}
+
+// ExpireEscrow marks an InProgress escrow Expired and refunds the amount still
+// escrowed to the original FromAccount in one transaction, then cancels the
+// payout with its cashout provider. The escrow is reloaded and conditionally
+// finalized first, so the provider's payout is only cancelled for an escrow
+// this call actually expired; a concurrent sweeper or provider confirmation
+// cannot cause a double refund. A confirmation that arrives after the refund is
+// rejected with ErrEscrowAlreadyFinalized even if cancelling the payout failed.
+func ExpireEscrow(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction, actor string) (EscrowTransaction, error) {
+	provider, err := GetCashoutProvider(es.CashoutProvider)
+	if err != nil {
+		return es, err
+	}
+
+	latest, err := reloadEscrow(ctx, dbSvc, es)
+	if err != nil {
+		return es, err
+	}
+	if latest.Status != StatusInProgress {
+		return *latest, fmt.Errorf("%w: escrow %s is %s", ErrEscrowStateConflict, es.SystemTransactionID, latest.Status)
+	}
+	es = *latest
+
+	remaining := es.RemainingAmount()
+	if err := finalizeEscrow(ctx, dbSvc, es, StatusExpired, "RefundedAmount", refundLeg(es, remaining),
+		actor, "cashout provider did not settle before timeout"); err != nil {
+		return es, err
+	}
+	es.Status = StatusExpired
+	es.RefundedAmount += remaining
+
+	if err := provider.CancelPayout(ctx, dbSvc, es); err != nil {
+		return es, fmt.Errorf("escrow %s expired but cancelling its payout failed: %w", es.SystemTransactionID, err)
+	}
+	return es, nil
+}
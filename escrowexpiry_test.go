@@ -0,0 +1,40 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscrowTimeout(t *testing.T) {
+	EscrowTimeouts["test-provider"] = time.Hour
+	defer delete(EscrowTimeouts, "test-provider")
+
+	tests := []struct {
+		name     string
+		provider string
+		want     time.Duration
+	}{
+		{"internal wallet never expires", "nil", 0},
+		{"configured provider", "test-provider", time.Hour},
+		{"unconfigured provider", "bok", DefaultEscrowTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EscrowTimeout(tt.provider); got != tt.want {
+				t.Errorf("EscrowTimeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpiredEscrows(t *testing.T) {
+	expired, err := ExpiredEscrows(context.TODO(), _dbSvc, time.Now())
+	assert.NoError(t, err)
+	for _, es := range expired {
+		assert.Equal(t, StatusInProgress, es.Status)
+		assert.LessOrEqual(t, es.ExpiresAt, time.Now().Unix())
+	}
+}
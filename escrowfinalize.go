@@ -0,0 +1,375 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+// escrowLeg pays Amount out of the escrow account into ToAccount as part of an
+// escrow update. TransactionID names the leg's ledger entries and transaction
+// record; applyEscrowChange assigns one when it is empty.
+type escrowLeg struct {
+	ToAccount     string
+	ToTenantID    string
+	Amount        float64
+	TransactionID string
+}
+
+// refundLeg returns amount to the sender of es.
+func refundLeg(es EscrowTransaction, amount float64) escrowLeg {
+	return escrowLeg{ToAccount: es.FromAccount, ToTenantID: es.FromTenantID, Amount: amount}
+}
+
+// escrowSource is the account holding the escrowed funds of es.
+func escrowSource(es EscrowTransaction) (account, tenantID string) {
+	if es.TransientAccount != "" {
+		return es.TransientAccount, es.TransientTenant
+	}
+	return ESCROW_ACCOUNT, ESCROW_TENANT
+}
+
+// maxEscrowSplits bounds the splits of one release, so that the release, a
+// refund of the rest and a dispute resolution fit in a single transaction.
+const maxEscrowSplits = 20
+
+// escrowChange is a change of an escrow written in one transaction with the
+// money it moves. The escrow moves From -> To, or keeps its status when To is
+// From. Released legs are paid to beneficiaries and added to ReleasedAmount,
+// with Releases appended to the escrow's Releases; Refund is returned to the
+// sender and added to RefundedAmount.
+type escrowChange struct {
+	From     Status
+	To       Status
+	Released []escrowLeg
+	Releases []EscrowRelease
+	Refund   escrowLeg
+	Actor    string
+	Reason   string
+}
+
+// legs lists the legs of c that move money, refund last.
+func (c escrowChange) legs() []escrowLeg {
+	var legs []escrowLeg
+	for _, leg := range c.Released {
+		if leg.Amount > 0 {
+			legs = append(legs, leg)
+		}
+	}
+	if c.Refund.Amount > 0 {
+		legs = append(legs, c.Refund)
+	}
+	return legs
+}
+
+// applyTo updates es as c is written.
+func (c escrowChange) applyTo(es *EscrowTransaction) {
+	for _, leg := range c.Released {
+		es.ReleasedAmount += leg.Amount
+	}
+	es.RefundedAmount += c.Refund.Amount
+	es.Releases = append(es.Releases, c.Releases...)
+	es.Status = c.To
+}
+
+// finalizeEscrow moves an InProgress escrow to `to` and pays leg out of the
+// escrow account in the same transaction, so the status never says the money
+// moved when it did not. attribute, ReleasedAmount or RefundedAmount, records
+// the leg on the escrow. The escrow must not have changed since es was read;
+// otherwise ErrEscrowStateConflict is returned and nothing is written.
+func finalizeEscrow(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction, to Status, attribute string, leg escrowLeg, actor, reason string) error {
+	change, err := finalizeChange(to, attribute, leg, actor, reason)
+	if err != nil {
+		return err
+	}
+	return applyEscrowChange(ctx, dbSvc, es, change)
+}
+
+// finalizeChange is the change finalizeEscrow writes.
+func finalizeChange(to Status, attribute string, leg escrowLeg, actor, reason string) (escrowChange, error) {
+	if !to.IsFinal() {
+		return escrowChange{}, fmt.Errorf("%w: %s -> %s", ErrInvalidEscrowTransition, StatusInProgress, to)
+	}
+	change := escrowChange{From: StatusInProgress, To: to, Actor: actor, Reason: reason}
+	if attribute == "RefundedAmount" {
+		change.Refund = leg
+	} else {
+		change.Released = []escrowLeg{leg}
+	}
+	return change, nil
+}
+
+// applyEscrowChange writes change to es, followed by extra items that must
+// succeed with it, in one transaction. The escrow must not have changed since
+// es was read; otherwise ErrEscrowStateConflict is returned and nothing is
+// written. Other cancellations are returned wrapped, so callers can inspect
+// the reasons of their extra items, which come last.
+func applyEscrowChange(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction, change escrowChange, extra ...types.TransactWriteItem) error {
+	for i := range change.Released {
+		if change.Released[i].TransactionID == "" {
+			change.Released[i].TransactionID = ksuid.New().String()
+		}
+	}
+	if change.Refund.TransactionID == "" {
+		change.Refund.TransactionID = ksuid.New().String()
+	}
+
+	debitShard := noShard
+	var total float64
+	for _, leg := range change.legs() {
+		total += leg.Amount
+	}
+	if total > 0 {
+		account, tenantID := escrowSource(es)
+		shard, err := pickDebitShard(ctx, dbSvc, tenantID, account, total)
+		if err != nil {
+			return err
+		}
+		debitShard = shard
+	}
+	items, err := escrowChangeItems(es, change, debitShard, getCurrentTimestamp())
+	if err != nil {
+		return err
+	}
+	items = append(items, extra...)
+	if len(items) > 100 {
+		return fmt.Errorf("escrow %s change needs %d items, a transaction holds at most 100", es.SystemTransactionID, len(items))
+	}
+
+	_, err = dbSvc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) && len(canceled.CancellationReasons) > 0 &&
+			aws.ToString(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			return fmt.Errorf("%w: escrow %s is no longer %s", ErrEscrowStateConflict, es.SystemTransactionID, change.From)
+		}
+		return fmt.Errorf("failed to update escrow %s: %w", es.SystemTransactionID, err)
+	}
+	return nil
+}
+
+// escrowChangeItems builds the escrow update of change, conditioned on the
+// escrow's status and amounts being those of es, followed by the items of its
+// legs, debiting debitShard of the escrow account.
+func escrowChangeItems(es EscrowTransaction, change escrowChange, debitShard int, timestamp int64) ([]types.TransactWriteItem, error) {
+	if change.To != change.From && !change.From.CanTransitionTo(change.To) {
+		return nil, fmt.Errorf("%w: %s -> %s", ErrInvalidEscrowTransition, change.From, change.To)
+	}
+
+	fromValue, err := change.From.MarshalDynamoDBAttributeValue()
+	if err != nil {
+		return nil, err
+	}
+	var released float64
+	for _, leg := range change.Released {
+		released += leg.Amount
+	}
+	names := map[string]string{
+		"#ts":       "TransactionStatus",
+		"#released": "ReleasedAmount",
+		"#refunded": "RefundedAmount",
+	}
+	values := map[string]types.AttributeValue{
+		":from":        fromValue,
+		":legacyFrom":  &types.AttributeValueMemberN{Value: strconv.Itoa(int(change.From))},
+		":released":    numberValue(es.ReleasedAmount),
+		":refunded":    numberValue(es.RefundedAmount),
+		":addReleased": numberValue(released),
+		":addRefunded": numberValue(change.Refund.Amount),
+	}
+
+	var set []string
+	if change.To != change.From {
+		entry, err := attributevalue.Marshal([]EscrowTransition{{
+			From:      change.From,
+			To:        change.To,
+			Actor:     change.Actor,
+			Reason:    change.Reason,
+			Timestamp: getCurrentTimeZone(),
+		}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal escrow transition: %w", err)
+		}
+		toValue, err := change.To.MarshalDynamoDBAttributeValue()
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, "#ts = :to", "#history = list_append(if_not_exists(#history, :empty), :entry)")
+		names["#history"] = "TransitionHistory"
+		values[":to"], values[":entry"] = toValue, entry
+		values[":empty"] = &types.AttributeValueMemberL{Value: []types.AttributeValue{}}
+	}
+	if len(change.Releases) > 0 {
+		entries, err := attributevalue.Marshal(change.Releases)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal escrow releases: %w", err)
+		}
+		set = append(set, "#releases = list_append(if_not_exists(#releases, :empty), :releases)")
+		names["#releases"] = "Releases"
+		values[":releases"] = entries
+		values[":empty"] = &types.AttributeValueMemberL{Value: []types.AttributeValue{}}
+	}
+	expression := "ADD #released :addReleased, #refunded :addRefunded"
+	if len(set) > 0 {
+		expression = "SET " + strings.Join(set, ", ") + " " + expression
+	}
+
+	items := []types.TransactWriteItem{{
+		Update: &types.Update{
+			TableName:        aws.String(EscrowTransactionsTable),
+			Key:              escrowKey(&es),
+			UpdateExpression: aws.String(expression),
+			// Rows written before statuses were stored by name hold the numeric value.
+			ConditionExpression: aws.String("(#ts = :from OR #ts = :legacyFrom)" +
+				" AND (attribute_not_exists(#released) OR #released = :released)" +
+				" AND (attribute_not_exists(#refunded) OR #refunded = :refunded)"),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+		},
+	}}
+
+	legs := change.legs()
+	if len(legs) == 0 {
+		return items, nil
+	}
+	legItems, err := escrowLegItems(es, legs, debitShard, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return append(items, legItems...), nil
+}
+
+// escrowLegItems debits the total of legs from debitShard of the escrow
+// account and credits each receiving account once with the sum of its legs.
+// Every leg gets its own ledger entries and transaction record under its
+// TransactionID.
+func escrowLegItems(es EscrowTransaction, legs []escrowLeg, debitShard int, timestamp int64) ([]types.TransactWriteItem, error) {
+	fromAccount, fromTenant := escrowSource(es)
+	newVersion := &types.AttributeValueMemberN{Value: strconv.FormatInt(timestamp, 10)}
+
+	var total float64
+	credits := make(map[[2]string]float64)
+	for _, leg := range legs {
+		if leg.ToAccount == "" {
+			return nil, fmt.Errorf("escrow %s leg has no receiving account", es.SystemTransactionID)
+		}
+		total += leg.Amount
+		credits[[2]string{leg.ToTenantID, leg.ToAccount}] += leg.Amount
+	}
+
+	items := []types.TransactWriteItem{
+		{Update: shardDebitUpdate(&types.Update{
+			TableName: aws.String(NilUsers),
+			Key: map[string]types.AttributeValue{
+				"TenantID":  &types.AttributeValueMemberS{Value: fromTenant},
+				"AccountID": &types.AttributeValueMemberS{Value: fromAccount},
+			},
+			UpdateExpression:    aws.String("SET amount = amount - :amount, Version = :newVersion"),
+			ConditionExpression: aws.String("amount >= :amount"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":amount":     amountNumber(es.EscrowCurrency(), total),
+				":newVersion": newVersion,
+			},
+		}, fromTenant, fromAccount, es.EscrowCurrency(), total, debitShard)},
+	}
+
+	credited := make(map[[2]string]bool)
+	for _, leg := range legs {
+		debit, err := attributevalue.MarshalMap(LedgerEntry{
+			TenantID:            fromTenant,
+			AccountID:           fromAccount,
+			Amount:              leg.Amount,
+			SystemTransactionID: leg.TransactionID,
+			Type:                "debit",
+			Time:                timestamp,
+			InitiatorUUID:       es.InitiatorUUID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal ledger entry: %v", err)
+		}
+		credit, err := attributevalue.MarshalMap(LedgerEntry{
+			TenantID:            leg.ToTenantID,
+			AccountID:           leg.ToAccount,
+			Amount:              leg.Amount,
+			SystemTransactionID: leg.TransactionID,
+			Type:                "credit",
+			Time:                timestamp,
+			InitiatorUUID:       es.InitiatorUUID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal ledger entry: %v", err)
+		}
+		success := 0
+		record, err := attributevalue.MarshalMap(TransactionEntry{
+			TenantID:            fromTenant + ":" + leg.ToTenantID,
+			AccountID:           fromAccount,
+			SystemTransactionID: leg.TransactionID,
+			FromAccount:         fromAccount,
+			ToAccount:           leg.ToAccount,
+			Amount:              leg.Amount,
+			Comment:             "Escrow " + es.SystemTransactionID,
+			TransactionDate:     timestamp,
+			Status:              &success,
+			InitiatorUUID:       es.InitiatorUUID,
+			Currency:            es.EscrowCurrency(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal transaction entry: %v", err)
+		}
+
+		items = append(items, types.TransactWriteItem{Put: &types.Put{TableName: aws.String(LedgerTable), Item: debit}})
+		// an account may receive several legs, but a transaction updates it once
+		if key := [2]string{leg.ToTenantID, leg.ToAccount}; !credited[key] {
+			credited[key] = true
+			items = append(items, types.TransactWriteItem{Update: shardBalanceUpdate(&types.Update{
+				TableName: aws.String(NilUsers),
+				Key: map[string]types.AttributeValue{
+					"TenantID":  &types.AttributeValueMemberS{Value: leg.ToTenantID},
+					"AccountID": &types.AttributeValueMemberS{Value: leg.ToAccount},
+				},
+				UpdateExpression:    aws.String("SET amount = amount + :amount, Version = :newVersion"),
+				ConditionExpression: aws.String("attribute_exists(AccountID)"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":amount":     amountNumber(es.EscrowCurrency(), credits[key]),
+					":newVersion": newVersion,
+				},
+			}, leg.ToTenantID, leg.ToAccount, es.EscrowCurrency(), credits[key])})
+		}
+		items = append(items,
+			types.TransactWriteItem{Put: &types.Put{TableName: aws.String(LedgerTable), Item: credit}},
+			types.TransactWriteItem{Put: &types.Put{TableName: aws.String(TransactionsTable), Item: record}},
+		)
+	}
+	return items, nil
+}
+
+// reloadEscrow reads es again by its key with a strongly consistent read, so
+// its status and amounts can be used as conditions of finalizeEscrow. Escrows
+// found through a GSI may lag behind the table.
+func reloadEscrow(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) (*EscrowTransaction, error) {
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(EscrowTransactionsTable),
+		Key:            escrowKey(&es),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read escrow %s: %w", es.SystemTransactionID, err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("escrow transaction %s not found", es.SystemTransactionID)
+	}
+
+	var latest EscrowTransaction
+	if err := attributevalue.UnmarshalMap(result.Item, &latest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal escrow transaction: %w", err)
+	}
+	return &latest, nil
+}
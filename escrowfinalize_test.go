@@ -0,0 +1,130 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFinalizeEscrowItems(t *testing.T) {
+	es := EscrowTransaction{
+		SystemTransactionID: "tx-1",
+		InitiatorUUID:       "uuid-1",
+		FromAccount:         "0912141679",
+		FromTenantID:        "nil",
+		Amount:              100,
+		ReleasedAmount:      40,
+	}
+	payout := escrowLeg{ToAccount: "0911111111", ToTenantID: "bok", Amount: es.RemainingAmount()}
+
+	tests := []struct {
+		name      string
+		to        Status
+		attribute string
+		leg       escrowLeg
+		wantItems int
+		wantErr   bool
+	}{
+		{"payout", StatusCompleted, "ReleasedAmount", payout, 6, false},
+		{"refund", StatusFailed, "RefundedAmount", refundLeg(es, 60), 6, false},
+		{"nothing left", StatusCompleted, "ReleasedAmount", escrowLeg{ToAccount: "0911111111", ToTenantID: "bok"}, 1, false},
+		{"not final", StatusDisputed, "ReleasedAmount", payout, 0, true},
+		{"no receiving account", StatusCompleted, "ReleasedAmount", escrowLeg{Amount: 60}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.leg.TransactionID = "tx-2"
+			change, err := finalizeChange(tt.to, tt.attribute, tt.leg, "ops", "test")
+			if err == nil {
+				var items []types.TransactWriteItem
+				items, err = escrowChangeItems(es, change, noShard, 1700000000)
+				if err == nil {
+					assertFinalizeItems(t, items, tt.attribute, tt.leg, tt.wantItems)
+				}
+			}
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func assertFinalizeItems(t *testing.T, items []types.TransactWriteItem, attribute string, leg escrowLeg, wantItems int) {
+	t.Helper()
+	assert.Len(t, items, wantItems)
+
+	// the escrow update comes first, conditioned on the amounts read
+	update := items[0].Update
+	assert.Equal(t, EscrowTransactionsTable, aws.ToString(update.TableName))
+	assert.Equal(t, "40", update.ExpressionAttributeValues[":released"].(*types.AttributeValueMemberN).Value)
+	added := ":addReleased"
+	if attribute == "RefundedAmount" {
+		added = ":addRefunded"
+	}
+	assert.Equal(t, numberValue(leg.Amount), update.ExpressionAttributeValues[added])
+	if wantItems == 1 {
+		return
+	}
+
+	credit := items[3].Update
+	assert.Equal(t, leg.ToAccount, credit.Key["AccountID"].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, leg.ToTenantID, credit.Key["TenantID"].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, TransactionsTable, aws.ToString(items[5].Put.TableName))
+}
+
+func TestReleaseChangeItems(t *testing.T) {
+	es := EscrowTransaction{
+		SystemTransactionID: "tx-1",
+		InitiatorUUID:       "uuid-1",
+		FromAccount:         "0912141679",
+		FromTenantID:        "nil",
+		ToAccount:           "0911111111",
+		ToTenantID:          "nil",
+		Amount:              100,
+	}
+
+	tests := []struct {
+		name        string
+		splits      []EscrowSplit
+		wantTo      Status
+		wantItems   int
+		wantCredits int
+		wantErr     error
+	}{
+		{"whole remainder", nil, StatusCompleted, 6, 1, nil},
+		{"partial", []EscrowSplit{{Amount: 40}}, StatusInProgress, 6, 1, nil},
+		{"same account credited once", []EscrowSplit{{Amount: 40}, {Amount: 10, Label: "tip"}, {ToAccount: "0922222222", ToTenantID: "nil", Amount: 50}},
+			StatusCompleted, 2 + 3*3 + 2, 2, nil},
+		{"overdrawn", []EscrowSplit{{Amount: 60}, {Amount: 50}}, 0, 0, 0, ErrInsufficientEscrowBalance},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			change, err := releaseChange(es, StatusInProgress, tt.splits, "ops")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantTo, change.To)
+			assert.Len(t, change.Releases, len(change.Released))
+
+			items, err := escrowChangeItems(es, change, noShard, 1700000000)
+			assert.NoError(t, err)
+			assert.Len(t, items, tt.wantItems)
+
+			var credits int
+			for _, item := range items[2:] {
+				if item.Update != nil {
+					credits++
+				}
+			}
+			assert.Equal(t, tt.wantCredits, credits)
+			_, transition := items[0].Update.ExpressionAttributeValues[":to"]
+			assert.Equal(t, tt.wantTo != StatusInProgress, transition)
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// EscrowFilter narrows ListEscrowTransactions results. Zero values disable a
+// filter. StartTime and EndTime bound TransactionDate, in unix seconds.
+type EscrowFilter struct {
+	FromTenantID    string
+	ToTenantID      string
+	Statuses        []Status
+	CashoutProvider string
+	ServiceProvider string
+	StartTime       int64
+	EndTime         int64
+	Limit           int32
+	Cursor          string
+	// Totals asks for the totals of the whole listing with its first page,
+	// which reads every matching escrow once more.
+	Totals bool
+}
+
+// EscrowPage is a page of escrows with an opaque cursor for the next page.
+// Count covers this page only. Totals, set on the first page when the filter
+// asks for it, covers every escrow of the listing, by currency.
+type EscrowPage struct {
+	Escrows    []EscrowTransaction     `json:"escrows"`
+	NextCursor string                  `json:"next_cursor,omitempty"`
+	Count      int                     `json:"count"`
+	Totals     map[string]EscrowTotals `json:"totals,omitempty"`
+}
+
+// EscrowTotals adds up the escrows of a listing held in one currency.
+// Remaining counts escrows that are not final only.
+type EscrowTotals struct {
+	Count     int     `json:"count"`
+	Amount    float64 `json:"amount"`
+	Released  float64 `json:"released"`
+	Refunded  float64 `json:"refunded"`
+	Remaining float64 `json:"remaining"`
+}
+
+// ListEscrowTransactions lists escrows matching filter. It queries the
+// FromTenantIDIndex or ToTenantIDIndex when a tenant is given and scans the
+// table otherwise. As with any DynamoDB filter a page may hold fewer than
+// Limit escrows while NextCursor is still set.
+func ListEscrowTransactions(ctx context.Context, dbSvc *dynamodb.Client, filter EscrowFilter) (*EscrowPage, error) {
+	if filter.Limit == 0 {
+		filter.Limit = 25
+	}
+	if filter.StartTime != 0 && filter.EndTime != 0 && filter.StartTime > filter.EndTime {
+		return nil, fmt.Errorf("start time %d is after end time %d", filter.StartTime, filter.EndTime)
+	}
+
+	startKey, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	items, lastKey, err := queryEscrowList(ctx, dbSvc, filter, startKey, filter.Limit, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &EscrowPage{Escrows: []EscrowTransaction{}}
+	if err := attributevalue.UnmarshalListOfMaps(items, &page.Escrows); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal escrow transactions: %w", err)
+	}
+	page.Count = len(page.Escrows)
+	if filter.Totals && filter.Cursor == "" {
+		if page.Totals, err = escrowListTotals(ctx, dbSvc, filter); err != nil {
+			return nil, err
+		}
+	}
+
+	page.NextCursor, err = encodeCursor(lastKey)
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// escrowTotalsProjection reads only what escrowListTotals adds up.
+var escrowTotalsProjection = map[string]string{
+	"#amount":   "Amount",
+	"#released": "ReleasedAmount",
+	"#refunded": "RefundedAmount",
+	"#ts":       "TransactionStatus",
+	"#currency": "Currency",
+}
+
+// queryEscrowList reads one page of the escrows matching filter from startKey.
+// A zero limit reads as much as DynamoDB returns in one call; projection, when
+// set, names the attributes to read.
+func queryEscrowList(ctx context.Context, dbSvc *dynamodb.Client, filter EscrowFilter, startKey map[string]types.AttributeValue,
+	limit int32, projection map[string]string) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+	keyCondition, filterExpression, names, values := escrowListExpression(filter)
+	var projectionExpression *string
+	if len(projection) > 0 {
+		placeholders := make([]string, 0, len(projection))
+		for placeholder, name := range projection {
+			names[placeholder] = name
+			placeholders = append(placeholders, placeholder)
+		}
+		sort.Strings(placeholders)
+		projectionExpression = aws.String(strings.Join(placeholders, ", "))
+	}
+	var limitValue *int32
+	if limit > 0 {
+		limitValue = aws.Int32(limit)
+	}
+
+	if keyCondition != "" {
+		input := &dynamodb.QueryInput{
+			TableName:                 aws.String(EscrowTransactionsTable),
+			IndexName:                 aws.String(escrowListIndex(filter)),
+			KeyConditionExpression:    aws.String(keyCondition),
+			ExpressionAttributeValues: values,
+			ExclusiveStartKey:         startKey,
+			Limit:                     limitValue,
+			ProjectionExpression:      projectionExpression,
+			// TransactionIDs are KSUIDs, so this lists the newest escrows first
+			ScanIndexForward: aws.Bool(false),
+		}
+		if filterExpression != "" {
+			input.FilterExpression = aws.String(filterExpression)
+		}
+		if len(names) > 0 {
+			input.ExpressionAttributeNames = names
+		}
+		result, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to query escrow transactions: %w", err)
+		}
+		return result.Items, result.LastEvaluatedKey, nil
+	}
+
+	input := &dynamodb.ScanInput{
+		TableName:            aws.String(EscrowTransactionsTable),
+		ExclusiveStartKey:    startKey,
+		Limit:                limitValue,
+		ProjectionExpression: projectionExpression,
+	}
+	if filterExpression != "" {
+		input.FilterExpression = aws.String(filterExpression)
+		input.ExpressionAttributeValues = values
+	}
+	if len(names) > 0 {
+		input.ExpressionAttributeNames = names
+	}
+	result, err := dbSvc.Scan(ctx, input)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to scan escrow transactions: %w", err)
+	}
+	return result.Items, result.LastEvaluatedKey, nil
+}
+
+// escrowListTotals adds up every escrow matching filter, by currency.
+func escrowListTotals(ctx context.Context, dbSvc *dynamodb.Client, filter EscrowFilter) (map[string]EscrowTotals, error) {
+	totals := map[string]EscrowTotals{}
+	var startKey map[string]types.AttributeValue
+	for {
+		items, lastKey, err := queryEscrowList(ctx, dbSvc, filter, startKey, 0, escrowTotalsProjection)
+		if err != nil {
+			return nil, err
+		}
+		var escrows []EscrowTransaction
+		if err := attributevalue.UnmarshalListOfMaps(items, &escrows); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal escrow transactions: %w", err)
+		}
+		addEscrowTotals(totals, escrows)
+
+		if len(lastKey) == 0 {
+			break
+		}
+		startKey = lastKey
+	}
+	roundEscrowTotals(totals)
+	return totals, nil
+}
+
+// addEscrowTotals adds escrows to the totals of their currencies.
+func addEscrowTotals(totals map[string]EscrowTotals, escrows []EscrowTransaction) {
+	for _, es := range escrows {
+		t := totals[es.EscrowCurrency()]
+		t.Count++
+		t.Amount += es.Amount
+		t.Released += es.ReleasedAmount
+		t.Refunded += es.RefundedAmount
+		if !es.Status.IsFinal() {
+			t.Remaining += es.RemainingAmount()
+		}
+		totals[es.EscrowCurrency()] = t
+	}
+}
+
+// roundEscrowTotals removes the float noise of the sums, as each currency rounds.
+func roundEscrowTotals(totals map[string]EscrowTotals) {
+	for code, t := range totals {
+		c, err := GetCurrency(code)
+		if err != nil {
+			continue
+		}
+		t.Amount, t.Released = c.Round(t.Amount), c.Round(t.Released)
+		t.Refunded, t.Remaining = c.Round(t.Refunded), c.Round(t.Remaining)
+		totals[code] = t
+	}
+}
+
+func escrowListIndex(filter EscrowFilter) string {
+	if filter.FromTenantID != "" {
+		return "FromTenantIDIndex"
+	}
+	return "ToTenantIDIndex"
+}
+
+// escrowListExpression builds the key condition and filter expression of a
+// listing. The key condition is empty when no tenant is given.
+func escrowListExpression(filter EscrowFilter) (keyCondition, filterExpression string, names map[string]string, values map[string]types.AttributeValue) {
+	names = map[string]string{}
+	values = map[string]types.AttributeValue{}
+	filters := []string{}
+
+	switch {
+	case filter.FromTenantID != "":
+		keyCondition = "FromTenantID = :fromTenantID"
+		values[":fromTenantID"] = &types.AttributeValueMemberS{Value: filter.FromTenantID}
+		if filter.ToTenantID != "" {
+			filters = append(filters, "ToTenantID = :toTenantID")
+			values[":toTenantID"] = &types.AttributeValueMemberS{Value: filter.ToTenantID}
+		}
+	case filter.ToTenantID != "":
+		keyCondition = "ToTenantID = :toTenantID"
+		values[":toTenantID"] = &types.AttributeValueMemberS{Value: filter.ToTenantID}
+	}
+
+	if len(filter.Statuses) > 0 {
+		placeholders := []string{}
+		for i, status := range filter.Statuses {
+			// match both the status name and its legacy numeric form
+			name := fmt.Sprintf(":status%d", i)
+			legacy := fmt.Sprintf(":legacyStatus%d", i)
+			values[name] = &types.AttributeValueMemberS{Value: status.String()}
+			values[legacy] = &types.AttributeValueMemberN{Value: strconv.Itoa(int(status))}
+			placeholders = append(placeholders, name, legacy)
+		}
+		names["#st"] = "TransactionStatus"
+		filters = append(filters, "#st IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if filter.CashoutProvider != "" {
+		filters = append(filters, "CashoutProvider = :cashoutProvider")
+		values[":cashoutProvider"] = &types.AttributeValueMemberS{Value: filter.CashoutProvider}
+	}
+	if filter.ServiceProvider != "" {
+		filters = append(filters, "ServiceProvider = :serviceProvider")
+		values[":serviceProvider"] = &types.AttributeValueMemberS{Value: filter.ServiceProvider}
+	}
+	if filter.StartTime != 0 {
+		filters = append(filters, "TransactionDate >= :startTime")
+		values[":startTime"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(filter.StartTime, 10)}
+	}
+	if filter.EndTime != 0 {
+		filters = append(filters, "TransactionDate <= :endTime")
+		values[":endTime"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(filter.EndTime, 10)}
+	}
+
+	return keyCondition, strings.Join(filters, " AND "), names, values
+}
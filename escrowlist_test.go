@@ -0,0 +1,96 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscrowListExpression(t *testing.T) {
+	tests := []struct {
+		name          string
+		filter        EscrowFilter
+		wantIndex     string
+		wantKey       string
+		wantFilter    string
+		wantValueKeys []string
+	}{
+		{
+			name:       "scan without filters",
+			filter:     EscrowFilter{},
+			wantIndex:  "ToTenantIDIndex",
+			wantKey:    "",
+			wantFilter: "",
+		},
+		{
+			name:          "from tenant with to tenant filter",
+			filter:        EscrowFilter{FromTenantID: "nonil", ToTenantID: "nil"},
+			wantIndex:     "FromTenantIDIndex",
+			wantKey:       "FromTenantID = :fromTenantID",
+			wantFilter:    "ToTenantID = :toTenantID",
+			wantValueKeys: []string{":fromTenantID", ":toTenantID"},
+		},
+		{
+			name:          "to tenant only",
+			filter:        EscrowFilter{ToTenantID: "nil"},
+			wantIndex:     "ToTenantIDIndex",
+			wantKey:       "ToTenantID = :toTenantID",
+			wantValueKeys: []string{":toTenantID"},
+		},
+		{
+			name: "all filters",
+			filter: EscrowFilter{
+				FromTenantID:    "nonil",
+				Statuses:        []Status{StatusInProgress, StatusDisputed},
+				CashoutProvider: "bok",
+				ServiceProvider: "oss@pynil.com",
+				StartTime:       100,
+				EndTime:         200,
+			},
+			wantIndex: "FromTenantIDIndex",
+			wantKey:   "FromTenantID = :fromTenantID",
+			wantFilter: "#st IN (:status0, :legacyStatus0, :status1, :legacyStatus1) AND CashoutProvider = :cashoutProvider" +
+				" AND ServiceProvider = :serviceProvider AND TransactionDate >= :startTime AND TransactionDate <= :endTime",
+			wantValueKeys: []string{":fromTenantID", ":status0", ":legacyStatus0", ":status1", ":legacyStatus1",
+				":cashoutProvider", ":serviceProvider", ":startTime", ":endTime"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, filter, _, values := escrowListExpression(tt.filter)
+			assert.Equal(t, tt.wantIndex, escrowListIndex(tt.filter))
+			assert.Equal(t, tt.wantKey, key)
+			assert.Equal(t, tt.wantFilter, filter)
+			assert.Len(t, values, len(tt.wantValueKeys))
+			for _, k := range tt.wantValueKeys {
+				assert.Contains(t, values, k)
+			}
+		})
+	}
+
+	_, _, names, values := escrowListExpression(EscrowFilter{Statuses: []Status{StatusInProgress}})
+	assert.Equal(t, map[string]string{"#st": "TransactionStatus"}, names)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "InProgress"}, values[":status0"])
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "3"}, values[":legacyStatus0"])
+}
+
+func TestAddEscrowTotals(t *testing.T) {
+	totals := map[string]EscrowTotals{}
+	addEscrowTotals(totals, []EscrowTransaction{
+		{Amount: 100, ReleasedAmount: 40, Status: StatusInProgress},
+		{Amount: 50, RefundedAmount: 50, Status: StatusFailed, Currency: "SDG"},
+	})
+	// a later page adds to the same totals
+	addEscrowTotals(totals, []EscrowTransaction{
+		{Amount: 20, Status: StatusCompleted},
+		{Amount: 0.1, Status: StatusInProgress, Currency: "USD"},
+		{Amount: 0.2, Status: StatusInProgress, Currency: "USD"},
+	})
+	roundEscrowTotals(totals)
+
+	assert.Equal(t, map[string]EscrowTotals{
+		"SDG": {Count: 3, Amount: 170, Released: 40, Refunded: 50, Remaining: 60},
+		"USD": {Count: 2, Amount: 0.3, Remaining: 0.3},
+	}, totals)
+}
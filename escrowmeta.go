@@ -0,0 +1,204 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const EscrowMetaTable = "EscrowMeta"
+
+// Error codes returned in NilResponse.Code when an escrow violates the sending
+// tenant's EscrowMeta.
+const (
+	EscrowCodeNotEnabled         = "escrow_not_enabled"
+	EscrowCodeTenantNotAllowed   = "tenant_not_allowed"
+	EscrowCodeInvalidAmount      = "invalid_amount"
+	EscrowCodeBelowMinimum       = "amount_below_minimum"
+	EscrowCodeAboveMaximum       = "amount_above_maximum"
+	EscrowCodeConversionRequired = "conversion_required"
+)
+
+// EscrowCorridor limits the amounts a tenant may escrow towards ToTenantID. A
+// zero MinAmount or MaxAmount leaves that side unbounded. The sender pays Fee
+// plus FeeRate of the amount on top of it, shared according to RevenueShare.
+// The fee is earned when the escrow is created: refunds, expiry and failed
+// payouts return the amount only.
+type EscrowCorridor struct {
+	ToTenantID   string        `dynamodbav:"ToTenantID" json:"to_tenant_id"`
+	MinAmount    float64       `dynamodbav:"MinAmount,omitempty" json:"min_amount,omitempty"`
+	MaxAmount    float64       `dynamodbav:"MaxAmount,omitempty" json:"max_amount,omitempty"`
+	Fee          float64       `dynamodbav:"Fee,omitempty" json:"fee,omitempty"`
+	FeeRate      float64       `dynamodbav:"FeeRate,omitempty" json:"fee_rate,omitempty"`
+	RevenueShare *RevenueShare `dynamodbav:"RevenueShare,omitempty" json:"revenue_share,omitempty"`
+}
+
+// EscrowPolicyError reports why EscrowMeta rejected an escrow. Code is one of
+// the EscrowCode constants.
+type EscrowPolicyError struct {
+	Code    string
+	Message string
+}
+
+func (e *EscrowPolicyError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Corridor returns the limits configured towards toTenantID, if any.
+func (m EscrowMeta) Corridor(toTenantID string) (EscrowCorridor, bool) {
+	for _, c := range m.Corridors {
+		if c.ToTenantID == toTenantID {
+			return c, true
+		}
+	}
+	return EscrowCorridor{}, false
+}
+
+// CheckEscrow validates an escrow of amount in currency from m.TenantID to
+// toTenantID. toCurrency is the receiving tenant's currency. An empty currency
+// is treated as m.Currency and an empty toCurrency, like an empty m.Currency,
+// as DefaultCurrency. Escrows are held and paid out without conversion, so the
+// currencies must match.
+func (m EscrowMeta) CheckEscrow(toTenantID string, amount float64, currency, toCurrency string) error {
+	if amount <= 0 {
+		return &EscrowPolicyError{EscrowCodeInvalidAmount, "amount must be greater than zero"}
+	}
+	if toTenantID != m.TenantID && !slices.Contains(m.AllowedTenants, toTenantID) {
+		return &EscrowPolicyError{EscrowCodeTenantNotAllowed, fmt.Sprintf("tenant %s may not send escrows to %s", m.TenantID, toTenantID)}
+	}
+
+	if corridor, ok := m.Corridor(toTenantID); ok {
+		if corridor.MinAmount > 0 && amount < corridor.MinAmount {
+			return &EscrowPolicyError{EscrowCodeBelowMinimum, fmt.Sprintf("minimum escrow from %s to %s is %.2f", m.TenantID, toTenantID, corridor.MinAmount)}
+		}
+		if corridor.MaxAmount > 0 && amount > corridor.MaxAmount {
+			return &EscrowPolicyError{EscrowCodeAboveMaximum, fmt.Sprintf("maximum escrow from %s to %s is %.2f", m.TenantID, toTenantID, corridor.MaxAmount)}
+		}
+	}
+
+	if currency == "" {
+		currency = m.Currency
+	}
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	if toCurrency == "" {
+		toCurrency = DefaultCurrency
+	}
+	if toCurrency != currency {
+		return &EscrowPolicyError{EscrowCodeConversionRequired, fmt.Sprintf("%s settles in %s but the escrow is in %s; escrows are not converted", toTenantID, toCurrency, currency)}
+	}
+	return nil
+}
+
+// ValidateEscrowCorridor loads the sending tenant's EscrowMeta and checks an
+// escrow of amount in currency against it and against the currency of the
+// receiving tenant, see tenantCurrency.
+func ValidateEscrowCorridor(ctx context.Context, dbSvc *dynamodb.Client, fromTenantID, toTenantID string, amount float64, currency string) error {
+	meta, err := GetEscrowMeta(ctx, dbSvc, fromTenantID)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		return &EscrowPolicyError{EscrowCodeNotEnabled, fmt.Sprintf("tenant %s is not configured for escrow", fromTenantID)}
+	}
+
+	toCurrency := meta.Currency
+	if toTenantID != fromTenantID {
+		if toCurrency, err = tenantCurrency(ctx, dbSvc, toTenantID); err != nil {
+			return err
+		}
+	}
+	return meta.CheckEscrow(toTenantID, amount, currency, toCurrency)
+}
+
+// tenantCurrency is the currency tenantID settles in: that of its EscrowMeta,
+// else that of its Tenant record, else DefaultCurrency.
+func tenantCurrency(ctx context.Context, dbSvc *dynamodb.Client, tenantID string) (string, error) {
+	meta, err := GetEscrowMeta(ctx, dbSvc, tenantID)
+	if err != nil {
+		return "", err
+	}
+	if meta != nil && meta.Currency != "" {
+		return meta.Currency, nil
+	}
+	tenant, err := GetTenant(ctx, dbSvc, tenantID)
+	if errors.Is(err, ErrTenantNotFound) {
+		return DefaultCurrency, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if tenant.Currency == "" {
+		return DefaultCurrency, nil
+	}
+	return tenant.Currency, nil
+}
+
+// GetEscrowMeta returns the escrow configuration of a tenant, or nil if it has none.
+func GetEscrowMeta(ctx context.Context, dbSvc *dynamodb.Client, tenantID string) (*EscrowMeta, error) {
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(EscrowMetaTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: tenantID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get escrow meta: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var meta EscrowMeta
+	if err := attributevalue.UnmarshalMap(result.Item, &meta); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal escrow meta: %w", err)
+	}
+	return &meta, nil
+}
+
+// PutEscrowMeta stores the escrow configuration of a tenant.
+func PutEscrowMeta(ctx context.Context, dbSvc *dynamodb.Client, meta EscrowMeta) error {
+	if err := meta.validate(); err != nil {
+		return err
+	}
+
+	item, err := attributevalue.MarshalMap(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal escrow meta: %w", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(EscrowMetaTable),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store escrow meta: %w", err)
+	}
+	return nil
+}
+
+func (m EscrowMeta) validate() error {
+	if m.TenantID == "" {
+		return fmt.Errorf("tenantID is required")
+	}
+	for _, c := range m.Corridors {
+		if c.MaxAmount > 0 && c.MinAmount > c.MaxAmount {
+			return fmt.Errorf("corridor to %s has min %.2f above max %.2f", c.ToTenantID, c.MinAmount, c.MaxAmount)
+		}
+		if c.Fee < 0 || c.FeeRate < 0 || c.FeeRate >= 1 {
+			return fmt.Errorf("corridor to %s has an invalid fee", c.ToTenantID)
+		}
+		if c.RevenueShare != nil {
+			if err := c.RevenueShare.Validate(); err != nil {
+				return fmt.Errorf("corridor to %s: %w", c.ToTenantID, err)
+			}
+		}
+	}
+	return nil
+}
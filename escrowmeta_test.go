@@ -0,0 +1,58 @@
+package ledger
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscrowMetaCheckEscrow(t *testing.T) {
+	meta := EscrowMeta{
+		TenantID:       "nil",
+		AllowedTenants: []string{"bok", "cashi"},
+		Currency:       "SDG",
+		Corridors: []EscrowCorridor{
+			{ToTenantID: "bok", MinAmount: 10, MaxAmount: 1000},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		meta       EscrowMeta
+		toTenant   string
+		amount     float64
+		toCurrency string
+		wantCode   string
+	}{
+		{"allowed corridor", meta, "bok", 100, "SDG", ""},
+		{"same tenant", meta, "nil", 100, "", ""},
+		{"no corridor limits", meta, "cashi", 1e6, "", ""},
+		{"disallowed tenant", meta, "other", 100, "", EscrowCodeTenantNotAllowed},
+		{"zero amount", meta, "bok", 0, "", EscrowCodeInvalidAmount},
+		{"below minimum", meta, "bok", 5, "", EscrowCodeBelowMinimum},
+		{"above maximum", meta, "bok", 1000.01, "", EscrowCodeAboveMaximum},
+		{"currency mismatch", meta, "cashi", 100, "USD", EscrowCodeConversionRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.meta.CheckEscrow(tt.toTenant, tt.amount, "", tt.toCurrency)
+			if tt.wantCode == "" {
+				assert.NoError(t, err)
+				return
+			}
+			var policyErr *EscrowPolicyError
+			if assert.True(t, errors.As(err, &policyErr), "error: %v", err) {
+				assert.Equal(t, tt.wantCode, policyErr.Code)
+			}
+		})
+	}
+
+	// the sender's account currency counts, not only its tenant's
+	var policyErr *EscrowPolicyError
+	assert.ErrorAs(t, meta.CheckEscrow("bok", 100, "USD", "SDG"), &policyErr)
+	assert.Equal(t, EscrowCodeConversionRequired, policyErr.Code)
+	// a receiving tenant without a currency settles in DefaultCurrency
+	assert.ErrorAs(t, meta.CheckEscrow("cashi", 100, "USD", ""), &policyErr)
+	assert.NoError(t, EscrowMeta{TenantID: "nil"}.CheckEscrow("nil", 100, "", ""))
+}
@@ -0,0 +1,182 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// EscrowReconciliation compares the balance of NIL_ESCROW_ACCOUNT with the
+// escrows it is supposed to be holding.
+type EscrowReconciliation struct {
+	GeneratedAt string `json:"generated_at"`
+	// Currency is the currency of the escrow account.
+	Currency string `json:"currency"`
+	// OpenEscrows are the escrows whose funds should still be in the account.
+	OpenEscrows []EscrowTransaction `json:"open_escrows"`
+	// ExpectedFloat is the sum of the remaining amounts of the OpenEscrows
+	// held in Currency.
+	ExpectedFloat float64 `json:"expected_float"`
+	// OtherCurrencies sums, by currency, the remaining amounts of OpenEscrows
+	// held in currencies the account cannot hold. Any entry unbalances the
+	// report.
+	OtherCurrencies map[string]float64 `json:"other_currencies,omitempty"`
+	// ActualBalance is the stored balance of the escrow account.
+	ActualBalance float64 `json:"actual_balance"`
+	// LedgerBalance is the balance implied by the account's ledger entries.
+	LedgerBalance float64 `json:"ledger_balance"`
+	// Difference is ActualBalance - ExpectedFloat.
+	Difference float64 `json:"difference"`
+	// LedgerDifference is LedgerBalance - ExpectedFloat.
+	LedgerDifference float64 `json:"ledger_difference"`
+	// OrphanMovements are ledger entries on the escrow account whose UUID
+	// matches no escrow record.
+	OrphanMovements []LedgerEntry `json:"orphan_movements"`
+	Balanced        bool          `json:"balanced"`
+}
+
+// ReconcileEscrowFloat builds an EscrowReconciliation from the escrow table, the
+// escrow account and its ledger entries.
+func ReconcileEscrowFloat(ctx context.Context, dbSvc *dynamodb.Client) (*EscrowReconciliation, error) {
+	escrows, err := scanEscrowTransactions(ctx, dbSvc)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := GetAccountBalance(ctx, dbSvc, TransactionEntry{AccountID: ESCROW_ACCOUNT, FromAccount: ESCROW_ACCOUNT, TenantID: ESCROW_TENANT})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get escrow account: %w", err)
+	}
+	if account == nil {
+		return nil, fmt.Errorf("escrow account %s not found", ESCROW_ACCOUNT)
+	}
+
+	movements, err := accountLedgerEntries(ctx, dbSvc, ESCROW_TENANT, ESCROW_ACCOUNT)
+	if err != nil {
+		return nil, err
+	}
+
+	currency, err := GetCurrency(account.AccountCurrency())
+	if err != nil {
+		return nil, fmt.Errorf("escrow account %s: %w", ESCROW_ACCOUNT, err)
+	}
+
+	report := reconcileEscrowFloat(escrows, movements, account.Amount, currency)
+	report.GeneratedAt = getCurrentTimeZone()
+	return report, nil
+}
+
+// reconcileEscrowFloat does the bookkeeping of ReconcileEscrowFloat for an
+// escrow account in currency.
+func reconcileEscrowFloat(escrows []EscrowTransaction, movements []LedgerEntry, actualBalance float64, currency Currency) *EscrowReconciliation {
+	report := &EscrowReconciliation{
+		Currency:        currency.Code,
+		ActualBalance:   actualBalance,
+		OpenEscrows:     []EscrowTransaction{},
+		OrphanMovements: []LedgerEntry{},
+	}
+
+	known := make(map[string]bool, len(escrows))
+	for _, es := range escrows {
+		known[es.InitiatorUUID] = true
+		if es.Status.IsFinal() {
+			continue
+		}
+		report.OpenEscrows = append(report.OpenEscrows, es)
+		if code := es.EscrowCurrency(); code != currency.Code {
+			if report.OtherCurrencies == nil {
+				report.OtherCurrencies = map[string]float64{}
+			}
+			report.OtherCurrencies[code] += es.RemainingAmount()
+			continue
+		}
+		report.ExpectedFloat += es.RemainingAmount()
+	}
+
+	for _, entry := range movements {
+		switch entry.Type {
+		case "credit":
+			report.LedgerBalance += entry.Amount
+		case "debit":
+			report.LedgerBalance -= entry.Amount
+		}
+		if !known[entry.InitiatorUUID] {
+			report.OrphanMovements = append(report.OrphanMovements, entry)
+		}
+	}
+
+	for code, amount := range report.OtherCurrencies {
+		if c, err := GetCurrency(code); err == nil {
+			report.OtherCurrencies[code] = c.Round(amount)
+		}
+	}
+	report.ExpectedFloat = currency.Round(report.ExpectedFloat)
+	report.LedgerBalance = currency.Round(report.LedgerBalance)
+	report.Difference = currency.Round(report.ActualBalance - report.ExpectedFloat)
+	report.LedgerDifference = currency.Round(report.LedgerBalance - report.ExpectedFloat)
+	report.Balanced = report.Difference == 0 && report.LedgerDifference == 0 &&
+		len(report.OrphanMovements) == 0 && len(report.OtherCurrencies) == 0
+	return report
+}
+
+// scanEscrowTransactions reads every escrow record.
+func scanEscrowTransactions(ctx context.Context, dbSvc *dynamodb.Client) ([]EscrowTransaction, error) {
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(EscrowTransactionsTable),
+	}
+
+	var escrows []EscrowTransaction
+	for {
+		result, err := dbSvc.Scan(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan escrow transactions: %w", err)
+		}
+		var page []EscrowTransaction
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal escrow transactions: %w", err)
+		}
+		escrows = append(escrows, page...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	return escrows, nil
+}
+
+// accountLedgerEntries returns every ledger entry of an account.
+func accountLedgerEntries(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string) ([]LedgerEntry, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(LedgerTable),
+		KeyConditionExpression: aws.String("TenantID = :tenantID"),
+		FilterExpression:       aws.String("AccountID = :accountID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantID":  &types.AttributeValueMemberS{Value: tenantID},
+			":accountID": &types.AttributeValueMemberS{Value: accountID},
+		},
+	}
+
+	var entries []LedgerEntry
+	for {
+		result, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query ledger entries: %w", err)
+		}
+		var page []LedgerEntry
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal ledger entries: %w", err)
+		}
+		entries = append(entries, page...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	return entries, nil
+}
@@ -0,0 +1,61 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcileEscrowFloat(t *testing.T) {
+	escrows := []EscrowTransaction{
+		{InitiatorUUID: "open", Amount: 100, Status: StatusInProgress},
+		{InitiatorUUID: "partial", Amount: 50, ReleasedAmount: 20, Status: StatusInProgress},
+		{InitiatorUUID: "disputed", Amount: 30, Status: StatusDisputed},
+		{InitiatorUUID: "done", Amount: 70, Status: StatusCompleted},
+	}
+	movements := []LedgerEntry{
+		{InitiatorUUID: "open", Type: "credit", Amount: 100},
+		{InitiatorUUID: "partial", Type: "credit", Amount: 50},
+		{InitiatorUUID: "partial", Type: "debit", Amount: 20},
+		{InitiatorUUID: "disputed", Type: "credit", Amount: 30},
+		{InitiatorUUID: "done", Type: "credit", Amount: 70},
+		{InitiatorUUID: "done", Type: "debit", Amount: 70},
+	}
+
+	currency, err := GetCurrency(DefaultCurrency)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		movements      []LedgerEntry
+		actual         float64
+		wantBalanced   bool
+		wantDiff       float64
+		wantLedgerDiff float64
+		wantOrphans    int
+	}{
+		{"balanced", movements, 160, true, 0, 0, 0},
+		{"short", movements, 150, false, -10, 0, 0},
+		{"orphan movement", append(movements, LedgerEntry{InitiatorUUID: "ghost", Type: "credit", Amount: 5}), 160, false, 0, 5, 1},
+		{"ledger drift", append(movements, LedgerEntry{InitiatorUUID: "open", Type: "debit", Amount: 10}), 160, false, 0, -10, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := reconcileEscrowFloat(escrows, tt.movements, tt.actual, currency)
+			assert.Len(t, report.OpenEscrows, 3)
+			assert.Equal(t, 160.0, report.ExpectedFloat)
+			assert.Equal(t, tt.wantDiff, report.Difference)
+			assert.Equal(t, tt.wantLedgerDiff, report.LedgerDifference)
+			assert.Len(t, report.OrphanMovements, tt.wantOrphans)
+			assert.Equal(t, tt.wantBalanced, report.Balanced)
+		})
+	}
+
+	t.Run("escrow in another currency", func(t *testing.T) {
+		foreign := append(escrows, EscrowTransaction{InitiatorUUID: "usd", Amount: 12.5, Currency: "USD", Status: StatusInProgress})
+		report := reconcileEscrowFloat(foreign, movements, 160, currency)
+		assert.Equal(t, 160.0, report.ExpectedFloat)
+		assert.Equal(t, map[string]float64{"USD": 12.5}, report.OtherCurrencies)
+		assert.False(t, report.Balanced)
+	})
+}
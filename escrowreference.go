@@ -0,0 +1,226 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// EscrowReferencesTable maps a service provider's PaymentReference to the
+// escrow it identifies. It is keyed by ServiceProvider and PaymentReference, so
+// a provider can use each reference only once.
+const EscrowReferencesTable = "EscrowPaymentReferences"
+
+// escrowPaymentReferenceIndex indexes EscrowTransactionsTable by
+// ServiceProvider and PaymentReference. It finds escrows created before
+// references were recorded in EscrowReferencesTable.
+const escrowPaymentReferenceIndex = "PaymentReferenceIndex"
+
+var ErrDuplicatePaymentReference = errors.New("payment reference already used by this service provider")
+
+// escrowReference is an item of EscrowReferencesTable.
+type escrowReference struct {
+	ServiceProvider  string `dynamodbav:"ServiceProvider"`
+	PaymentReference string `dynamodbav:"PaymentReference"`
+	UUID             string `dynamodbav:"UUID"`
+	TransactionID    string `dynamodbav:"TransactionID"`
+	CreatedAt        string `dynamodbav:"CreatedAt"`
+}
+
+// EscrowStatusInquiry is what a service provider sees of one of its escrows.
+type EscrowStatusInquiry struct {
+	TransactionID    string  `json:"transaction_id"`
+	UUID             string  `json:"uuid"`
+	ServiceProvider  string  `json:"service_provider"`
+	PaymentReference string  `json:"service_provider_transaction_id"`
+	Status           string  `json:"status"`
+	Amount           float64 `json:"amount"`
+	ReleasedAmount   float64 `json:"released_amount"`
+	RefundedAmount   float64 `json:"refunded_amount"`
+	RemainingAmount  float64 `json:"remaining_amount"`
+	CashoutProvider  string  `json:"cashout_provider,omitempty"`
+	CreatedAt        string  `json:"created_at,omitempty"`
+	UpdatedAt        string  `json:"updated_at,omitempty"`
+	ExpiresAt        int64   `json:"expires_at,omitempty"`
+}
+
+// NewEscrowStatusInquiry summarizes es for its service provider.
+func NewEscrowStatusInquiry(es EscrowTransaction) EscrowStatusInquiry {
+	inquiry := EscrowStatusInquiry{
+		TransactionID:    es.SystemTransactionID,
+		UUID:             es.InitiatorUUID,
+		ServiceProvider:  es.ServiceProvider,
+		PaymentReference: es.PaymentReference,
+		Status:           es.Status.String(),
+		Amount:           es.Amount,
+		ReleasedAmount:   es.ReleasedAmount,
+		RefundedAmount:   es.RefundedAmount,
+		RemainingAmount:  es.RemainingAmount(),
+		CashoutProvider:  es.CashoutProvider,
+		CreatedAt:        es.Timestamp,
+		UpdatedAt:        es.Timestamp,
+		ExpiresAt:        es.ExpiresAt,
+	}
+	if es.Status.IsFinal() {
+		inquiry.RemainingAmount = 0
+	}
+	if len(es.History) > 0 {
+		inquiry.UpdatedAt = es.History[len(es.History)-1].Timestamp
+	}
+	return inquiry
+}
+
+// InquireEscrowStatus returns the status of the escrow serviceProvider created
+// with paymentReference.
+func InquireEscrowStatus(ctx context.Context, dbSvc *dynamodb.Client, serviceProvider, paymentReference string) (*EscrowStatusInquiry, error) {
+	es, err := GetEscrowTransactionByPaymentReference(ctx, dbSvc, serviceProvider, paymentReference)
+	if err != nil {
+		return nil, err
+	}
+	inquiry := NewEscrowStatusInquiry(*es)
+	return &inquiry, nil
+}
+
+// GetEscrowTransactionByPaymentReference returns the escrow serviceProvider
+// created with paymentReference.
+func GetEscrowTransactionByPaymentReference(ctx context.Context, dbSvc *dynamodb.Client, serviceProvider, paymentReference string) (*EscrowTransaction, error) {
+	if serviceProvider == "" || paymentReference == "" {
+		return nil, fmt.Errorf("service provider and payment reference are required")
+	}
+
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(EscrowReferencesTable),
+		Key:       escrowReferenceKey(serviceProvider, paymentReference),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payment reference: %w", err)
+	}
+	if result.Item == nil {
+		// escrows created before references were recorded
+		es, err := queryEscrowByPaymentReference(ctx, dbSvc, serviceProvider, paymentReference)
+		if err != nil {
+			return nil, err
+		}
+		if es == nil {
+			return nil, fmt.Errorf("escrow transaction with payment reference %s not found for %s", paymentReference, serviceProvider)
+		}
+		return es, nil
+	}
+
+	var ref escrowReference
+	if err := attributevalue.UnmarshalMap(result.Item, &ref); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal payment reference: %w", err)
+	}
+	stored, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(EscrowTransactionsTable),
+		Key: map[string]types.AttributeValue{
+			"UUID":          &types.AttributeValueMemberS{Value: ref.UUID},
+			"TransactionID": &types.AttributeValueMemberS{Value: ref.TransactionID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get escrow transaction: %w", err)
+	}
+	if stored.Item == nil {
+		return nil, fmt.Errorf("escrow transaction with payment reference %s not found for %s", paymentReference, serviceProvider)
+	}
+	var es EscrowTransaction
+	if err := attributevalue.UnmarshalMap(stored.Item, &es); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal escrow transaction: %w", err)
+	}
+	return &es, nil
+}
+
+// queryEscrowByPaymentReference looks up an escrow by its reference in
+// escrowPaymentReferenceIndex. It returns nil when there is none.
+func queryEscrowByPaymentReference(ctx context.Context, dbSvc *dynamodb.Client, serviceProvider, paymentReference string) (*EscrowTransaction, error) {
+	result, err := dbSvc.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(EscrowTransactionsTable),
+		IndexName:              aws.String(escrowPaymentReferenceIndex),
+		KeyConditionExpression: aws.String("ServiceProvider = :sp AND PaymentReference = :ref"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":sp":  &types.AttributeValueMemberS{Value: serviceProvider},
+			":ref": &types.AttributeValueMemberS{Value: paymentReference},
+		},
+		Limit: aws.Int32(1),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query escrow transactions: %w", err)
+	}
+	if len(result.Items) == 0 {
+		return nil, nil
+	}
+	var es EscrowTransaction
+	if err := attributevalue.UnmarshalMap(result.Items[0], &es); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal escrow transaction: %w", err)
+	}
+	return &es, nil
+}
+
+// paymentReferenceTaken reports whether serviceProvider already used
+// paymentReference. CreateEscrow enforces uniqueness atomically against
+// EscrowReferencesTable; this rejects duplicates before any balance is read,
+// including those of escrows created before references were recorded.
+func paymentReferenceTaken(ctx context.Context, dbSvc *dynamodb.Client, serviceProvider, paymentReference string) (bool, error) {
+	if serviceProvider == "" || paymentReference == "" {
+		return false, nil
+	}
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(EscrowReferencesTable),
+		Key:       escrowReferenceKey(serviceProvider, paymentReference),
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to get payment reference: %w", err)
+	}
+	if result.Item != nil {
+		return true, nil
+	}
+	legacy, err := queryEscrowByPaymentReference(ctx, dbSvc, serviceProvider, paymentReference)
+	if err != nil {
+		return false, err
+	}
+	return legacy != nil, nil
+}
+
+func duplicateReferenceError(esEntry EscrowEntry) error {
+	return &EscrowCreationError{
+		Code:    "duplicate_payment_reference",
+		Message: fmt.Sprintf("Payment reference %s was already used by %s.", esEntry.PaymentReference, esEntry.ServiceProvider),
+		Err:     ErrDuplicatePaymentReference,
+	}
+}
+
+// escrowReferencePut claims es.PaymentReference for es.ServiceProvider as part
+// of the escrow creation transaction. It returns nil when es has no reference.
+func escrowReferencePut(es EscrowTransaction) (*types.Put, error) {
+	if es.ServiceProvider == "" || es.PaymentReference == "" {
+		return nil, nil
+	}
+	item, err := attributevalue.MarshalMap(escrowReference{
+		ServiceProvider:  es.ServiceProvider,
+		PaymentReference: es.PaymentReference,
+		UUID:             es.InitiatorUUID,
+		TransactionID:    es.SystemTransactionID,
+		CreatedAt:        es.Timestamp,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payment reference: %w", err)
+	}
+	return &types.Put{
+		TableName:           aws.String(EscrowReferencesTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(PaymentReference)"),
+	}, nil
+}
+
+func escrowReferenceKey(serviceProvider, paymentReference string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"ServiceProvider":  &types.AttributeValueMemberS{Value: serviceProvider},
+		"PaymentReference": &types.AttributeValueMemberS{Value: paymentReference},
+	}
+}
@@ -0,0 +1,78 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscrowCreationItemsClaimsPaymentReference(t *testing.T) {
+	es := EscrowTransaction{
+		SystemTransactionID: "tx-1",
+		FromAccount:         "0111493885",
+		FromTenantID:        "nonil",
+		Amount:              5,
+		InitiatorUUID:       "uuid-1",
+		Status:              StatusInProgress,
+		ServiceProvider:     "oss@pynil.com",
+		PaymentReference:    "ref-1",
+	}
+	items, err := escrowCreationItems(es, 1)
+	assert.NoError(t, err)
+	assert.Len(t, items, 7)
+	assert.Equal(t, EscrowIdempotencyTable, *items[0].Put.TableName)
+
+	ref := items[1].Put
+	assert.NotNil(t, ref)
+	assert.Equal(t, EscrowReferencesTable, *ref.TableName)
+	assert.Equal(t, "attribute_not_exists(PaymentReference)", *ref.ConditionExpression)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "oss@pynil.com"}, ref.Item["ServiceProvider"])
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "ref-1"}, ref.Item["PaymentReference"])
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "tx-1"}, ref.Item["TransactionID"])
+
+	es.PaymentReference = ""
+	items, err = escrowCreationItems(es, 1)
+	assert.NoError(t, err)
+	assert.Len(t, items, 6)
+
+	// empty strings may not be written to the keys of PaymentReferenceIndex
+	stored := items[len(items)-1].Put
+	assert.Equal(t, EscrowTransactionsTable, *stored.TableName)
+	assert.NotContains(t, stored.Item, "PaymentReference")
+}
+
+func TestNewEscrowStatusInquiry(t *testing.T) {
+	tests := []struct {
+		name          string
+		es            EscrowTransaction
+		wantStatus    string
+		wantRemaining float64
+		wantUpdatedAt string
+	}{
+		{
+			"in progress",
+			EscrowTransaction{Amount: 100, ReleasedAmount: 40, Status: StatusInProgress, Timestamp: "t0"},
+			"InProgress", 60, "t0",
+		},
+		{
+			"paid out",
+			EscrowTransaction{Amount: 100, Status: StatusCompleted, Timestamp: "t0",
+				History: []EscrowTransition{{From: StatusInProgress, To: StatusCompleted, Timestamp: "t1"}}},
+			"Completed", 0, "t1",
+		},
+		{
+			"disputed",
+			EscrowTransaction{Amount: 10, Status: StatusDisputed, Timestamp: "t0"},
+			"Disputed", 10, "t0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewEscrowStatusInquiry(tt.es)
+			assert.Equal(t, tt.wantStatus, got.Status)
+			assert.InDelta(t, tt.wantRemaining, got.RemainingAmount, amountEpsilon)
+			assert.Equal(t, tt.wantUpdatedAt, got.UpdatedAt)
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+// amountEpsilon absorbs float64 noise when comparing escrowed amounts.
+const amountEpsilon = 0.000001
+
+// ErrEscrowNotReleasable is returned when releasing or refunding an escrow that
+// is not InProgress.
+var ErrEscrowNotReleasable = errors.New("escrow is not in progress")
+
+// ErrInsufficientEscrowBalance is returned when a release asks for more than
+// the escrow still holds.
+var ErrInsufficientEscrowBalance = errors.New("release exceeds remaining escrowed amount")
+
+// EscrowSplit is one beneficiary of a release. An empty ToAccount means the
+// escrow's own ToAccount and ToTenantID.
+type EscrowSplit struct {
+	ToAccount  string  `dynamodbav:"ToAccount" json:"to_account,omitempty"`
+	ToTenantID string  `dynamodbav:"ToTenantID" json:"to_tenant_id,omitempty"`
+	Amount     float64 `dynamodbav:"Amount" json:"amount"`
+	Label      string  `dynamodbav:"Label" json:"label,omitempty"`
+}
+
+// EscrowRelease records a split that was paid out of an escrow.
+type EscrowRelease struct {
+	ToAccount     string  `dynamodbav:"ToAccount" json:"to_account"`
+	ToTenantID    string  `dynamodbav:"ToTenantID" json:"to_tenant_id"`
+	Amount        float64 `dynamodbav:"Amount" json:"amount"`
+	Label         string  `dynamodbav:"Label" json:"label,omitempty"`
+	TransactionID string  `dynamodbav:"TransactionID" json:"transaction_id"`
+	Actor         string  `dynamodbav:"Actor" json:"actor,omitempty"`
+	Timestamp     string  `dynamodbav:"Timestamp" json:"timestamp"`
+}
+
+// RemainingAmount is the part of the escrow that has been neither released nor refunded.
+func (es EscrowTransaction) RemainingAmount() float64 {
+	remaining := es.Amount - es.ReleasedAmount - es.RefundedAmount
+	if remaining < amountEpsilon {
+		return 0
+	}
+	return remaining
+}
+
+// ReleaseEscrow pays part or all of an InProgress escrow out to one or more
+// beneficiaries, e.g. a seller, the platform commission and a courier. With no
+// splits the whole remaining amount goes to the escrow's ToAccount. The escrow
+// completes once nothing remains; otherwise it stays InProgress for later
+// releases or a RefundEscrowRemainder.
+//
+// The splits, the escrow's released amount and, once nothing remains, its
+// completion are written in one transaction conditioned on the escrow being
+// unchanged since it was read, so concurrent releases cannot overdraw it and a
+// failed release moves nothing. Escrows whose payout is queued with a service
+// provider are refused with ErrEscrowPayoutQueued; they settle through
+// ConfirmEscrowPayout or a dispute.
+func ReleaseEscrow(ctx context.Context, dbSvc *dynamodb.Client, transactionID string, splits []EscrowSplit, actor string) (*EscrowTransaction, error) {
+	es, err := GetEscrowTransactionBySystemID(ctx, dbSvc, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	if es, err = reloadEscrow(ctx, dbSvc, *es); err != nil {
+		return nil, err
+	}
+	if es.Status != StatusInProgress {
+		return es, fmt.Errorf("%w: escrow %s is %s", ErrEscrowNotReleasable, transactionID, es.Status)
+	}
+	provider, queued, err := payoutQueued(*es)
+	if err != nil {
+		return es, err
+	}
+	if queued {
+		return es, fmt.Errorf("%w: escrow %s is paid out by %s", ErrEscrowPayoutQueued, transactionID, provider.Name())
+	}
+
+	change, err := releaseChange(*es, StatusInProgress, splits, actor)
+	if err != nil {
+		return es, err
+	}
+	if err := applyEscrowChange(ctx, dbSvc, *es, change); err != nil {
+		return es, err
+	}
+	change.applyTo(es)
+	return es, nil
+}
+
+// releaseChange pays splits out of es, which is in status from, and completes
+// it once nothing remains.
+func releaseChange(es EscrowTransaction, from Status, splits []EscrowSplit, actor string) (escrowChange, error) {
+	if len(splits) == 0 {
+		splits = []EscrowSplit{{Amount: es.RemainingAmount()}}
+	}
+	if len(splits) > maxEscrowSplits {
+		return escrowChange{}, fmt.Errorf("a release takes at most %d splits, got %d", maxEscrowSplits, len(splits))
+	}
+
+	change := escrowChange{From: from, To: from, Actor: actor}
+	var total float64
+	for i, split := range splits {
+		if split.ToAccount == "" {
+			split.ToAccount, split.ToTenantID = es.ToAccount, es.ToTenantID
+		}
+		if split.Amount <= 0 {
+			return escrowChange{}, fmt.Errorf("split %d to %s must have a positive amount", i, split.ToAccount)
+		}
+		total += split.Amount
+
+		leg := escrowLeg{
+			ToAccount:     split.ToAccount,
+			ToTenantID:    split.ToTenantID,
+			Amount:        split.Amount,
+			TransactionID: ksuid.New().String(),
+		}
+		change.Released = append(change.Released, leg)
+		change.Releases = append(change.Releases, EscrowRelease{
+			ToAccount:     leg.ToAccount,
+			ToTenantID:    leg.ToTenantID,
+			Amount:        leg.Amount,
+			Label:         split.Label,
+			TransactionID: leg.TransactionID,
+			Actor:         actor,
+			Timestamp:     getCurrentTimeZone(),
+		})
+	}
+	if total > es.RemainingAmount()+amountEpsilon {
+		return escrowChange{}, fmt.Errorf("%w: requested %.2f, remaining %.2f", ErrInsufficientEscrowBalance, total, es.RemainingAmount())
+	}
+	if es.RemainingAmount()-total < amountEpsilon {
+		change.To, change.Reason = StatusCompleted, "escrow fully released"
+	}
+	return change, nil
+}
+
+// RefundEscrowRemainder returns whatever is left in an InProgress escrow to the
+// sender and finalizes it: Completed if part of it was released, Failed if not.
+// The refund and the status change are written in one transaction; a payout
+// queued with a service provider is cancelled afterwards.
+func RefundEscrowRemainder(ctx context.Context, dbSvc *dynamodb.Client, transactionID, actor string) (*EscrowTransaction, error) {
+	es, err := GetEscrowTransactionBySystemID(ctx, dbSvc, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	if es, err = reloadEscrow(ctx, dbSvc, *es); err != nil {
+		return nil, err
+	}
+	if es.Status != StatusInProgress {
+		return es, fmt.Errorf("%w: escrow %s is %s", ErrEscrowNotReleasable, transactionID, es.Status)
+	}
+	provider, queued, err := payoutQueued(*es)
+	if err != nil {
+		return es, err
+	}
+
+	remaining := es.RemainingAmount()
+	next := StatusCompleted
+	if es.ReleasedAmount == 0 {
+		next = StatusFailed
+	}
+	if err := finalizeEscrow(ctx, dbSvc, *es, next, "RefundedAmount", refundLeg(*es, remaining),
+		actor, fmt.Sprintf("remaining %.2f refunded to sender", remaining)); err != nil {
+		return es, err
+	}
+	es.Status = next
+	es.RefundedAmount += remaining
+
+	if queued {
+		if err := provider.CancelPayout(ctx, dbSvc, *es); err != nil {
+			return es, fmt.Errorf("escrow %s refunded but cancelling its payout failed: %w", transactionID, err)
+		}
+	}
+	return es, nil
+}
+
+func escrowKey(es *EscrowTransaction) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"UUID":          &types.AttributeValueMemberS{Value: es.InitiatorUUID},
+		"TransactionID": &types.AttributeValueMemberS{Value: es.SystemTransactionID},
+	}
+}
+
+// numberValue formats an amount with the shortest exact representation, so a
+// condition on it matches the stored value it was read from.
+func numberValue(v float64) *types.AttributeValueMemberN {
+	return &types.AttributeValueMemberN{Value: strconv.FormatFloat(v, 'f', -1, 64)}
+}
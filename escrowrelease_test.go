@@ -0,0 +1,26 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscrowTransactionRemainingAmount(t *testing.T) {
+	tests := []struct {
+		name string
+		es   EscrowTransaction
+		want float64
+	}{
+		{"untouched", EscrowTransaction{Amount: 100}, 100},
+		{"partially released", EscrowTransaction{Amount: 100, ReleasedAmount: 60}, 40},
+		{"released and refunded", EscrowTransaction{Amount: 100, ReleasedAmount: 60, RefundedAmount: 40}, 0},
+		{"float noise", EscrowTransaction{Amount: 0.3, ReleasedAmount: 0.1 + 0.2}, 0},
+		{"over released", EscrowTransaction{Amount: 10, ReleasedAmount: 11}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.want, tt.es.RemainingAmount(), amountEpsilon)
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// escrowTransitions lists the statuses an escrow may move to from each status.
+// Completed, Failed and Expired are final. A Disputed escrow is frozen until the
+// dispute is resolved: it is settled straight to Completed or Failed, or
+// returns to InProgress when a dispute cannot be recorded.
+var escrowTransitions = map[Status][]Status{
+	StatusPending:    {StatusInProgress, StatusFailed},
+	StatusInProgress: {StatusCompleted, StatusFailed, StatusExpired, StatusDisputed},
+	StatusDisputed:   {StatusInProgress, StatusCompleted, StatusFailed},
+}
+
+// ErrInvalidEscrowTransition is returned for transitions the state machine forbids.
+var ErrInvalidEscrowTransition = errors.New("invalid escrow status transition")
+
+// ErrEscrowStateConflict is returned when the stored escrow is no longer in the
+// expected status, typically because another writer moved it first.
+var ErrEscrowStateConflict = errors.New("escrow status changed concurrently")
+
+// EscrowTransition records a single status change of an escrow transaction.
+type EscrowTransition struct {
+	From      Status `dynamodbav:"From" json:"from"`
+	To        Status `dynamodbav:"To" json:"to"`
+	Actor     string `dynamodbav:"Actor" json:"actor,omitempty"`
+	Reason    string `dynamodbav:"Reason" json:"reason,omitempty"`
+	Timestamp string `dynamodbav:"Timestamp" json:"timestamp"`
+}
+
+// IsFinal reports whether no further transitions are allowed from s.
+func (s Status) IsFinal() bool {
+	return len(escrowTransitions[s]) == 0
+}
+
+// CanTransitionTo reports whether the escrow state machine allows s -> next.
+func (s Status) CanTransitionTo(next Status) bool {
+	return slices.Contains(escrowTransitions[s], next)
+}
+
+// TransitionEscrow moves the escrow identified by uuid and transactionID from
+// `from` to `to`, appending the change to its transition history. The update is
+// conditional on the stored status, so concurrent writers cannot both win.
+func TransitionEscrow(ctx context.Context, dbSvc *dynamodb.Client, uuid, transactionID string, from, to Status, actor, reason string) error {
+	if !from.CanTransitionTo(to) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidEscrowTransition, from, to)
+	}
+
+	entry, err := attributevalue.Marshal([]EscrowTransition{{
+		From:      from,
+		To:        to,
+		Actor:     actor,
+		Reason:    reason,
+		Timestamp: getCurrentTimeZone(),
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to marshal escrow transition: %w", err)
+	}
+	fromValue, err := from.MarshalDynamoDBAttributeValue()
+	if err != nil {
+		return err
+	}
+	toValue, err := to.MarshalDynamoDBAttributeValue()
+	if err != nil {
+		return err
+	}
+
+	_, err = dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(EscrowTransactionsTable),
+		Key: map[string]types.AttributeValue{
+			"UUID":          &types.AttributeValueMemberS{Value: uuid},
+			"TransactionID": &types.AttributeValueMemberS{Value: transactionID},
+		},
+		UpdateExpression: aws.String("SET #ts = :to, #history = list_append(if_not_exists(#history, :empty), :entry)"),
+		// Rows written before statuses were stored by name hold the numeric value.
+		ConditionExpression: aws.String("#ts = :from OR #ts = :legacyFrom"),
+		ExpressionAttributeNames: map[string]string{
+			"#ts":      "TransactionStatus",
+			"#history": "TransitionHistory",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":to":         toValue,
+			":from":       fromValue,
+			":legacyFrom": &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", from)},
+			":entry":      entry,
+			":empty":      &types.AttributeValueMemberL{Value: []types.AttributeValue{}},
+		},
+	})
+	if err != nil {
+		var conditionalCheckFailedErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionalCheckFailedErr) {
+			return fmt.Errorf("%w: escrow %s is no longer %s", ErrEscrowStateConflict, transactionID, from)
+		}
+		return fmt.Errorf("failed to update escrow status: %w", err)
+	}
+	return nil
+}
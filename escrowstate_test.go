@@ -0,0 +1,62 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusCanTransitionTo(t *testing.T) {
+	tests := []struct {
+		from Status
+		to   Status
+		want bool
+	}{
+		{StatusPending, StatusInProgress, true},
+		{StatusPending, StatusFailed, true},
+		{StatusPending, StatusCompleted, false},
+		{StatusInProgress, StatusCompleted, true},
+		{StatusInProgress, StatusFailed, true},
+		{StatusInProgress, StatusPending, false},
+		{StatusInProgress, StatusExpired, true},
+		{StatusExpired, StatusCompleted, false},
+		{StatusInProgress, StatusDisputed, true},
+		{StatusDisputed, StatusInProgress, true},
+		{StatusDisputed, StatusCompleted, true},
+		{StatusDisputed, StatusFailed, true},
+		{StatusDisputed, StatusExpired, false},
+		{StatusPending, StatusDisputed, false},
+		{StatusCompleted, StatusFailed, false},
+		{StatusFailed, StatusCompleted, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from.String()+"->"+tt.to.String(), func(t *testing.T) {
+			if got := tt.from.CanTransitionTo(tt.to); got != tt.want {
+				t.Errorf("CanTransitionTo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	assert.True(t, StatusCompleted.IsFinal())
+	assert.True(t, StatusFailed.IsFinal())
+	assert.True(t, StatusExpired.IsFinal())
+	assert.False(t, StatusInProgress.IsFinal())
+	assert.False(t, StatusDisputed.IsFinal())
+}
+
+func TestStatusDynamoDBRepresentation(t *testing.T) {
+	av, err := attributevalue.Marshal(StatusInProgress)
+	assert.NoError(t, err)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "InProgress"}, av)
+
+	var fromString, fromNumber Status
+	assert.NoError(t, attributevalue.Unmarshal(av, &fromString))
+	assert.NoError(t, attributevalue.Unmarshal(&types.AttributeValueMemberN{Value: "3"}, &fromNumber))
+	assert.Equal(t, StatusInProgress, fromString)
+	assert.Equal(t, StatusInProgress, fromNumber)
+
+	item, err := attributevalue.MarshalMap(EscrowTransaction{Status: StatusCompleted})
+	assert.NoError(t, err)
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "Completed"}, item["TransactionStatus"])
+}
@@ -0,0 +1,407 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+// FX_POSITION_ACCOUNT is the per-tenant account through which conversions
+// pass. Each currency has its own position item, see fxPositionAccountID: a
+// conversion credits the position in the source currency and debits the one in
+// the target currency, so the positions show the tenant's open exposure.
+const FX_POSITION_ACCOUNT = "NIL_FX_POSITION"
+
+// AccountCurrency returns the currency of the account, DefaultCurrency for
+// accounts stored without one.
+func (u User) AccountCurrency() string {
+	if u.Currency == "" {
+		return DefaultCurrency
+	}
+	return u.Currency
+}
+
+// EscrowCurrency is the currency the escrow is held in. Escrows created before
+// the currency was recorded are in DefaultCurrency.
+func (es EscrowTransaction) EscrowCurrency() string {
+	if es.Currency == "" {
+		return DefaultCurrency
+	}
+	return es.Currency
+}
+
+// TransactionCurrency is the currency the transaction moved. Records written
+// before the currency was recorded are in DefaultCurrency.
+func (tx TransactionEntry) TransactionCurrency() string {
+	if tx.Currency == "" {
+		return DefaultCurrency
+	}
+	return tx.Currency
+}
+
+// CurrencyAccountID returns the AccountID holding accountID's balance in
+// currency. Balances in DefaultCurrency stay on the account itself.
+func CurrencyAccountID(accountID, currency string) string {
+	if currency == "" || currency == DefaultCurrency {
+		return accountID
+	}
+	return accountID + ":" + currency
+}
+
+func fxPositionAccountID(currency string) string {
+	return FX_POSITION_ACCOUNT + ":" + currency
+}
+
+// CreateCurrencyAccount opens a balance in currency for an existing account.
+// The new account copies the owner's details and starts at zero.
+func CreateCurrencyAccount(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID, currency string) (*User, error) {
+	if tenantID == "" {
+		tenantID = "nil"
+	}
+	if currency == "" || currency == DefaultCurrency {
+		return nil, fmt.Errorf("account %s already holds %s", accountID, DefaultCurrency)
+	}
+	owner, err := GetAccount(ctx, dbSvc, TransactionEntry{AccountID: accountID, TenantID: tenantID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account %s: %w", accountID, err)
+	}
+
+	account := *owner
+	account.AccountID = CurrencyAccountID(accountID, currency)
+	account.Currency = currency
+	account.Amount = 0
+	account.Version = getCurrentTimestamp()
+	account.CreatedAt = getCurrentTimeZone()
+
+	item, err := attributevalue.MarshalMap(account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal account: %w", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(NilUsers),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(AccountID)"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s account for %s: %w", currency, accountID, err)
+	}
+	return &account, nil
+}
+
+// GetCurrencyAccounts returns accountID and each of its currency accounts.
+func GetCurrencyAccounts(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string) ([]User, error) {
+	if tenantID == "" {
+		tenantID = "nil"
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(NilUsers),
+		KeyConditionExpression: aws.String("TenantID = :tenantID AND begins_with(AccountID, :accountID)"),
+		// balance shards of sharded accounts are not accounts of their own
+		FilterExpression: aws.String("attribute_not_exists(ShardOf)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantID":  &types.AttributeValueMemberS{Value: tenantID},
+			":accountID": &types.AttributeValueMemberS{Value: accountID},
+		},
+	}
+
+	var accounts []User
+	for {
+		result, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query accounts: %w", err)
+		}
+		var page []User
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal accounts: %w", err)
+		}
+		for _, account := range page {
+			// begins_with also matches other accounts sharing the prefix
+			if account.AccountID == accountID || strings.HasPrefix(account.AccountID, accountID+":") {
+				accounts = append(accounts, account)
+			}
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	return accounts, nil
+}
+
+// ConversionTransfer moves Amount of FromCurrency out of FromAccount and pays
+// its converted value in ToCurrency into ToAccount, within TenantID.
+type ConversionTransfer struct {
+	TenantID     string  `json:"tenant_id,omitempty"`
+	FromAccount  string  `json:"from_account"`
+	ToAccount    string  `json:"to_account"`
+	FromCurrency string  `json:"from_currency"`
+	ToCurrency   string  `json:"to_currency"`
+	Amount       float64 `json:"amount"`
+	// QuoteID executes the transfer at the rate locked by a RateQuote.
+	QuoteID       string `json:"quote_id,omitempty"`
+	InitiatorUUID string `json:"uuid,omitempty"`
+	SignedUUID    string `json:"signed_uuid,omitempty"`
+	Timestamp     string `json:"timestamp,omitempty"`
+}
+
+// convertAmount applies rate to amount, rounded to the minor unit of the
+// target currency, or to two decimals if it is not registered.
+func convertAmount(amount, rate float64, to string) float64 {
+	c, err := GetCurrency(to)
+	if err != nil {
+		return math.Round(amount*rate*100) / 100
+	}
+	return c.Round(amount * rate)
+}
+
+// TransferWithConversion converts tr.Amount at the rate given by rates and
+// posts four legs in a single transaction: the sender debit, a credit of the
+// tenant's FX position in FromCurrency, a debit of its FX position in
+// ToCurrency and the receiver credit. The response carries the applied rate.
+// When tr.QuoteID is set the quote's locked rate is used instead, rates may be
+// nil, and the quote is consumed by the same transaction.
+func TransferWithConversion(ctx context.Context, dbSvc *dynamodb.Client, rates RateProvider, tr ConversionTransfer) (NilResponse, error) {
+	if tr.TenantID == "" {
+		tr.TenantID = "nil"
+	}
+	if tr.FromCurrency == "" {
+		tr.FromCurrency = DefaultCurrency
+	}
+	if tr.ToCurrency == "" {
+		tr.ToCurrency = DefaultCurrency
+	}
+	errorResponse := func(code, message string, err error) (NilResponse, error) {
+		return NilResponse{
+			Status:    "error",
+			Code:      code,
+			Message:   message,
+			Details:   err.Error(),
+			Timestamp: tr.Timestamp,
+			Data: data{
+				UUID:       tr.InitiatorUUID,
+				SignedUUID: tr.SignedUUID,
+			},
+		}, err
+	}
+	if tr.Amount <= 0 {
+		return errorResponse("invalid_amount", "Amount must be greater than zero.", errors.New("invalid amount"))
+	}
+	if tr.FromCurrency == tr.ToCurrency {
+		// both FX legs would update the same position item
+		return errorResponse("invalid_currency", "A conversion needs two different currencies.",
+			fmt.Errorf("cannot convert %s to itself", tr.FromCurrency))
+	}
+
+	fromAccountID := CurrencyAccountID(tr.FromAccount, tr.FromCurrency)
+	toAccountID := CurrencyAccountID(tr.ToAccount, tr.ToCurrency)
+
+	sender, err := GetAccountBalance(ctx, dbSvc, TransactionEntry{AccountID: fromAccountID, TenantID: tr.TenantID})
+	if err != nil {
+		return errorResponse("user_not_found", "Error in retrieving sender.", fmt.Errorf("error in retrieving sender: %w", err))
+	}
+	receiver, err := GetAccount(ctx, dbSvc, TransactionEntry{AccountID: toAccountID, TenantID: tr.TenantID})
+	if err != nil {
+		return errorResponse("user_not_found", "Error in retrieving receiver.", fmt.Errorf("error in retrieving receiver: %w", err))
+	}
+	if sender.AccountCurrency() != tr.FromCurrency || receiver.AccountCurrency() != tr.ToCurrency {
+		return errorResponse("currency_mismatch", "Account currency does not match the transfer.",
+			fmt.Errorf("%s holds %s and %s holds %s", fromAccountID, sender.AccountCurrency(), toAccountID, receiver.AccountCurrency()))
+	}
+	if err := ValidateCurrencyAmount(tr.FromCurrency, tr.Amount); err != nil {
+		return errorResponse("invalid_amount", "Invalid amount for the account currency.", err)
+	}
+	if err := checkTenantTransfer(ctx, dbSvc, tr.TenantID, tr.TenantID, tr.Amount); errors.Is(err, ErrTenantInactive) || errors.Is(err, ErrTenantLimit) {
+		return errorResponse(tenantTransferCode(err), "The tenant does not allow this transfer.", err)
+	} else if err != nil {
+		return NilResponse{}, err
+	}
+	if tr.Amount > sender.Amount {
+		return errorResponse("insufficient_balance", "Insufficient balance to complete the transaction.", errors.New("insufficient balance"))
+	}
+
+	var rate float64
+	if tr.QuoteID != "" {
+		quote, err := GetRateQuote(ctx, dbSvc, tr.QuoteID)
+		if err != nil {
+			return errorResponse("quote_not_found", "Rate quote not found.", err)
+		}
+		if err := quote.check(tr, time.Now()); err != nil {
+			return errorResponse("quote_invalid", "Rate quote cannot be used for this transfer.", err)
+		}
+		rate = quote.Rate
+	} else {
+		if rates == nil {
+			return errorResponse("rate_unavailable", "No exchange rate source.", ErrRateNotFound)
+		}
+		rate, err = rates.Rate(ctx, tr.FromCurrency, tr.ToCurrency)
+		if err != nil {
+			return errorResponse("rate_unavailable", fmt.Sprintf("No exchange rate for %s to %s.", tr.FromCurrency, tr.ToCurrency), err)
+		}
+	}
+	converted := convertAmount(tr.Amount, rate, tr.ToCurrency)
+	if converted <= 0 {
+		return errorResponse("invalid_amount", "Converted amount is too small.", fmt.Errorf("%.2f %s converts to %.2f %s", tr.Amount, tr.FromCurrency, converted, tr.ToCurrency))
+	}
+
+	uid := ksuid.New().String()
+	timestamp := getCurrentTimestamp()
+	items, err := conversionItems(tr, uid, timestamp, sender.Version, converted)
+	if err != nil {
+		return NilResponse{}, err
+	}
+	if tr.QuoteID != "" {
+		items = append(items, types.TransactWriteItem{Update: useQuoteUpdate(tr.QuoteID, uid, time.Now())})
+	}
+
+	transactionStatus := 0
+	transaction := TransactionEntry{
+		TenantID:            tr.TenantID,
+		AccountID:           fromAccountID,
+		SystemTransactionID: uid,
+		FromAccount:         fromAccountID,
+		ToAccount:           toAccountID,
+		Amount:              tr.Amount,
+		Comment:             fmt.Sprintf("Convert %s to %s at %s", tr.FromCurrency, tr.ToCurrency, strconv.FormatFloat(rate, 'f', -1, 64)),
+		TransactionDate:     timestamp,
+		Status:              &transactionStatus,
+		InitiatorUUID:       tr.InitiatorUUID,
+		Currency:            tr.FromCurrency,
+	}
+
+	_, err = dbSvc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		transactionStatus = 1
+		if saveErr := SaveToTransactionTable(dbSvc, tr.TenantID, transaction, transactionStatus); saveErr != nil {
+			log.Printf("failed to record failed conversion %s: %v", uid, saveErr)
+		}
+		return errorResponse("debit_failed", fmt.Sprintf("Failed to debit from balance for user %s", fromAccountID), err)
+	}
+
+	if err := SaveToTransactionTable(dbSvc, tr.TenantID, transaction, transactionStatus); err != nil {
+		log.Printf("conversion %s posted but its transaction record failed: %v", uid, err)
+	}
+
+	return NilResponse{
+		Status:    "success",
+		Code:      "successful_transaction",
+		Message:   "Transaction initiated successfully.",
+		Timestamp: tr.Timestamp,
+		Data: data{
+			FromAccount:     fromAccountID,
+			TransactionID:   uid,
+			Amount:          tr.Amount,
+			Currency:        tr.FromCurrency,
+			ToCurrency:      tr.ToCurrency,
+			ConvertedAmount: converted,
+			Rate:            rate,
+			UUID:            tr.InitiatorUUID,
+			SignedUUID:      tr.SignedUUID,
+		},
+	}, nil
+}
+
+// conversionItems are the balance updates and ledger entries of a conversion.
+// Ledger entries are keyed by TenantID and TransactionID and all legs share the
+// tenant, so every leg after the sender debit gets a "-<leg>" suffix.
+func conversionItems(tr ConversionTransfer, uid string, timestamp, senderVersion int64, converted float64) ([]types.TransactWriteItem, error) {
+	fromAccountID := CurrencyAccountID(tr.FromAccount, tr.FromCurrency)
+	toAccountID := CurrencyAccountID(tr.ToAccount, tr.ToCurrency)
+	newVersion := &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)}
+
+	legs := []struct {
+		accountID string
+		currency  string
+		amount    float64
+		kind      string
+	}{
+		{fromAccountID, tr.FromCurrency, tr.Amount, "debit"},
+		{fxPositionAccountID(tr.FromCurrency), tr.FromCurrency, tr.Amount, "credit"},
+		{fxPositionAccountID(tr.ToCurrency), tr.ToCurrency, converted, "debit"},
+		{toAccountID, tr.ToCurrency, converted, "credit"},
+	}
+
+	var items []types.TransactWriteItem
+	for i, leg := range legs {
+		transactionID := uid
+		if i > 0 {
+			transactionID = uid + "-" + strconv.Itoa(i)
+		}
+		entry, err := attributevalue.MarshalMap(LedgerEntry{
+			TenantID:            tr.TenantID,
+			AccountID:           leg.accountID,
+			Amount:              leg.amount,
+			SystemTransactionID: transactionID,
+			Type:                leg.kind,
+			Time:                timestamp,
+			InitiatorUUID:       tr.InitiatorUUID,
+			Currency:            leg.currency,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal ledger entry: %v", err)
+		}
+
+		key := map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tr.TenantID},
+			"AccountID": &types.AttributeValueMemberS{Value: leg.accountID},
+		}
+		delta := leg.amount
+		if leg.kind == "debit" {
+			delta = -delta
+		}
+		var update *types.Update
+		switch i {
+		case 0:
+			update = &types.Update{
+				TableName:           aws.String(NilUsers),
+				Key:                 key,
+				UpdateExpression:    aws.String("SET amount = amount - :amount, Version = :newVersion"),
+				ConditionExpression: aws.String("attribute_not_exists(Version) OR Version = :oldVersion"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":amount":     amountNumber(leg.currency, leg.amount),
+					":oldVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(senderVersion, 10)},
+					":newVersion": newVersion,
+				},
+			}
+		case len(legs) - 1:
+			update = &types.Update{
+				TableName:           aws.String(NilUsers),
+				Key:                 key,
+				UpdateExpression:    aws.String("SET amount = amount + :amount, Version = :newVersion"),
+				ConditionExpression: aws.String("attribute_exists(AccountID)"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":amount":     amountNumber(leg.currency, leg.amount),
+					":newVersion": newVersion,
+				},
+			}
+		default:
+			// FX positions may go negative and are created on first use
+			update = &types.Update{
+				TableName:        aws.String(NilUsers),
+				Key:              key,
+				UpdateExpression: aws.String("SET Version = :newVersion, currency = :currency ADD amount :delta"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":delta":      amountNumber(leg.currency, delta),
+					":currency":   &types.AttributeValueMemberS{Value: leg.currency},
+					":newVersion": newVersion,
+				},
+			}
+		}
+
+		items = append(items,
+			types.TransactWriteItem{Update: shardBalanceUpdate(update, tr.TenantID, leg.accountID, leg.currency, delta)},
+			types.TransactWriteItem{Put: &types.Put{TableName: aws.String(LedgerTable), Item: entry}},
+		)
+	}
+	return items, nil
+}
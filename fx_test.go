@@ -0,0 +1,88 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticRates(t *testing.T) {
+	rates := StaticRates{"USD/SDG": 600}
+	tests := []struct {
+		name     string
+		from, to string
+		want     float64
+		wantErr  bool
+	}{
+		{"listed pair", "USD", "SDG", 600, false},
+		{"inverse pair", "SDG", "USD", 1.0 / 600, false},
+		{"same currency", "EUR", "EUR", 1, false},
+		{"unknown pair", "USD", "EUR", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rates.Rate(context.TODO(), tt.from, tt.to)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrRateNotFound)
+				return
+			}
+			assert.NoError(t, err)
+			assert.InDelta(t, tt.want, got, 1e-12)
+		})
+	}
+}
+
+func TestCurrencyAccountID(t *testing.T) {
+	assert.Equal(t, "0111493885", CurrencyAccountID("0111493885", ""))
+	assert.Equal(t, "0111493885", CurrencyAccountID("0111493885", DefaultCurrency))
+	assert.Equal(t, "0111493885:USD", CurrencyAccountID("0111493885", "USD"))
+	assert.Equal(t, DefaultCurrency, User{}.AccountCurrency())
+	assert.Equal(t, "USD", User{Currency: "USD"}.AccountCurrency())
+}
+
+func TestConversionItems(t *testing.T) {
+	tr := ConversionTransfer{
+		TenantID:     "nil",
+		FromAccount:  "0111493885",
+		ToAccount:    "0965256869",
+		FromCurrency: "USD",
+		ToCurrency:   "SDG",
+		Amount:       10,
+	}
+	converted := convertAmount(tr.Amount, 600.125, tr.ToCurrency)
+	assert.Equal(t, 6001.25, converted)
+
+	items, err := conversionItems(tr, "tx-1", 1, 7, converted)
+	assert.NoError(t, err)
+	assert.Len(t, items, 8)
+
+	wantAccounts := []string{"0111493885:USD", "NIL_FX_POSITION:USD", "NIL_FX_POSITION:SDG", "0965256869"}
+	wantLedgerIDs := []string{"tx-1", "tx-1-1", "tx-1-2", "tx-1-3"}
+	for i := range wantAccounts {
+		update := items[2*i].Update
+		assert.NotNil(t, update)
+		assert.Equal(t, &types.AttributeValueMemberS{Value: wantAccounts[i]}, update.Key["AccountID"])
+
+		ledger := items[2*i+1].Put
+		assert.NotNil(t, ledger)
+		assert.Equal(t, &types.AttributeValueMemberS{Value: wantLedgerIDs[i]}, ledger.Item["TransactionID"])
+	}
+
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "7"}, items[0].Update.ExpressionAttributeValues[":oldVersion"])
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "10.00"}, items[2].Update.ExpressionAttributeValues[":delta"])
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "-6001.25"}, items[4].Update.ExpressionAttributeValues[":delta"])
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "6001.25"}, items[6].Update.ExpressionAttributeValues[":amount"])
+}
+
+func TestTransferWithConversionSameCurrency(t *testing.T) {
+	response, err := TransferWithConversion(context.TODO(), nil, StaticRates{}, ConversionTransfer{
+		FromAccount: "0111493885",
+		ToAccount:   "0965256869",
+		ToCurrency:  DefaultCurrency,
+		Amount:      10,
+	})
+	assert.Error(t, err)
+	assert.Equal(t, "invalid_currency", response.Code)
+}
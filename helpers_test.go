@@ -0,0 +1,31 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	key := map[string]types.AttributeValue{
+		"TenantID":         &types.AttributeValueMemberS{Value: "nil"},
+		"PaymentID":        &types.AttributeValueMemberS{Value: "2hdIAOLMzFJIElMoPZ3R9DGR3DQ"},
+		"CreatorAccountID": &types.AttributeValueMemberS{Value: "0111493885"},
+	}
+
+	cursor, err := encodeCursor(key)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, cursor)
+
+	got, err := decodeCursor(cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, key, got)
+
+	empty, err := encodeCursor(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, empty)
+
+	_, err = decodeCursor("not a cursor!")
+	assert.Error(t, err)
+}
@@ -62,6 +62,7 @@ type LedgerEntry struct {
 	Time                int64   `dynamodbav:"Time" json:"time,omitempty"`
 	TenantID            string  `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
 	InitiatorUUID       string  `dynamodbav:"UUID" json:"uuid,omitempty"`
+	Currency            string  `dynamodbav:"Currency,omitempty" json:"currency,omitempty"`
 }
 
 // DeleteAccount by its tenantID and accountID
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -36,6 +37,13 @@ func HandleDynamoDBStream(ctx context.Context, event events.DynamoDBEvent) error
 		// Extract the necessary data from the new image
 		accountID := newImage["AccountID"].String()
 		amount := newImage["Amount"].Number()
+		currency := DefaultCurrency
+		if av, ok := newImage["Currency"]; ok && av.DataType() == events.DataTypeString {
+			currency = av.String()
+		}
+		if value, err := strconv.ParseFloat(amount, 64); err == nil {
+			amount = FormatAmount(currency, value)
+		}
 		opType := newImage["Type"].String()
 		tranID := newImage["TransactionID"]
 
@@ -2,8 +2,14 @@ package ledger
 
 import (
 	"context"
+	"crypto"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -13,6 +19,42 @@ import (
 	"github.com/segmentio/ksuid"
 )
 
+const QRPaymentsTable = "QRPaymentsTable"
+
+// QR payment statuses. Single-use codes move PENDING -> PROCESSING ->
+// COMPLETED/FAILED, or PENDING -> CANCELLED; static codes stay ACTIVE until
+// cancelled. EXPIRED is reported for PENDING codes past their ExpiresAt. A
+// payment the payer can retry, such as one short of balance, moves the code
+// from PROCESSING back to PENDING.
+const (
+	QRStatusPending    = "PENDING"
+	QRStatusProcessing = "PROCESSING"
+	QRStatusCompleted  = "COMPLETED"
+	QRStatusFailed     = "FAILED"
+	QRStatusCancelled  = "CANCELLED"
+	QRStatusExpired    = "EXPIRED"
+	QRStatusActive     = "ACTIVE"
+)
+
+// DefaultQRPaymentTTL is how long a code created by GenerateQRPayment stays payable.
+var DefaultQRPaymentTTL = 15 * time.Minute
+
+// QRProcessingTimeout is how long a code may stay PROCESSING before
+// RecoverQRPayment settles it from the transfer it finds, if any.
+var QRProcessingTimeout = 5 * time.Minute
+
+// qrRetryableTransferCodes are the TransferCredits failures the payer can fix,
+// by topping up or paying from another account, so the code stays payable.
+var qrRetryableTransferCodes = map[string]bool{
+	"insufficient_balance": true,
+	"currency_mismatch":    true,
+	"debit_failed":         true,
+}
+
+// ErrQRPaymentNotPayable is returned when a QR payment cannot be claimed
+// because it was already paid, cancelled, expired or is being paid concurrently.
+var ErrQRPaymentNotPayable = errors.New("QR payment is not payable")
+
 type QRPaymentRequest struct {
 	TenantID     string  `json:"TenantID"`
 	PaymentID    string  `json:"PaymentID"`
@@ -23,27 +65,134 @@ type QRPaymentRequest struct {
 	CreationDate int64   `json:"CreationDate"`
 	FromAccount  string  `json:"from_account"`
 	ToAccount    string  `json:"to_account"`
+	Currency     string  `json:"Currency,omitempty"`
+	Payload      string  `json:"Payload,omitempty"`
+
+	// Static codes are reusable: the payer enters the amount (bounded by
+	// MinAmount/MaxAmount when set) and every payment is stored as a child
+	// row pointing back to the static code via ParentPaymentID.
+	Static          bool    `json:"Static,omitempty"`
+	MinAmount       float64 `json:"MinAmount,omitempty"`
+	MaxAmount       float64 `json:"MaxAmount,omitempty"`
+	ParentPaymentID string  `dynamodbav:"ParentPaymentID,omitempty" json:"ParentPaymentID,omitempty"`
+	TransactionID   string  `json:"TransactionID,omitempty"`
+
+	// ExpiresAt is the unix time after which a PENDING code can no longer be paid.
+	// Zero means the code never expires.
+	ExpiresAt int64 `json:"ExpiresAt,omitempty"`
+
+	// ClaimedAt is the unix time the code last moved to PROCESSING.
+	ClaimedAt int64 `json:"ClaimedAt,omitempty"`
+
+	// CreatorAccountID is the account that generated the code (or, for child
+	// payments of a static code, the merchant that collected them).
+	CreatorAccountID string `dynamodbav:"CreatorAccountID,omitempty" json:"CreatorAccountID,omitempty"`
+
+	// SignatureAlgorithm is set when Payload is signed with the tenant key
+	// registered through RegisterTenantKey.
+	SignatureAlgorithm string `json:"SignatureAlgorithm,omitempty"`
+}
+
+// QRPaymentFilter narrows ListQRPayments results. Zero values disable a filter.
+type QRPaymentFilter struct {
+	Statuses  []string
+	StartTime int64
+	EndTime   int64
+	Limit     int32
+	Cursor    string
+	// Totals asks for the totals of the whole listing with its first page,
+	// which reads every matching payment once more.
+	Totals bool
+}
+
+// QRPaymentPage is a page of QR payments with an opaque cursor for the next
+// page. Totals, set on the first page when the filter asks for it, covers the
+// COMPLETED payments of the whole listing, by currency.
+type QRPaymentPage struct {
+	Payments   []QRPaymentRequest  `json:"payments"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+	Totals     map[string]QRTotals `json:"totals,omitempty"`
+}
+
+// QRTotals adds up the COMPLETED payments of a listing in one currency.
+type QRTotals struct {
+	Completed int     `json:"completed"`
+	Amount    float64 `json:"amount"`
 }
 
 func (qr *QRPaymentRequest) IsPaid() bool {
-	return qr.Status == "COMPLETED"
+	return qr.Status == QRStatusCompleted
 }
 
+// IsExpired reports whether the code is past its expiry at the given time.
+func (qr *QRPaymentRequest) IsExpired(now time.Time) bool {
+	return qr.ExpiresAt > 0 && now.Unix() >= qr.ExpiresAt
+}
+
+// GenerateQRPayment creates a single-use QR code that expires after DefaultQRPaymentTTL.
 func GenerateQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string, amount float64) (*QRPaymentRequest, error) {
+	return GenerateQRPaymentWithTTL(ctx, dbSvc, tenantID, accountID, amount, DefaultQRPaymentTTL)
+}
 
+// GenerateQRPaymentWithTTL creates a single-use QR code payable for ttl. A zero
+// ttl creates a code that never expires.
+func GenerateQRPaymentWithTTL(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string, amount float64, ttl time.Duration) (*QRPaymentRequest, error) {
+	return generateQRPayment(ctx, dbSvc, tenantID, accountID, amount, ttl, nil)
+}
+
+// GenerateSignedQRPayment creates a single-use QR code whose payload is signed
+// with the tenant's private key, so payer apps can verify the merchant and the
+// amount offline with VerifyQRPayload.
+func GenerateSignedQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string, amount float64, ttl time.Duration, key crypto.Signer) (*QRPaymentRequest, error) {
+	if key == nil {
+		return nil, fmt.Errorf("a signing key is required")
+	}
+	return generateQRPayment(ctx, dbSvc, tenantID, accountID, amount, ttl, key)
+}
+
+func generateQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string, amount float64, ttl time.Duration, key crypto.Signer) (*QRPaymentRequest, error) {
+	if err := ValidateCurrencyAmount(DefaultCurrency, amount); err != nil {
+		return nil, fmt.Errorf("invalid QR payment amount: %w", err)
+	}
 	uuid := ksuid.New().String()
-	timestamp := time.Now().UTC().Unix()
+	now := time.Now().UTC()
+	timestamp := now.Unix()
+
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = now.Add(ttl).Unix()
+	}
 
 	qrPayment := QRPaymentRequest{
 		TenantID:     tenantID,
 		PaymentID:    uuid,
 		AccountID:    accountID,
 		Amount:       amount,
-		Status:       "PENDING",
+		Status:       QRStatusPending,
 		UUID:         uuid,
 		CreationDate: timestamp,
 		ToAccount:    accountID,
+		Currency:     DefaultCurrency,
+		ExpiresAt:    expiresAt,
+
+		CreatorAccountID: accountID,
+	}
+
+	payload, err := EncodeEMVQR(qrPayment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR payment request: %v", err)
 	}
+	if key != nil {
+		payload, err = SignQRPayload(payload, key)
+		if err != nil {
+			return nil, err
+		}
+		qrPayment.SignatureAlgorithm = QRSignatureRSA
+		if _, ok := key.(ed25519.PrivateKey); ok {
+			qrPayment.SignatureAlgorithm = QRSignatureEd25519
+		}
+	}
+	qrPayment.Payload = payload
 
 	av, err := attributevalue.MarshalMap(qrPayment)
 	if err != nil {
@@ -51,7 +200,7 @@ func GenerateQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, ac
 	}
 
 	input := &dynamodb.PutItemInput{
-		TableName: aws.String("QRPaymentsTable"),
+		TableName: aws.String(QRPaymentsTable),
 		Item:      av,
 	}
 
@@ -70,7 +219,7 @@ func InquireQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, pay
 	}
 
 	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String("QRPaymentsTable"),
+		TableName: aws.String(QRPaymentsTable),
 		Key:       key,
 	})
 	if err != nil {
@@ -87,63 +236,278 @@ func InquireQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, pay
 		return nil, fmt.Errorf("failed to unmarshal QR payment: %v", err)
 	}
 
+	if qrPayment.Status == QRStatusPending && qrPayment.IsExpired(time.Now()) {
+		qrPayment.Status = QRStatusExpired
+	}
+
 	return &qrPayment, nil
 }
 
+// PerformQRPayment pays a single-use QR code from personPayingAccount. The code
+// is claimed with a conditional PENDING -> PROCESSING update before any money
+// moves, so concurrent payers cannot both succeed; the claim then settles to
+// COMPLETED or FAILED depending on the transfer, or goes back to PENDING when
+// the payer can fix the failure. A claim left behind by a crash is settled by
+// RecoverQRPayment.
 func PerformQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, paymentID, personPayingAccount string) error {
 	qrPayment, err := InquireQRPayment(ctx, dbSvc, tenantID, paymentID)
 	if err != nil {
 		return err
 	}
 
-	if qrPayment.Status != "PENDING" {
-		return fmt.Errorf("QR payment %s is not in PENDING status", paymentID)
+	if qrPayment.Static {
+		return fmt.Errorf("QR payment %s is a static code, use PerformStaticQRPayment", paymentID)
+	}
+
+	if qrPayment.Status != QRStatusPending {
+		return fmt.Errorf("%w: QR payment %s is %s", ErrQRPaymentNotPayable, paymentID, qrPayment.Status)
+	}
+
+	if qrPayment.SignatureAlgorithm != "" {
+		if err := verifyQRPaymentSignature(ctx, dbSvc, qrPayment, qrPayment.Payload); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC().Unix()
+	err = transitionQRPayment(ctx, dbSvc, tenantID, paymentID, QRStatusPending, QRStatusProcessing,
+		"(attribute_not_exists(ExpiresAt) OR ExpiresAt = :zero OR ExpiresAt > :now)", "FromAccount = :fromAccount, ClaimedAt = :now",
+		map[string]types.AttributeValue{
+			":zero":        &types.AttributeValueMemberN{Value: "0"},
+			":now":         &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+			":fromAccount": &types.AttributeValueMemberS{Value: personPayingAccount},
+		})
+	if err != nil {
+		return err
 	}
 
 	trEntry := TransactionEntry{
 		TenantID:      tenantID,
 		FromAccount:   personPayingAccount,
-		AccountID:     qrPayment.ToAccount,
+		AccountID:     personPayingAccount,
 		ToAccount:     qrPayment.AccountID,
 		Amount:        qrPayment.Amount,
-		InitiatorUUID: ksuid.New().String(),
+		InitiatorUUID: qrPayment.UUID,
 	}
 
-	response, err := TransferCredits(ctx, dbSvc, trEntry)
+	response, transferErr := TransferCredits(ctx, dbSvc, trEntry)
+	log.Printf("the result of transfer is: %+v", response)
+
+	err = transitionQRPayment(ctx, dbSvc, tenantID, paymentID, QRStatusProcessing, qrStatusAfterTransfer(response, transferErr), "", "TransactionID = :transactionID",
+		map[string]types.AttributeValue{
+			":transactionID": &types.AttributeValueMemberS{Value: response.Data.TransactionID},
+		})
+	if transferErr != nil && err != nil {
+		// the code may still be PROCESSING; the sweeper's recovery releases it
+		return fmt.Errorf("failed to perform QR payment: %w; failed to update QR payment status: %w", transferErr, err)
+	}
+	if transferErr != nil {
+		return fmt.Errorf("failed to perform QR payment: %w", transferErr)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to perform QR payment: %v", err)
+		return fmt.Errorf("failed to update QR payment status: %w", err)
 	}
 
-	log.Printf("the result of transfer is: %+v", response)
+	return nil
+}
 
-	updateExpression := "SET #st = :status"
-	expressionAttributeNames := map[string]string{
-		"#st": "Status",
+// qrStatusAfterTransfer is the status a claimed code moves to once the
+// transfer paying it returned response and err.
+func qrStatusAfterTransfer(response NilResponse, err error) string {
+	switch {
+	case err == nil:
+		return QRStatusCompleted
+	case qrRetryableTransferCodes[response.Code]:
+		return QRStatusPending
 	}
+	return QRStatusFailed
+}
+
+// StuckQRPayments returns the single-use codes that have been PROCESSING for
+// longer than QRProcessingTimeout at now.
+func StuckQRPayments(ctx context.Context, dbSvc *dynamodb.Client, now time.Time) ([]QRPaymentRequest, error) {
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(QRPaymentsTable),
+		FilterExpression:         aws.String("#st = :processing AND (attribute_not_exists(ClaimedAt) OR ClaimedAt <= :claimedBefore)"),
+		ExpressionAttributeNames: map[string]string{"#st": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":processing":    &types.AttributeValueMemberS{Value: QRStatusProcessing},
+			":claimedBefore": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(-QRProcessingTimeout).Unix(), 10)},
+		},
+	}
+
+	var stuck []QRPaymentRequest
+	for {
+		result, err := dbSvc.Scan(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan QR payments: %v", err)
+		}
+		var page []QRPaymentRequest
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal QR payments: %v", err)
+		}
+		stuck = append(stuck, page...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	return stuck, nil
+}
+
+// RecoverQRPayment settles a code PerformQRPayment left PROCESSING, e.g.
+// because it crashed mid-payment. If a successful transfer for the code was
+// recorded the code is COMPLETED with it; otherwise no money moved and the code
+// goes back to PENDING, where it can be paid again or is reported EXPIRED once
+// past its expiry. The returned status is the one stored.
+func RecoverQRPayment(ctx context.Context, dbSvc *dynamodb.Client, qrPayment QRPaymentRequest) (string, error) {
+	result, err := dbSvc.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(TransactionsTable),
+		IndexName:              aws.String("UserUUIDIndex"),
+		KeyConditionExpression: aws.String("TenantID = :tenantID AND #uuid = :uuid"),
+		FilterExpression:       aws.String("TransactionStatus = :success AND ToAccount = :toAccount"),
+		ExpressionAttributeNames: map[string]string{
+			"#uuid": "UUID",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantID":  &types.AttributeValueMemberS{Value: qrPayment.TenantID},
+			":uuid":      &types.AttributeValueMemberS{Value: qrPayment.UUID},
+			":success":   &types.AttributeValueMemberN{Value: "0"},
+			":toAccount": &types.AttributeValueMemberS{Value: qrPayment.AccountID},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to query transactions of QR payment %s: %v", qrPayment.PaymentID, err)
+	}
+
+	claimed := map[string]types.AttributeValue{
+		":claimedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(qrPayment.ClaimedAt, 10)},
+	}
+	// a claim made after qrPayment was read is left to its own payer
+	condition := "(attribute_not_exists(ClaimedAt) OR ClaimedAt = :claimedAt)"
+	if len(result.Items) == 0 {
+		return QRStatusPending, transitionQRPayment(ctx, dbSvc, qrPayment.TenantID, qrPayment.PaymentID,
+			QRStatusProcessing, QRStatusPending, condition, "", claimed)
+	}
+
+	var transfer TransactionEntry
+	if err := attributevalue.UnmarshalMap(result.Items[0], &transfer); err != nil {
+		return "", fmt.Errorf("failed to unmarshal transaction: %v", err)
+	}
+	claimed[":transactionID"] = &types.AttributeValueMemberS{Value: transfer.SystemTransactionID}
+	return QRStatusCompleted, transitionQRPayment(ctx, dbSvc, qrPayment.TenantID, qrPayment.PaymentID,
+		QRStatusProcessing, QRStatusCompleted, condition, "TransactionID = :transactionID", claimed)
+}
+
+// PerformQRPaymentFromPayload pays the code a payer scanned. The payload must
+// match the stored code exactly and, for signed codes, carry a valid tenant
+// signature; tampered payloads are rejected before any money moves.
+func PerformQRPaymentFromPayload(ctx context.Context, dbSvc *dynamodb.Client, payload, personPayingAccount string) error {
+	scanned, err := ParseEMVQR(payload)
+	if err != nil {
+		return err
+	}
+
+	qrPayment, err := InquireQRPayment(ctx, dbSvc, scanned.TenantID, scanned.PaymentID)
+	if err != nil {
+		return err
+	}
+
+	if qrPayment.SignatureAlgorithm != "" {
+		if err := verifyQRPaymentSignature(ctx, dbSvc, qrPayment, payload); err != nil {
+			return err
+		}
+	}
+	if payload != qrPayment.Payload {
+		return fmt.Errorf("%w: payload does not match QR payment %s", ErrInvalidQRSignature, qrPayment.PaymentID)
+	}
+
+	return PerformQRPayment(ctx, dbSvc, qrPayment.TenantID, qrPayment.PaymentID, personPayingAccount)
+}
+
+// verifyQRPaymentSignature checks payload against the tenant key and makes sure
+// the signed content describes the stored QR payment.
+func verifyQRPaymentSignature(ctx context.Context, dbSvc *dynamodb.Client, qrPayment *QRPaymentRequest, payload string) error {
+	tenantKey, err := GetTenantKey(ctx, dbSvc, qrPayment.TenantID)
+	if err != nil {
+		return err
+	}
+
+	signed, err := VerifyQRPayload(payload, tenantKey.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	if signed.TenantID != qrPayment.TenantID || signed.PaymentID != qrPayment.PaymentID ||
+		signed.AccountID != qrPayment.AccountID || signed.Amount != qrPayment.Amount {
+		return fmt.Errorf("%w: signed content does not match QR payment %s", ErrInvalidQRSignature, qrPayment.PaymentID)
+	}
+	return nil
+}
+
+// CancelQRPayment cancels a pending single-use code or an active static code.
+// Codes that are already being paid or settled cannot be cancelled.
+func CancelQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, paymentID string) error {
+	qrPayment, err := InquireQRPayment(ctx, dbSvc, tenantID, paymentID)
+	if err != nil {
+		return err
+	}
+
+	from := QRStatusPending
+	if qrPayment.Static {
+		from = QRStatusActive
+	}
+	return transitionQRPayment(ctx, dbSvc, tenantID, paymentID, from, QRStatusCancelled, "", "", nil)
+}
+
+// transitionQRPayment moves a QR payment from one status to another, failing
+// with ErrQRPaymentNotPayable if the stored status is not `from`. condition and
+// set are optional extra clauses appended to the condition and update expressions.
+func transitionQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, paymentID, from, to, condition, set string, values map[string]types.AttributeValue) error {
 	expressionAttributeValues := map[string]types.AttributeValue{
-		":status": &types.AttributeValueMemberS{Value: "COMPLETED"},
+		":from": &types.AttributeValueMemberS{Value: from},
+		":to":   &types.AttributeValueMemberS{Value: to},
+	}
+	for k, v := range values {
+		expressionAttributeValues[k] = v
+	}
+
+	conditionExpression := "#st = :from"
+	if condition != "" {
+		conditionExpression += " AND " + condition
+	}
+	updateExpression := "SET #st = :to"
+	if set != "" {
+		updateExpression += ", " + set
 	}
 
-	_, err = dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
-		TableName: aws.String("QRPaymentsTable"),
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(QRPaymentsTable),
 		Key: map[string]types.AttributeValue{
 			"TenantID":  &types.AttributeValueMemberS{Value: tenantID},
 			"PaymentID": &types.AttributeValueMemberS{Value: paymentID},
 		},
-		UpdateExpression:          aws.String(updateExpression),
-		ExpressionAttributeNames:  expressionAttributeNames,
+		UpdateExpression:    aws.String(updateExpression),
+		ConditionExpression: aws.String(conditionExpression),
+		ExpressionAttributeNames: map[string]string{
+			"#st": "Status",
+		},
 		ExpressionAttributeValues: expressionAttributeValues,
 	})
 	if err != nil {
+		var conditionalCheckFailedErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionalCheckFailedErr) {
+			return fmt.Errorf("%w: QR payment %s is no longer %s", ErrQRPaymentNotPayable, paymentID, from)
+		}
 		return fmt.Errorf("failed to update QR payment status: %v", err)
 	}
-
 	return nil
 }
 
 func GetAllQRPaymentsForUser(ctx context.Context, dbSvc *dynamodb.Client, tenantID, creatorAccountID string) ([]QRPaymentRequest, error) {
 	input := &dynamodb.QueryInput{
-		TableName:              aws.String("QRPaymentsTable"),
+		TableName:              aws.String(QRPaymentsTable),
 		IndexName:              aws.String("CreatorAccountIDIndex"),
 		KeyConditionExpression: aws.String("TenantID = :tenantID AND CreatorAccountID = :creatorAccountID"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
@@ -165,3 +529,315 @@ func GetAllQRPaymentsForUser(ctx context.Context, dbSvc *dynamodb.Client, tenant
 
 	return qrPayments, nil
 }
+
+// ListQRPayments lists the QR payments created by creatorAccountID, optionally
+// filtered by status and by a CreationDate range. PENDING codes past their
+// expiry are reported, and filtered, as EXPIRED, as InquireQRPayment does.
+func ListQRPayments(ctx context.Context, dbSvc *dynamodb.Client, tenantID, creatorAccountID string, filter QRPaymentFilter) (*QRPaymentPage, error) {
+	if filter.Limit == 0 {
+		filter.Limit = 25
+	}
+
+	expressionAttributeNames := map[string]string{}
+	expressionAttributeValues := map[string]types.AttributeValue{
+		":tenantID":         &types.AttributeValueMemberS{Value: tenantID},
+		":creatorAccountID": &types.AttributeValueMemberS{Value: creatorAccountID},
+	}
+	filterExpressions := []string{}
+
+	if len(filter.Statuses) > 0 {
+		// expired codes are stored as PENDING
+		statuses := slices.Clone(filter.Statuses)
+		if slices.Contains(statuses, QRStatusExpired) && !slices.Contains(statuses, QRStatusPending) {
+			statuses = append(statuses, QRStatusPending)
+		}
+		placeholders := make([]string, len(statuses))
+		for i, status := range statuses {
+			placeholders[i] = fmt.Sprintf(":status%d", i)
+			expressionAttributeValues[placeholders[i]] = &types.AttributeValueMemberS{Value: status}
+		}
+		expressionAttributeNames["#st"] = "Status"
+		filterExpressions = append(filterExpressions, "#st IN ("+strings.Join(placeholders, ", ")+")")
+	}
+
+	if filter.StartTime != 0 {
+		filterExpressions = append(filterExpressions, "CreationDate >= :startTime")
+		expressionAttributeValues[":startTime"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(filter.StartTime, 10)}
+	}
+	if filter.EndTime != 0 {
+		filterExpressions = append(filterExpressions, "CreationDate <= :endTime")
+		expressionAttributeValues[":endTime"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(filter.EndTime, 10)}
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(QRPaymentsTable),
+		IndexName:                 aws.String("CreatorAccountIDIndex"),
+		KeyConditionExpression:    aws.String("TenantID = :tenantID AND CreatorAccountID = :creatorAccountID"),
+		ExpressionAttributeValues: expressionAttributeValues,
+		Limit:                     aws.Int32(filter.Limit),
+	}
+	if len(expressionAttributeNames) > 0 {
+		input.ExpressionAttributeNames = expressionAttributeNames
+	}
+	if len(filterExpressions) > 0 {
+		input.FilterExpression = aws.String(strings.Join(filterExpressions, " AND "))
+	}
+
+	startKey, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	input.ExclusiveStartKey = startKey
+
+	result, err := dbSvc.Query(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query QR payments: %v", err)
+	}
+
+	var payments []QRPaymentRequest
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &payments); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal QR payments: %v", err)
+	}
+
+	page := &QRPaymentPage{Payments: reportExpiredQRPayments(payments, filter.Statuses, time.Now())}
+	if filter.Totals && filter.Cursor == "" {
+		if page.Totals, err = qrListTotals(ctx, dbSvc, *input); err != nil {
+			return nil, err
+		}
+	}
+
+	page.NextCursor, err = encodeCursor(result.LastEvaluatedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// qrListTotals adds up the COMPLETED payments of the listing queried by input,
+// by currency.
+func qrListTotals(ctx context.Context, dbSvc *dynamodb.Client, input dynamodb.QueryInput) (map[string]QRTotals, error) {
+	names := map[string]string{"#st": "Status", "#amount": "Amount", "#currency": "Currency"}
+	for k, v := range input.ExpressionAttributeNames {
+		names[k] = v
+	}
+	input.ExpressionAttributeNames = names
+	input.ProjectionExpression = aws.String("#st, #amount, #currency")
+	input.Limit = nil
+	input.ExclusiveStartKey = nil
+
+	totals := map[string]QRTotals{}
+	for {
+		result, err := dbSvc.Query(ctx, &input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query QR payments: %v", err)
+		}
+		var payments []QRPaymentRequest
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &payments); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal QR payments: %v", err)
+		}
+		addQRTotals(totals, payments)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	for code, t := range totals {
+		if c, err := GetCurrency(code); err == nil {
+			t.Amount = c.Round(t.Amount)
+			totals[code] = t
+		}
+	}
+	return totals, nil
+}
+
+// addQRTotals adds the COMPLETED payments to the totals of their currencies.
+func addQRTotals(totals map[string]QRTotals, payments []QRPaymentRequest) {
+	for _, qrPayment := range payments {
+		if qrPayment.Status != QRStatusCompleted {
+			continue
+		}
+		code := qrPayment.Currency
+		if code == "" {
+			code = DefaultCurrency
+		}
+		t := totals[code]
+		t.Completed++
+		t.Amount += qrPayment.Amount
+		totals[code] = t
+	}
+}
+
+// reportExpiredQRPayments reports the PENDING payments past their expiry at now
+// as EXPIRED and keeps those whose status is in statuses, or all when empty.
+func reportExpiredQRPayments(payments []QRPaymentRequest, statuses []string, now time.Time) []QRPaymentRequest {
+	reported := make([]QRPaymentRequest, 0, len(payments))
+	for _, qrPayment := range payments {
+		if qrPayment.Status == QRStatusPending && qrPayment.IsExpired(now) {
+			qrPayment.Status = QRStatusExpired
+		}
+		if len(statuses) == 0 || slices.Contains(statuses, qrPayment.Status) {
+			reported = append(reported, qrPayment)
+		}
+	}
+	return reported
+}
+
+// GenerateStaticQRPayment creates a reusable merchant QR code. The payer enters
+// the amount at payment time; minAmount and maxAmount bound it when non-zero.
+func GenerateStaticQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string, minAmount, maxAmount float64) (*QRPaymentRequest, error) {
+	if minAmount < 0 || maxAmount < 0 {
+		return nil, fmt.Errorf("amount limits must not be negative")
+	}
+	if maxAmount > 0 && minAmount > maxAmount {
+		return nil, fmt.Errorf("minimum amount %.2f is greater than maximum amount %.2f", minAmount, maxAmount)
+	}
+
+	uuid := ksuid.New().String()
+	qrPayment := QRPaymentRequest{
+		TenantID:     tenantID,
+		PaymentID:    uuid,
+		AccountID:    accountID,
+		Status:       QRStatusActive,
+		UUID:         uuid,
+		CreationDate: time.Now().UTC().Unix(),
+		ToAccount:    accountID,
+		Currency:     DefaultCurrency,
+		Static:       true,
+		MinAmount:    minAmount,
+		MaxAmount:    maxAmount,
+
+		CreatorAccountID: accountID,
+	}
+
+	payload, err := EncodeEMVQR(qrPayment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR payment request: %v", err)
+	}
+	qrPayment.Payload = payload
+
+	av, err := attributevalue.MarshalMap(qrPayment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal QR payment request: %v", err)
+	}
+
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(QRPaymentsTable),
+		Item:      av,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create QR payment request: %v", err)
+	}
+
+	return &qrPayment, nil
+}
+
+// PerformStaticQRPayment pays amount from personPayingAccount to the owner of a
+// static QR code. Each payment, successful or not, is recorded as its own child
+// row and returned to the caller.
+func PerformStaticQRPayment(ctx context.Context, dbSvc *dynamodb.Client, tenantID, paymentID, personPayingAccount string, amount float64) (*QRPaymentRequest, error) {
+	staticQR, err := InquireQRPayment(ctx, dbSvc, tenantID, paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !staticQR.Static {
+		return nil, fmt.Errorf("QR payment %s is not a static code", paymentID)
+	}
+	if staticQR.Status != QRStatusActive {
+		return nil, fmt.Errorf("static QR payment %s is not active", paymentID)
+	}
+	if err := ValidateCurrencyAmount(staticQR.Currency, amount); err != nil {
+		return nil, fmt.Errorf("invalid QR payment amount: %w", err)
+	}
+	if staticQR.MinAmount > 0 && amount < staticQR.MinAmount {
+		return nil, fmt.Errorf("amount %.2f is below the minimum of %.2f", amount, staticQR.MinAmount)
+	}
+	if staticQR.MaxAmount > 0 && amount > staticQR.MaxAmount {
+		return nil, fmt.Errorf("amount %.2f is above the maximum of %.2f", amount, staticQR.MaxAmount)
+	}
+
+	uuid := ksuid.New().String()
+	child := QRPaymentRequest{
+		TenantID:        tenantID,
+		PaymentID:       uuid,
+		AccountID:       staticQR.AccountID,
+		Amount:          amount,
+		Status:          QRStatusCompleted,
+		UUID:            uuid,
+		CreationDate:    time.Now().UTC().Unix(),
+		FromAccount:     personPayingAccount,
+		ToAccount:       staticQR.AccountID,
+		Currency:        staticQR.Currency,
+		ParentPaymentID: staticQR.PaymentID,
+
+		CreatorAccountID: staticQR.AccountID,
+	}
+
+	trEntry := TransactionEntry{
+		TenantID:      tenantID,
+		AccountID:     personPayingAccount,
+		FromAccount:   personPayingAccount,
+		ToAccount:     staticQR.AccountID,
+		Amount:        amount,
+		InitiatorUUID: uuid,
+	}
+
+	response, transferErr := TransferCredits(ctx, dbSvc, trEntry)
+	if transferErr != nil {
+		child.Status = QRStatusFailed
+	}
+	child.TransactionID = response.Data.TransactionID
+
+	av, err := attributevalue.MarshalMap(child)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal QR payment: %v", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(QRPaymentsTable),
+		Item:      av,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record QR payment: %v", err)
+	}
+
+	if transferErr != nil {
+		return &child, fmt.Errorf("failed to perform QR payment: %v", transferErr)
+	}
+	return &child, nil
+}
+
+// ListStaticQRPayments returns every payment made against a static QR code.
+func ListStaticQRPayments(ctx context.Context, dbSvc *dynamodb.Client, tenantID, paymentID string) ([]QRPaymentRequest, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(QRPaymentsTable),
+		IndexName:              aws.String("ParentPaymentIDIndex"),
+		KeyConditionExpression: aws.String("TenantID = :tenantID AND ParentPaymentID = :parentPaymentID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantID":        &types.AttributeValueMemberS{Value: tenantID},
+			":parentPaymentID": &types.AttributeValueMemberS{Value: paymentID},
+		},
+	}
+
+	var qrPayments []QRPaymentRequest
+	for {
+		result, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query QR payments: %v", err)
+		}
+
+		var page []QRPaymentRequest
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal QR payments: %v", err)
+		}
+		qrPayments = append(qrPayments, page...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+
+	return qrPayments, nil
+}
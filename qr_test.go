@@ -2,8 +2,10 @@ package ledger
 
 import (
 	"context"
+	"errors"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/stretchr/testify/assert"
@@ -72,3 +74,207 @@ func TestInquireQRPayment(t *testing.T) {
 		})
 	}
 }
+
+func TestStaticQRPaymentFunctionalIntegration(t *testing.T) {
+	tenantID := "nil"
+	merchantAccountID := "0111493885"
+	payerAccountID := "0111493888"
+
+	ctx := context.Background()
+
+	staticQR, err := GenerateStaticQRPayment(ctx, _dbSvc, tenantID, merchantAccountID, 5, 500)
+	assert.NoError(t, err)
+	assert.True(t, staticQR.Static)
+	assert.Equal(t, "ACTIVE", staticQR.Status)
+
+	// amounts outside the limits are rejected before any money moves
+	_, err = PerformStaticQRPayment(ctx, _dbSvc, tenantID, staticQR.PaymentID, payerAccountID, 1)
+	assert.Error(t, err)
+
+	first, err := PerformStaticQRPayment(ctx, _dbSvc, tenantID, staticQR.PaymentID, payerAccountID, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, staticQR.PaymentID, first.ParentPaymentID)
+
+	second, err := PerformStaticQRPayment(ctx, _dbSvc, tenantID, staticQR.PaymentID, payerAccountID, 20)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.PaymentID, second.PaymentID)
+
+	// the static code stays usable after being paid
+	inquired, err := InquireQRPayment(ctx, _dbSvc, tenantID, staticQR.PaymentID)
+	assert.NoError(t, err)
+	assert.Equal(t, "ACTIVE", inquired.Status)
+
+	children, err := ListStaticQRPayments(ctx, _dbSvc, tenantID, staticQR.PaymentID)
+	assert.NoError(t, err)
+	assert.Len(t, children, 2)
+}
+
+func TestGenerateStaticQRPaymentLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		minAmount float64
+		maxAmount float64
+	}{
+		{"negative minimum", -1, 0},
+		{"minimum above maximum", 100, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := GenerateStaticQRPayment(context.Background(), nil, "nil", "0111493885", tt.minAmount, tt.maxAmount); err == nil {
+				t.Errorf("GenerateStaticQRPayment() expected an error for min %v max %v", tt.minAmount, tt.maxAmount)
+			}
+		})
+	}
+}
+
+func TestQRPaymentIsExpired(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		qr   QRPaymentRequest
+		want bool
+	}{
+		{"no expiry", QRPaymentRequest{}, false},
+		{"not yet expired", QRPaymentRequest{ExpiresAt: now.Add(time.Minute).Unix()}, false},
+		{"expired", QRPaymentRequest{ExpiresAt: now.Add(-time.Minute).Unix()}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.qr.IsExpired(now); got != tt.want {
+				t.Errorf("IsExpired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReportExpiredQRPayments(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	payments := []QRPaymentRequest{
+		{PaymentID: "live", Status: QRStatusPending, ExpiresAt: now.Unix() + 60},
+		{PaymentID: "expired", Status: QRStatusPending, ExpiresAt: now.Unix() - 60},
+		{PaymentID: "forever", Status: QRStatusPending},
+		{PaymentID: "paid", Status: QRStatusCompleted, ExpiresAt: now.Unix() - 60},
+	}
+	ids := func(payments []QRPaymentRequest) []string {
+		var ids []string
+		for _, p := range payments {
+			ids = append(ids, p.PaymentID+"="+p.Status)
+		}
+		return ids
+	}
+
+	assert.Equal(t, []string{"live=PENDING", "expired=EXPIRED", "forever=PENDING", "paid=COMPLETED"},
+		ids(reportExpiredQRPayments(payments, nil, now)))
+	assert.Equal(t, []string{"live=PENDING", "forever=PENDING"},
+		ids(reportExpiredQRPayments(payments, []string{QRStatusPending}, now)))
+	assert.Equal(t, []string{"expired=EXPIRED"},
+		ids(reportExpiredQRPayments(payments, []string{QRStatusExpired}, now)))
+	assert.Equal(t, QRStatusPending, payments[1].Status, "the input is not modified")
+}
+
+func TestAddQRTotals(t *testing.T) {
+	totals := map[string]QRTotals{}
+	addQRTotals(totals, []QRPaymentRequest{
+		{Status: QRStatusCompleted, Amount: 10, Currency: "SDG"},
+		{Status: QRStatusCompleted, Amount: 5},
+		{Status: QRStatusCompleted, Amount: 2.5, Currency: "USD"},
+		{Status: QRStatusPending, Amount: 100, Currency: "SDG"},
+	})
+	addQRTotals(totals, []QRPaymentRequest{{Status: QRStatusCompleted, Amount: 1, Currency: "USD"}})
+
+	assert.Equal(t, map[string]QRTotals{
+		DefaultCurrency: {Completed: 2, Amount: 15},
+		"USD":           {Completed: 2, Amount: 3.5},
+	}, totals)
+}
+
+func TestQRStatusAfterTransfer(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		err      error
+		expected string
+	}{
+		{"paid", "successful_transaction", nil, QRStatusCompleted},
+		{"payer short of balance", "insufficient_balance", errors.New("insufficient balance"), QRStatusPending},
+		{"payer account in another currency", "currency_mismatch", errors.New("currency mismatch"), QRStatusPending},
+		{"concurrent debit", "debit_failed", errors.New("conflict"), QRStatusPending},
+		{"merchant account missing", "user_not_found", errors.New("not found"), QRStatusFailed},
+		{"credit failed", "credit_failed", errors.New("credit failed"), QRStatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, qrStatusAfterTransfer(NilResponse{Code: tt.code}, tt.err))
+		})
+	}
+}
+
+func TestQRPaymentCancelAndDoublePayIntegration(t *testing.T) {
+	tenantID := "nil"
+	accountID := "0111493885"
+	fromAccountID := "0111493888"
+
+	ctx := context.Background()
+
+	// a cancelled code can no longer be paid
+	cancelled, err := GenerateQRPayment(ctx, _dbSvc, tenantID, accountID, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, CancelQRPayment(ctx, _dbSvc, tenantID, cancelled.PaymentID))
+	err = PerformQRPayment(ctx, _dbSvc, tenantID, cancelled.PaymentID, fromAccountID)
+	assert.ErrorIs(t, err, ErrQRPaymentNotPayable)
+
+	// an expired code reports EXPIRED and rejects payment
+	expired, err := GenerateQRPaymentWithTTL(ctx, _dbSvc, tenantID, accountID, 1, time.Second)
+	assert.NoError(t, err)
+	time.Sleep(2 * time.Second)
+	inquired, err := InquireQRPayment(ctx, _dbSvc, tenantID, expired.PaymentID)
+	assert.NoError(t, err)
+	assert.Equal(t, QRStatusExpired, inquired.Status)
+	assert.Error(t, PerformQRPayment(ctx, _dbSvc, tenantID, expired.PaymentID, fromAccountID))
+
+	// concurrent payers: at most one succeeds
+	qrPayment, err := GenerateQRPayment(ctx, _dbSvc, tenantID, accountID, 1)
+	assert.NoError(t, err)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- PerformQRPayment(ctx, _dbSvc, tenantID, qrPayment.PaymentID, fromAccountID) }()
+	}
+	var succeeded int
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == nil {
+			succeeded++
+		}
+	}
+	assert.LessOrEqual(t, succeeded, 1)
+}
+
+func TestListQRPayments(t *testing.T) {
+	tenantID := "nil"
+	accountID := "0111493885"
+	ctx := context.Background()
+
+	qrPayment, err := GenerateQRPayment(ctx, _dbSvc, tenantID, accountID, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, accountID, qrPayment.CreatorAccountID)
+
+	var seen []QRPaymentRequest
+	filter := QRPaymentFilter{Statuses: []string{QRStatusPending}, Limit: 10}
+	for {
+		page, err := ListQRPayments(ctx, _dbSvc, tenantID, accountID, filter)
+		assert.NoError(t, err)
+		seen = append(seen, page.Payments...)
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+
+	var found bool
+	for _, p := range seen {
+		assert.Equal(t, QRStatusPending, p.Status)
+		if p.PaymentID == qrPayment.PaymentID {
+			found = true
+		}
+	}
+	assert.True(t, found)
+}
@@ -0,0 +1,262 @@
+package ledger
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const TenantKeysTable = "TenantKeys"
+
+// Signature algorithms supported for QR payloads. RS256 matches the
+// PKCS#1 v1.5 / SHA-256 scheme used by VerifySignature.
+const (
+	QRSignatureRSA     = "RS256"
+	QRSignatureEd25519 = "ED25519"
+)
+
+// Signed payloads carry the algorithm in tag 80 and the base64 signature split
+// across tags 81 onwards, since a single EMV field holds at most 99 characters.
+// The signature covers every field up to and including tag 80.
+const (
+	emvSignatureAlgorithm = "80"
+	emvSignatureFirst     = 81
+	emvSignatureChunk     = 99
+)
+
+// ErrInvalidQRSignature is returned when a QR payload's signature does not
+// verify against the tenant's public key.
+var ErrInvalidQRSignature = errors.New("invalid QR payload signature")
+
+// TenantKey is the public key a tenant signs its QR payloads with. PublicKey is
+// a base64 PKIX key, the same encoding VerifySignature expects.
+type TenantKey struct {
+	TenantID  string `dynamodbav:"TenantID" json:"tenant_id"`
+	PublicKey string `dynamodbav:"PublicKey" json:"public_key"`
+	Algorithm string `dynamodbav:"Algorithm" json:"algorithm"`
+	CreatedAt string `dynamodbav:"CreatedAt" json:"created_at"`
+}
+
+// SignQRPayload signs an EMV payload produced by EncodeEMVQR with an RSA or
+// Ed25519 private key and returns the signed payload with a fresh CRC.
+func SignQRPayload(payload string, key crypto.Signer) (string, error) {
+	body, err := stripEMVCRC(payload)
+	if err != nil {
+		return "", err
+	}
+
+	var algorithm string
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		algorithm = QRSignatureRSA
+	case ed25519.PrivateKey:
+		algorithm = QRSignatureEd25519
+	default:
+		return "", fmt.Errorf("unsupported QR signing key type %T", key)
+	}
+
+	algorithmField, err := emvTLV(emvField{emvSignatureAlgorithm, algorithm})
+	if err != nil {
+		return "", err
+	}
+	signed := body + algorithmField
+
+	var signature []byte
+	if algorithm == QRSignatureRSA {
+		hashed := sha256.Sum256([]byte(signed))
+		signature, err = key.Sign(rand.Reader, hashed[:], crypto.SHA256)
+	} else {
+		signature, err = key.Sign(rand.Reader, []byte(signed), crypto.Hash(0))
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to sign QR payload: %v", err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(signature)
+	for i, tag := 0, emvSignatureFirst; i < len(encoded); i, tag = i+emvSignatureChunk, tag+1 {
+		if tag > 99 {
+			return "", errors.New("QR signature is too long")
+		}
+		end := min(i+emvSignatureChunk, len(encoded))
+		chunk, err := emvTLV(emvField{strconv.Itoa(tag), encoded[i:end]})
+		if err != nil {
+			return "", err
+		}
+		signed += chunk
+	}
+
+	return appendEMVCRC(signed), nil
+}
+
+// VerifyQRPayload checks the CRC and signature of a signed payload against a
+// base64 PKIX public key and returns the decoded payment. It needs no network
+// access, so payer apps can run it offline with a cached tenant key.
+func VerifyQRPayload(payload, publicKey string) (*QRPaymentRequest, error) {
+	body, err := stripEMVCRC(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	signedEnd, err := emvFieldOffset(body, strconv.Itoa(emvSignatureFirst))
+	if err != nil {
+		return nil, err
+	}
+	if signedEnd < 0 {
+		return nil, fmt.Errorf("%w: payload has no signature", ErrInvalidQRSignature)
+	}
+	// only the signed part is parsed, so nothing appended after the
+	// signature can change the payment
+	fields, err := parseEMVTLV(body[:signedEnd])
+	if err != nil {
+		return nil, err
+	}
+	algorithm := fields[emvSignatureAlgorithm]
+	if algorithm == "" {
+		return nil, fmt.Errorf("%w: payload is not signed", ErrInvalidQRSignature)
+	}
+	encoded, err := emvSignatureChunks(body[signedEnd:])
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQRSignature, err)
+	}
+
+	pub, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := []byte(body[:signedEnd])
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if algorithm != QRSignatureRSA {
+			return nil, fmt.Errorf("%w: algorithm %s does not match RSA key", ErrInvalidQRSignature, algorithm)
+		}
+		hashed := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidQRSignature, err)
+		}
+	case ed25519.PublicKey:
+		if algorithm != QRSignatureEd25519 {
+			return nil, fmt.Errorf("%w: algorithm %s does not match Ed25519 key", ErrInvalidQRSignature, algorithm)
+		}
+		if !ed25519.Verify(key, signed, signature) {
+			return nil, ErrInvalidQRSignature
+		}
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	return parseEMVBody(body[:signedEnd])
+}
+
+// emvSignatureChunks joins the signature fields that close a signed body. They
+// must be tags 81, 82, ... in order with nothing else after them; the CRC has
+// already been stripped.
+func emvSignatureChunks(tail string) (string, error) {
+	var encoded string
+	for i, tag := 0, emvSignatureFirst; i < len(tail); tag++ {
+		if i+4 > len(tail) {
+			return "", fmt.Errorf("%w: truncated signature field", ErrInvalidQRSignature)
+		}
+		if tag > 99 || tail[i:i+2] != strconv.Itoa(tag) {
+			return "", fmt.Errorf("%w: unexpected field %s after the signature", ErrInvalidQRSignature, tail[i:i+2])
+		}
+		length, err := strconv.Atoi(tail[i+2 : i+4])
+		if err != nil || i+4+length > len(tail) {
+			return "", fmt.Errorf("%w: invalid signature field %s", ErrInvalidQRSignature, tail[i:i+2])
+		}
+		encoded += tail[i+4 : i+4+length]
+		i += 4 + length
+	}
+	return encoded, nil
+}
+
+// RegisterTenantKey stores the public key used to verify a tenant's QR payloads.
+func RegisterTenantKey(ctx context.Context, dbSvc *dynamodb.Client, tenantID, publicKey string) error {
+	if tenantID == "" {
+		return fmt.Errorf("tenantID is required")
+	}
+	pub, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	tenantKey := TenantKey{
+		TenantID:  tenantID,
+		PublicKey: publicKey,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		tenantKey.Algorithm = QRSignatureRSA
+	case ed25519.PublicKey:
+		tenantKey.Algorithm = QRSignatureEd25519
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	item, err := attributevalue.MarshalMap(tenantKey)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tenant key: %w", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(TenantKeysTable),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store tenant key: %w", err)
+	}
+	return nil
+}
+
+// GetTenantKey returns the public key registered for tenantID.
+func GetTenantKey(ctx context.Context, dbSvc *dynamodb.Client, tenantID string) (*TenantKey, error) {
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TenantKeysTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: tenantID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tenant key: %w", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("tenant %s has no registered key", tenantID)
+	}
+
+	var tenantKey TenantKey
+	if err := attributevalue.UnmarshalMap(result.Item, &tenantKey); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tenant key: %w", err)
+	}
+	return &tenantKey, nil
+}
+
+// parsePublicKey decodes a base64 PKIX public key.
+func parsePublicKey(publicKey string) (crypto.PublicKey, error) {
+	der, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %v", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %v", err)
+	}
+	return pub, nil
+}
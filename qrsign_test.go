@@ -0,0 +1,115 @@
+package ledger
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPublicKey(t *testing.T, key crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func TestSignVerifyQRPayload(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		key       crypto.Signer
+		publicKey string
+	}{
+		{"rsa", rsaKey, testPublicKey(t, &rsaKey.PublicKey)},
+		{"ed25519", edKey, testPublicKey(t, edPub)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qr := QRPaymentRequest{TenantID: "nil", PaymentID: "2hdIAOLMzFJIElMoPZ3R9DGR3DQ", AccountID: "0111493885", Amount: 100}
+			payload, err := EncodeEMVQR(qr)
+			assert.NoError(t, err)
+
+			signed, err := SignQRPayload(payload, tt.key)
+			assert.NoError(t, err)
+
+			got, err := VerifyQRPayload(signed, tt.publicKey)
+			assert.NoError(t, err)
+			assert.Equal(t, qr.PaymentID, got.PaymentID)
+			assert.Equal(t, qr.Amount, got.Amount)
+
+			// changing the amount and fixing up the CRC must still fail verification
+			body, err := stripEMVCRC(signed)
+			assert.NoError(t, err)
+			tampered := appendEMVCRC(strings.Replace(body, "5406100.00", "5406900.00", 1))
+			assert.NotEqual(t, signed, tampered)
+			_, err = VerifyQRPayload(tampered, tt.publicKey)
+			assert.ErrorIs(t, err, ErrInvalidQRSignature)
+
+			// unsigned payloads are rejected
+			_, err = VerifyQRPayload(payload, tt.publicKey)
+			assert.ErrorIs(t, err, ErrInvalidQRSignature)
+		})
+	}
+}
+
+func TestVerifyQRPayloadWrongKey(t *testing.T) {
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	_, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	payload, err := EncodeEMVQR(QRPaymentRequest{TenantID: "nil", PaymentID: "abc", AccountID: "0111493885", Amount: 1})
+	assert.NoError(t, err)
+	signed, err := SignQRPayload(payload, signingKey)
+	assert.NoError(t, err)
+
+	_, err = VerifyQRPayload(signed, testPublicKey(t, otherPub))
+	assert.ErrorIs(t, err, ErrInvalidQRSignature)
+}
+
+func TestVerifyQRPayloadRejectsAppendedFields(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	publicKey := testPublicKey(t, key.Public())
+
+	payload, err := EncodeEMVQR(QRPaymentRequest{TenantID: "nil", PaymentID: "abc", AccountID: "0111493885", Amount: 10})
+	assert.NoError(t, err)
+	signed, err := SignQRPayload(payload, key)
+	assert.NoError(t, err)
+	body, err := stripEMVCRC(signed)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		appended string
+	}{
+		{"amount", "5406999.00"},
+		{"account", "26200010012345678901"},
+		{"unknown tag", "990101"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tampered := appendEMVCRC(body + tt.appended)
+			got, err := VerifyQRPayload(tampered, publicKey)
+			assert.ErrorIs(t, err, ErrInvalidQRSignature)
+			assert.Nil(t, got)
+		})
+	}
+}
+
+func TestParseEMVTLVRejectsDuplicates(t *testing.T) {
+	_, err := parseEMVTLV("540510.00540599.00")
+	assert.Error(t, err)
+}
@@ -0,0 +1,292 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	ExchangeRatesTable = "ExchangeRates"
+	RateQuotesTable    = "RateQuotes"
+)
+
+// DefaultQuoteTTL is how long a quote locks its rate when no TTL is given.
+const DefaultQuoteTTL = time.Minute
+
+var (
+	ErrRateNotFound = errors.New("exchange rate not found")
+	ErrRateStale    = errors.New("exchange rate is stale")
+	ErrQuoteExpired = errors.New("rate quote expired")
+	ErrQuoteUsed    = errors.New("rate quote already used")
+	ErrQuoteInvalid = errors.New("rate quote does not match the transfer")
+)
+
+// RateProvider returns the rate that converts one unit of from into to.
+type RateProvider interface {
+	Rate(ctx context.Context, from, to string) (float64, error)
+}
+
+// StaticRates is a RateProvider backed by a fixed table keyed by "FROM/TO",
+// e.g. "USD/SDG". The inverse of a listed pair is derived from it.
+type StaticRates map[string]float64
+
+func (r StaticRates) Rate(ctx context.Context, from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	if rate, ok := r[ratePair(from, to)]; ok && rate > 0 {
+		return rate, nil
+	}
+	if rate, ok := r[ratePair(to, from)]; ok && rate > 0 {
+		return 1 / rate, nil
+	}
+	return 0, fmt.Errorf("%w: %s", ErrRateNotFound, ratePair(from, to))
+}
+
+// LoadRatesFile reads StaticRates from a JSON object such as {"USD/SDG": 600}.
+func LoadRatesFile(path string) (StaticRates, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rates file: %w", err)
+	}
+	var rates StaticRates
+	if err := json.Unmarshal(b, &rates); err != nil {
+		return nil, fmt.Errorf("failed to parse rates file: %w", err)
+	}
+	for pair, rate := range rates {
+		from, to, ok := strings.Cut(pair, "/")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid currency pair %q", pair)
+		}
+		if rate <= 0 {
+			return nil, fmt.Errorf("rate of %s must be positive", pair)
+		}
+	}
+	return rates, nil
+}
+
+func ratePair(from, to string) string {
+	return from + "/" + to
+}
+
+// ExchangeRate is an item of ExchangeRatesTable.
+type ExchangeRate struct {
+	Pair      string  `dynamodbav:"Pair" json:"pair"`
+	Rate      float64 `dynamodbav:"Rate" json:"rate"`
+	UpdatedAt int64   `dynamodbav:"UpdatedAt" json:"updated_at"`
+}
+
+// TableRateProvider reads rates from ExchangeRatesTable. Rates older than
+// MaxAge are refused with ErrRateStale; a zero MaxAge accepts any age.
+type TableRateProvider struct {
+	DB     *dynamodb.Client
+	MaxAge time.Duration
+}
+
+func (p TableRateProvider) Rate(ctx context.Context, from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	rate, err := p.storedRate(ctx, ratePair(from, to))
+	if err != nil {
+		return 0, err
+	}
+	if rate != nil {
+		return rate.Rate, p.checkAge(rate)
+	}
+	inverse, err := p.storedRate(ctx, ratePair(to, from))
+	if err != nil {
+		return 0, err
+	}
+	if inverse != nil {
+		return 1 / inverse.Rate, p.checkAge(inverse)
+	}
+	return 0, fmt.Errorf("%w: %s", ErrRateNotFound, ratePair(from, to))
+}
+
+func (p TableRateProvider) checkAge(rate *ExchangeRate) error {
+	if p.MaxAge > 0 && time.Since(time.Unix(rate.UpdatedAt, 0)) > p.MaxAge {
+		return fmt.Errorf("%w: %s was updated at %s", ErrRateStale, rate.Pair, time.Unix(rate.UpdatedAt, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (p TableRateProvider) storedRate(ctx context.Context, pair string) (*ExchangeRate, error) {
+	result, err := p.DB.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ExchangeRatesTable),
+		Key: map[string]types.AttributeValue{
+			"Pair": &types.AttributeValueMemberS{Value: pair},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rate %s: %w", pair, err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+	var rate ExchangeRate
+	if err := attributevalue.UnmarshalMap(result.Item, &rate); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rate %s: %w", pair, err)
+	}
+	if rate.Rate <= 0 {
+		return nil, fmt.Errorf("rate of %s must be positive", pair)
+	}
+	return &rate, nil
+}
+
+// PutExchangeRate stores the rate of from/to for TableRateProvider.
+func PutExchangeRate(ctx context.Context, dbSvc *dynamodb.Client, from, to string, rate float64) error {
+	if from == "" || to == "" || from == to {
+		return fmt.Errorf("invalid currency pair %s", ratePair(from, to))
+	}
+	if rate <= 0 {
+		return fmt.Errorf("rate of %s must be positive", ratePair(from, to))
+	}
+	item, err := attributevalue.MarshalMap(ExchangeRate{
+		Pair:      ratePair(from, to),
+		Rate:      rate,
+		UpdatedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal rate: %w", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(ExchangeRatesTable),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store rate %s: %w", ratePair(from, to), err)
+	}
+	return nil
+}
+
+// RateQuote locks a rate for Amount of FromCurrency until ExpiresAt, so the
+// user can see ConvertedAmount and then execute at exactly that rate by passing
+// QuoteID to TransferWithConversion. A quote can be used once.
+type RateQuote struct {
+	QuoteID         string  `dynamodbav:"QuoteID" json:"quote_id"`
+	TenantID        string  `dynamodbav:"TenantID" json:"tenant_id"`
+	FromCurrency    string  `dynamodbav:"FromCurrency" json:"from_currency"`
+	ToCurrency      string  `dynamodbav:"ToCurrency" json:"to_currency"`
+	Amount          float64 `dynamodbav:"Amount" json:"amount"`
+	Rate            float64 `dynamodbav:"Rate" json:"rate"`
+	ConvertedAmount float64 `dynamodbav:"ConvertedAmount" json:"converted_amount"`
+	CreatedAt       string  `dynamodbav:"CreatedAt" json:"created_at"`
+	// ExpiresAt is in unix seconds and doubles as the table's TTL attribute.
+	ExpiresAt     int64  `dynamodbav:"ExpiresAt" json:"expires_at"`
+	TransactionID string `dynamodbav:"TransactionID,omitempty" json:"transaction_id,omitempty"`
+}
+
+// IsExpired reports whether the quote is past its expiry at the given time.
+func (q RateQuote) IsExpired(now time.Time) bool {
+	return now.Unix() >= q.ExpiresAt
+}
+
+// check validates that q can pay for tr at now.
+func (q RateQuote) check(tr ConversionTransfer, now time.Time) error {
+	if q.TransactionID != "" {
+		return fmt.Errorf("%w: quote %s paid for %s", ErrQuoteUsed, q.QuoteID, q.TransactionID)
+	}
+	if q.IsExpired(now) {
+		return fmt.Errorf("%w: quote %s", ErrQuoteExpired, q.QuoteID)
+	}
+	if q.TenantID != tr.TenantID || q.FromCurrency != tr.FromCurrency || q.ToCurrency != tr.ToCurrency ||
+		math.Abs(q.Amount-tr.Amount) > amountEpsilon {
+		return fmt.Errorf("%w: quote %s is for %.2f %s to %s in %s", ErrQuoteInvalid, q.QuoteID, q.Amount, q.FromCurrency, q.ToCurrency, q.TenantID)
+	}
+	return nil
+}
+
+// CreateRateQuote locks the current rate of rates for converting amount from
+// one currency to another for ttl, DefaultQuoteTTL when zero.
+func CreateRateQuote(ctx context.Context, dbSvc *dynamodb.Client, rates RateProvider, tenantID, from, to string, amount float64, ttl time.Duration) (*RateQuote, error) {
+	if tenantID == "" {
+		tenantID = "nil"
+	}
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be greater than zero")
+	}
+	if ttl <= 0 {
+		ttl = DefaultQuoteTTL
+	}
+	rate, err := rates.Rate(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	quote := RateQuote{
+		QuoteID:         ksuid.New().String(),
+		TenantID:        tenantID,
+		FromCurrency:    from,
+		ToCurrency:      to,
+		Amount:          amount,
+		Rate:            rate,
+		ConvertedAmount: convertAmount(amount, rate, to),
+		CreatedAt:       getCurrentTimeZone(),
+		ExpiresAt:       now.Add(ttl).Unix(),
+	}
+	item, err := attributevalue.MarshalMap(quote)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal rate quote: %w", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(RateQuotesTable),
+		Item:      item,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store rate quote: %w", err)
+	}
+	return &quote, nil
+}
+
+// GetRateQuote returns a quote by its ID.
+func GetRateQuote(ctx context.Context, dbSvc *dynamodb.Client, quoteID string) (*RateQuote, error) {
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(RateQuotesTable),
+		Key:            map[string]types.AttributeValue{"QuoteID": &types.AttributeValueMemberS{Value: quoteID}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rate quote: %w", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("rate quote %s does not exist", quoteID)
+	}
+	var quote RateQuote
+	if err := attributevalue.UnmarshalMap(result.Item, &quote); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rate quote: %w", err)
+	}
+	return &quote, nil
+}
+
+// useQuoteUpdate marks a quote as paying for transactionID, in the same
+// transaction as the conversion legs. The condition repeats the checks of
+// RateQuote.check so a quote cannot be used twice or after it expired.
+func useQuoteUpdate(quoteID, transactionID string, now time.Time) *types.Update {
+	return &types.Update{
+		TableName: aws.String(RateQuotesTable),
+		Key: map[string]types.AttributeValue{
+			"QuoteID": &types.AttributeValueMemberS{Value: quoteID},
+		},
+		UpdateExpression:    aws.String("SET TransactionID = :transactionID"),
+		ConditionExpression: aws.String("attribute_exists(QuoteID) AND attribute_not_exists(TransactionID) AND ExpiresAt > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":transactionID": &types.AttributeValueMemberS{Value: transactionID},
+			":now":           &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	}
+}
@@ -0,0 +1,89 @@
+package ledger
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadRatesFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    StaticRates
+		wantErr bool
+	}{
+		{"valid", `{"USD/SDG": 600, "EUR/SDG": 650.5}`, StaticRates{"USD/SDG": 600, "EUR/SDG": 650.5}, false},
+		{"malformed json", `{"USD/SDG": }`, nil, true},
+		{"malformed pair", `{"USDSDG": 600}`, nil, true},
+		{"non positive rate", `{"USD/SDG": 0}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rates.json")
+			assert.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+			got, err := LoadRatesFile(path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := LoadRatesFile(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestRateQuoteCheck(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	quote := RateQuote{
+		QuoteID:      "q-1",
+		TenantID:     "nil",
+		FromCurrency: "USD",
+		ToCurrency:   "SDG",
+		Amount:       10,
+		Rate:         600,
+		ExpiresAt:    now.Add(time.Minute).Unix(),
+	}
+	tr := ConversionTransfer{TenantID: "nil", FromCurrency: "USD", ToCurrency: "SDG", Amount: 10, QuoteID: "q-1"}
+
+	tests := []struct {
+		name    string
+		modify  func(q *RateQuote, tr *ConversionTransfer)
+		at      time.Time
+		wantErr error
+	}{
+		{"valid", func(q *RateQuote, tr *ConversionTransfer) {}, now, nil},
+		{"expired", func(q *RateQuote, tr *ConversionTransfer) {}, now.Add(time.Minute), ErrQuoteExpired},
+		{"used", func(q *RateQuote, tr *ConversionTransfer) { q.TransactionID = "tx-1" }, now, ErrQuoteUsed},
+		{"other amount", func(q *RateQuote, tr *ConversionTransfer) { tr.Amount = 11 }, now, ErrQuoteInvalid},
+		{"other currency", func(q *RateQuote, tr *ConversionTransfer) { tr.ToCurrency = "EUR" }, now, ErrQuoteInvalid},
+		{"other tenant", func(q *RateQuote, tr *ConversionTransfer) { tr.TenantID = "nonil" }, now, ErrQuoteInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, r := quote, tr
+			tt.modify(&q, &r)
+			err := q.check(r, tt.at)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUseQuoteUpdate(t *testing.T) {
+	update := useQuoteUpdate("q-1", "tx-1", time.Unix(100, 0))
+	assert.Equal(t, RateQuotesTable, *update.TableName)
+	assert.Equal(t, "attribute_exists(QuoteID) AND attribute_not_exists(TransactionID) AND ExpiresAt > :now", *update.ConditionExpression)
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "100"}, update.ExpressionAttributeValues[":now"])
+	assert.Equal(t, &types.AttributeValueMemberS{Value: "tx-1"}, update.ExpressionAttributeValues[":transactionID"])
+}
@@ -0,0 +1,199 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// PLATFORM_TENANT holds the platform's part of collected fees in its
+// FEE_ACCOUNT.
+const PLATFORM_TENANT = "PLATFORM_TENANT"
+
+// RevenueShare splits the fee of a corridor between the sending tenant, the
+// receiving tenant and the platform. The shares are fractions summing to 1; a
+// corridor without a RevenueShare leaves the whole fee to the platform.
+type RevenueShare struct {
+	FromShare     float64 `dynamodbav:"FromShare" json:"from_share"`
+	ToShare       float64 `dynamodbav:"ToShare" json:"to_share"`
+	PlatformShare float64 `dynamodbav:"PlatformShare" json:"platform_share"`
+}
+
+// FeeSplit is a fee divided according to a RevenueShare.
+type FeeSplit struct {
+	From     float64 `dynamodbav:"From" json:"from"`
+	To       float64 `dynamodbav:"To" json:"to"`
+	Platform float64 `dynamodbav:"Platform" json:"platform"`
+}
+
+// Validate checks that the shares are non-negative and add up to 1.
+func (r RevenueShare) Validate() error {
+	if r.FromShare < 0 || r.ToShare < 0 || r.PlatformShare < 0 {
+		return fmt.Errorf("revenue shares must not be negative")
+	}
+	if math.Abs(r.FromShare+r.ToShare+r.PlatformShare-1) > amountEpsilon {
+		return fmt.Errorf("revenue shares add up to %v instead of 1", r.FromShare+r.ToShare+r.PlatformShare)
+	}
+	return nil
+}
+
+// Split divides fee by the shares, rounding the tenants' parts as currency
+// does. The rounding remainder goes to the platform so the parts always add up
+// to fee.
+func (r RevenueShare) Split(fee float64, currency Currency) FeeSplit {
+	split := FeeSplit{
+		From: currency.Round(fee * r.FromShare),
+		To:   currency.Round(fee * r.ToShare),
+	}
+	split.Platform = currency.Round(fee - split.From - split.To)
+	return split
+}
+
+// EscrowFee is the fee charged on top of amount for an escrow in the corridor,
+// rounded as currency does.
+func (c EscrowCorridor) EscrowFee(amount float64, currency Currency) float64 {
+	return currency.Round(c.Fee + amount*c.FeeRate)
+}
+
+// FeeSplit returns the fee for amount in currency and how it is shared.
+func (c EscrowCorridor) FeeSplit(amount float64, currency Currency) (float64, FeeSplit) {
+	fee := c.EscrowFee(amount, currency)
+	if fee <= 0 {
+		return 0, FeeSplit{}
+	}
+	if c.RevenueShare == nil {
+		return fee, FeeSplit{Platform: fee}
+	}
+	return fee, c.RevenueShare.Split(fee, currency)
+}
+
+// escrowFeeSplit looks up the fee of an escrow of amount in currencyCode from
+// fromTenantID's corridor to toTenantID. Tenants without EscrowMeta or a
+// corridor charge no fee.
+func escrowFeeSplit(ctx context.Context, dbSvc *dynamodb.Client, fromTenantID, toTenantID string, amount float64, currencyCode string) (float64, FeeSplit, error) {
+	currency, err := GetCurrency(currencyCode)
+	if err != nil {
+		return 0, FeeSplit{}, err
+	}
+	meta, err := GetEscrowMeta(ctx, dbSvc, fromTenantID)
+	if err != nil {
+		return 0, FeeSplit{}, err
+	}
+	if meta == nil {
+		return 0, FeeSplit{}, nil
+	}
+	corridor, ok := meta.Corridor(toTenantID)
+	if !ok {
+		return 0, FeeSplit{}, nil
+	}
+	fee, split := corridor.FeeSplit(amount, currency)
+	return fee, split, nil
+}
+
+// feeShare is one tenant's part of a collected fee.
+type feeShare struct {
+	tenantID string
+	amount   float64
+}
+
+// shares lists the non-zero parts of the split per receiving tenant. When the
+// escrow stays within one tenant its From and To parts are paid together and
+// rounded as currency does.
+func (s FeeSplit) shares(fromTenantID, toTenantID string, currency Currency) []feeShare {
+	var shares []feeShare
+	add := func(tenantID string, amount float64) {
+		if amount <= 0 {
+			return
+		}
+		for i := range shares {
+			if shares[i].tenantID == tenantID {
+				shares[i].amount = currency.Round(shares[i].amount + amount)
+				return
+			}
+		}
+		shares = append(shares, feeShare{tenantID, amount})
+	}
+	add(fromTenantID, s.From)
+	add(toTenantID, s.To)
+	add(PLATFORM_TENANT, s.Platform)
+	return shares
+}
+
+// feeShareItems credits each share of es.FeeSplit to the FEE_ACCOUNT of its
+// tenant and records the shares paid to other tenants under the combined
+// "from:to" TenantID, so settlement runs include them as fees of the sender.
+// The records are written with the credits, so a fee is never collected
+// without being settled. The ledger entries and records get a "-fee" suffix
+// because the sender's tenant already holds the escrow debit under the plain
+// transaction ID.
+func feeShareItems(es EscrowTransaction) ([]types.TransactWriteItem, error) {
+	if es.FeeSplit == nil {
+		return nil, nil
+	}
+	currency, err := GetCurrency(es.EscrowCurrency())
+	if err != nil {
+		return nil, err
+	}
+	newVersion := &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)}
+
+	var items, records []types.TransactWriteItem
+	for _, share := range es.FeeSplit.shares(es.FromTenantID, es.ToTenantID, currency) {
+		entry, err := attributevalue.MarshalMap(LedgerEntry{
+			TenantID:            share.tenantID,
+			AccountID:           FEE_ACCOUNT,
+			Amount:              share.amount,
+			SystemTransactionID: es.SystemTransactionID + "-fee",
+			Type:                "credit",
+			Time:                es.TransactionDate,
+			InitiatorUUID:       es.InitiatorUUID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal ledger entry: %v", err)
+		}
+		update := &types.Update{
+			TableName: aws.String(NilUsers),
+			Key: map[string]types.AttributeValue{
+				"TenantID":  &types.AttributeValueMemberS{Value: share.tenantID},
+				"AccountID": &types.AttributeValueMemberS{Value: FEE_ACCOUNT},
+			},
+			UpdateExpression: aws.String("SET Version = :newVersion ADD amount :delta"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":delta":      amountNumber(es.EscrowCurrency(), share.amount),
+				":newVersion": newVersion,
+			},
+		}
+		items = append(items,
+			types.TransactWriteItem{Update: shardBalanceUpdate(update, share.tenantID, FEE_ACCOUNT, es.EscrowCurrency(), share.amount)},
+			types.TransactWriteItem{Put: &types.Put{TableName: aws.String(LedgerTable), Item: entry}},
+		)
+
+		if share.tenantID == es.FromTenantID {
+			continue
+		}
+		success := 0
+		record, err := attributevalue.MarshalMap(TransactionEntry{
+			TenantID:            es.FromTenantID + ":" + share.tenantID,
+			AccountID:           es.FromAccount,
+			SystemTransactionID: es.SystemTransactionID + "-fee",
+			FromAccount:         es.FromAccount,
+			ToAccount:           FEE_ACCOUNT,
+			Amount:              share.amount,
+			Comment:             "Revenue share",
+			TransactionDate:     es.TransactionDate,
+			Status:              &success,
+			InitiatorUUID:       es.InitiatorUUID,
+			Currency:            es.EscrowCurrency(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal transaction entry: %v", err)
+		}
+		records = append(records, types.TransactWriteItem{Put: &types.Put{TableName: aws.String(TransactionsTable), Item: record}})
+	}
+	return append(items, records...), nil
+}
@@ -0,0 +1,90 @@
+package ledger
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevenueShareValidate(t *testing.T) {
+	assert.NoError(t, RevenueShare{FromShare: 0.25, ToShare: 0.25, PlatformShare: 0.5}.Validate())
+	assert.NoError(t, RevenueShare{PlatformShare: 1}.Validate())
+	assert.Error(t, RevenueShare{FromShare: 0.5, ToShare: 0.6}.Validate())
+	assert.Error(t, RevenueShare{FromShare: -0.5, ToShare: 1, PlatformShare: 0.5}.Validate())
+}
+
+func TestEscrowCorridorFeeSplit(t *testing.T) {
+	share := &RevenueShare{FromShare: 1.0 / 3, ToShare: 1.0 / 3, PlatformShare: 1.0 / 3}
+	sdg := Currency{Code: "SDG", Exponent: 2, Rounding: RoundHalfUp}
+	whole := Currency{Code: "XWU", Exponent: 0, Rounding: RoundHalfEven}
+	tests := []struct {
+		name      string
+		corridor  EscrowCorridor
+		amount    float64
+		currency  Currency
+		wantFee   float64
+		wantSplit FeeSplit
+	}{
+		{"no fee", EscrowCorridor{RevenueShare: share}, 100, sdg, 0, FeeSplit{}},
+		{"platform keeps fee without rule", EscrowCorridor{Fee: 1, FeeRate: 0.01}, 100, sdg, 2, FeeSplit{Platform: 2}},
+		{"remainder goes to platform", EscrowCorridor{Fee: 1, RevenueShare: share}, 100, sdg, 1, FeeSplit{From: 0.33, To: 0.33, Platform: 0.34}},
+		{"rounds to the currency exponent", EscrowCorridor{Fee: 2, FeeRate: 0.005, RevenueShare: share}, 100, whole, 2, FeeSplit{From: 1, To: 1, Platform: 0}},
+		{"rounds with the currency mode", EscrowCorridor{FeeRate: 0.04}, 12.5, whole, 0, FeeSplit{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fee, split := tt.corridor.FeeSplit(tt.amount, tt.currency)
+			assert.Equal(t, tt.wantFee, fee)
+			assert.Equal(t, tt.wantSplit, split)
+		})
+	}
+}
+
+func TestFeeSplitShares(t *testing.T) {
+	sdg := Currency{Code: "SDG", Exponent: 2, Rounding: RoundHalfUp}
+	split := FeeSplit{From: 0.5, To: 0.25, Platform: 0.25}
+	assert.Equal(t, []feeShare{{"nonil", 0.5}, {"nil", 0.25}, {PLATFORM_TENANT, 0.25}}, split.shares("nonil", "nil", sdg))
+	assert.Equal(t, []feeShare{{"nil", 0.75}, {PLATFORM_TENANT, 0.25}}, split.shares("nil", "nil", sdg))
+	assert.Equal(t, []feeShare{{PLATFORM_TENANT, 1}}, FeeSplit{Platform: 1}.shares("nonil", "nil", sdg))
+}
+
+func TestEscrowCreationItemsChargesFee(t *testing.T) {
+	es := EscrowTransaction{
+		SystemTransactionID: "tx-1",
+		FromAccount:         "0111493885",
+		FromTenantID:        "nonil",
+		ToTenantID:          "nil",
+		Amount:              100,
+		Fee:                 2,
+		FeeSplit:            &FeeSplit{From: 0.5, To: 0.5, Platform: 1},
+		InitiatorUUID:       "uuid-1",
+		Status:              StatusInProgress,
+	}
+	items, err := escrowCreationItems(es, 1)
+	assert.NoError(t, err)
+	// escrow items, a credit and ledger entry per share, then the records of
+	// the shares paid to other tenants
+	assert.Len(t, items, 6+2*3+2)
+
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "102.00"}, items[1].Update.ExpressionAttributeValues[":amount"])
+	assert.Equal(t, &types.AttributeValueMemberN{Value: "100.00"}, items[3].Update.ExpressionAttributeValues[":delta"])
+
+	wantTenants := []string{"nonil", "nil", PLATFORM_TENANT}
+	for i, tenant := range wantTenants {
+		credit := items[6+2*i].Update
+		assert.Equal(t, &types.AttributeValueMemberS{Value: tenant}, credit.Key["TenantID"])
+		assert.Equal(t, &types.AttributeValueMemberS{Value: FEE_ACCOUNT}, credit.ExpressionAttributeValues[":account"])
+
+		entry := items[6+2*i+1].Put
+		assert.Equal(t, &types.AttributeValueMemberS{Value: "tx-1-fee"}, entry.Item["TransactionID"])
+	}
+	for i, tenant := range wantTenants[1:] {
+		record := items[12+i].Put
+		assert.Equal(t, TransactionsTable, aws.ToString(record.TableName))
+		assert.Equal(t, &types.AttributeValueMemberS{Value: "nonil:" + tenant}, record.Item["TenantID"])
+		assert.Equal(t, &types.AttributeValueMemberS{Value: "tx-1-fee"}, record.Item["TransactionID"])
+		assert.Equal(t, &types.AttributeValueMemberN{Value: "0"}, record.Item["TransactionStatus"])
+	}
+}
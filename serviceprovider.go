@@ -0,0 +1,271 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ServiceProvidersTable is keyed by Email. TenantIDIndex and EscrowAccountIndex
+// resolve providers from the identifiers found on transactions.
+const (
+	ServiceProvidersTable             = "ServiceProviders"
+	serviceProviderTenantIndex        = "TenantIDIndex"
+	serviceProviderEscrowAccountIndex = "EscrowAccountIndex"
+)
+
+var (
+	ErrServiceProviderNotFound  = errors.New("service provider not found")
+	ErrServiceProviderInactive  = errors.New("service provider is deactivated")
+	ErrServiceProviderAmbiguous = errors.New("more than one active service provider")
+)
+
+// IsActive reports whether the provider may receive new escrows.
+func (sp ServiceProvider) IsActive() bool {
+	return !sp.Deactivated
+}
+
+// GetServiceProviderByTenantID returns the active service provider of a
+// tenant. A tenant may keep deactivated providers around, but only one active.
+func GetServiceProviderByTenantID(ctx context.Context, dbSvc *dynamodb.Client, tenantID string) (*ServiceProvider, error) {
+	providers, err := queryServiceProviders(ctx, dbSvc, &dynamodb.QueryInput{
+		TableName:              aws.String(ServiceProvidersTable),
+		IndexName:              aws.String(serviceProviderTenantIndex),
+		KeyConditionExpression: aws.String("TenantID = :tenantID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":tenantID": &types.AttributeValueMemberS{Value: tenantID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return activeServiceProvider(providers, "tenant "+tenantID)
+}
+
+// GetServiceProviderByEscrowAccount returns the active service provider whose
+// escrow account is accountID in tenantID, i.e. the ToAccount and ToTenantID
+// of the settlement paying it.
+func GetServiceProviderByEscrowAccount(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string) (*ServiceProvider, error) {
+	providers, err := queryServiceProviders(ctx, dbSvc, &dynamodb.QueryInput{
+		TableName:              aws.String(ServiceProvidersTable),
+		IndexName:              aws.String(serviceProviderEscrowAccountIndex),
+		KeyConditionExpression: aws.String("EscrowAccount = :account AND TenantID = :tenantID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":account":  &types.AttributeValueMemberS{Value: accountID},
+			":tenantID": &types.AttributeValueMemberS{Value: tenantID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return activeServiceProvider(providers, "escrow account "+tenantID+"/"+accountID)
+}
+
+// ResolveServiceProvider finds the provider an escrow is routed to: by its
+// ServiceProvider email when set, otherwise by the escrow account it pays into
+// and finally by the receiving tenant.
+func ResolveServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, es EscrowTransaction) (*ServiceProvider, error) {
+	if es.ServiceProvider != "" {
+		return GetServiceProvider(ctx, dbSvc, es.ServiceProvider)
+	}
+	if es.ToTenantID == "" {
+		return nil, fmt.Errorf("%w: escrow %s names no provider or tenant", ErrServiceProviderNotFound, es.SystemTransactionID)
+	}
+	if es.ToAccount != "" {
+		provider, err := GetServiceProviderByEscrowAccount(ctx, dbSvc, es.ToTenantID, es.ToAccount)
+		if !errors.Is(err, ErrServiceProviderNotFound) {
+			return provider, err
+		}
+	}
+	return GetServiceProviderByTenantID(ctx, dbSvc, es.ToTenantID)
+}
+
+// activeServiceProvider picks the single active provider out of providers,
+// which were looked up by what.
+func activeServiceProvider(providers []ServiceProvider, what string) (*ServiceProvider, error) {
+	var active []ServiceProvider
+	for _, sp := range providers {
+		if sp.IsActive() {
+			active = append(active, sp)
+		}
+	}
+	switch {
+	case len(active) == 1:
+		return &active[0], nil
+	case len(active) > 1:
+		return nil, fmt.Errorf("%w for %s", ErrServiceProviderAmbiguous, what)
+	case len(providers) > 0:
+		return nil, fmt.Errorf("%w: %s", ErrServiceProviderInactive, providers[0].Email)
+	}
+	return nil, fmt.Errorf("%w for %s", ErrServiceProviderNotFound, what)
+}
+
+// checkServiceProviderActive fails with ErrServiceProviderInactive when email
+// names a deactivated provider. Escrows without a provider, or with one that
+// was never registered, are left to the cashout provider to judge.
+func checkServiceProviderActive(ctx context.Context, dbSvc *dynamodb.Client, email string) error {
+	if email == "" {
+		return nil
+	}
+	provider, err := GetServiceProvider(ctx, dbSvc, email)
+	if errors.Is(err, ErrServiceProviderNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !provider.IsActive() {
+		return fmt.Errorf("%w: %s", ErrServiceProviderInactive, email)
+	}
+	return nil
+}
+
+func queryServiceProviders(ctx context.Context, dbSvc *dynamodb.Client, input *dynamodb.QueryInput) ([]ServiceProvider, error) {
+	var providers []ServiceProvider
+	for {
+		result, err := dbSvc.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query service providers: %w", err)
+		}
+		var page []ServiceProvider
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal service providers: %w", err)
+		}
+		providers = append(providers, page...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			return providers, nil
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+}
+
+// ServiceProviderFilter narrows ListServiceProviders results.
+type ServiceProviderFilter struct {
+	TenantID        string
+	IncludeInactive bool
+	Limit           int32
+	Cursor          string
+}
+
+// ServiceProviderPage is a page of providers with an opaque cursor for the
+// next page.
+type ServiceProviderPage struct {
+	Providers  []ServiceProvider `json:"providers"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// ListServiceProviders lists the providers of filter.TenantID, or of all
+// tenants when it is empty. Deactivated providers are left out unless
+// IncludeInactive is set, so a page may hold fewer than Limit providers while
+// NextCursor is still set.
+func ListServiceProviders(ctx context.Context, dbSvc *dynamodb.Client, filter ServiceProviderFilter) (*ServiceProviderPage, error) {
+	if filter.Limit == 0 {
+		filter.Limit = 25
+	}
+	startKey, err := decodeCursor(filter.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	var filterExpression *string
+	if !filter.IncludeInactive {
+		filterExpression = aws.String("attribute_not_exists(Deactivated) OR Deactivated = :false")
+	}
+
+	var items []map[string]types.AttributeValue
+	var lastKey map[string]types.AttributeValue
+	if filter.TenantID != "" {
+		values := map[string]types.AttributeValue{
+			":tenantID": &types.AttributeValueMemberS{Value: filter.TenantID},
+		}
+		if filterExpression != nil {
+			values[":false"] = &types.AttributeValueMemberBOOL{Value: false}
+		}
+		result, err := dbSvc.Query(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String(ServiceProvidersTable),
+			IndexName:                 aws.String(serviceProviderTenantIndex),
+			KeyConditionExpression:    aws.String("TenantID = :tenantID"),
+			FilterExpression:          filterExpression,
+			ExpressionAttributeValues: values,
+			ExclusiveStartKey:         startKey,
+			Limit:                     aws.Int32(filter.Limit),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query service providers: %w", err)
+		}
+		items, lastKey = result.Items, result.LastEvaluatedKey
+	} else {
+		input := &dynamodb.ScanInput{
+			TableName:         aws.String(ServiceProvidersTable),
+			FilterExpression:  filterExpression,
+			ExclusiveStartKey: startKey,
+			Limit:             aws.Int32(filter.Limit),
+		}
+		if filterExpression != nil {
+			input.ExpressionAttributeValues = map[string]types.AttributeValue{
+				":false": &types.AttributeValueMemberBOOL{Value: false},
+			}
+		}
+		result, err := dbSvc.Scan(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan service providers: %w", err)
+		}
+		items, lastKey = result.Items, result.LastEvaluatedKey
+	}
+
+	page := &ServiceProviderPage{Providers: []ServiceProvider{}}
+	if err := attributevalue.UnmarshalListOfMaps(items, &page.Providers); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal service providers: %w", err)
+	}
+	page.NextCursor, err = encodeCursor(lastKey)
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// DeactivateServiceProvider stops routing new escrows to a provider. Escrows
+// it already holds can still be confirmed.
+func DeactivateServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, email, reason string) error {
+	return setServiceProviderActive(ctx, dbSvc, email, false, reason)
+}
+
+// ReactivateServiceProvider undoes DeactivateServiceProvider.
+func ReactivateServiceProvider(ctx context.Context, dbSvc *dynamodb.Client, email string) error {
+	return setServiceProviderActive(ctx, dbSvc, email, true, "")
+}
+
+func setServiceProviderActive(ctx context.Context, dbSvc *dynamodb.Client, email string, active bool, reason string) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(ServiceProvidersTable),
+		Key: map[string]types.AttributeValue{
+			"Email": &types.AttributeValueMemberS{Value: email},
+		},
+		ConditionExpression: aws.String("attribute_exists(Email)"),
+	}
+	if active {
+		input.UpdateExpression = aws.String("REMOVE Deactivated, DeactivatedAt, DeactivationReason")
+	} else {
+		input.UpdateExpression = aws.String("SET Deactivated = :true, DeactivatedAt = :now, DeactivationReason = :reason")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":true":   &types.AttributeValueMemberBOOL{Value: true},
+			":now":    &types.AttributeValueMemberS{Value: getCurrentTimeZone()},
+			":reason": &types.AttributeValueMemberS{Value: reason},
+		}
+	}
+
+	if _, err := dbSvc.UpdateItem(ctx, input); err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return fmt.Errorf("%w: %s", ErrServiceProviderNotFound, email)
+		}
+		return fmt.Errorf("failed to update service provider %s: %w", email, err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package ledger
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActiveServiceProvider(t *testing.T) {
+	active := ServiceProvider{Email: "oss@pynil.com", TenantID: "nil"}
+	inactive := ServiceProvider{Email: "old@pynil.com", TenantID: "nil", Deactivated: true}
+	other := ServiceProvider{Email: "ops@pynil.com", TenantID: "nil"}
+
+	tests := []struct {
+		name      string
+		providers []ServiceProvider
+		want      string
+		wantErr   error
+	}{
+		{"single active", []ServiceProvider{active}, "oss@pynil.com", nil},
+		{"skips deactivated", []ServiceProvider{inactive, active}, "oss@pynil.com", nil},
+		{"only deactivated", []ServiceProvider{inactive}, "", ErrServiceProviderInactive},
+		{"several active", []ServiceProvider{active, other}, "", ErrServiceProviderAmbiguous},
+		{"none", nil, "", ErrServiceProviderNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := activeServiceProvider(tt.providers, "tenant nil")
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), "got %v", err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got.Email)
+		})
+	}
+}
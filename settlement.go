@@ -0,0 +1,436 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/segmentio/ksuid"
+)
+
+const SettlementsTable = "Settlements"
+
+// SettlementPosition nets the movements between two tenants. TenantA sorts
+// before TenantB; Payer owes Payee Net once both directions are offset.
+type SettlementPosition struct {
+	TenantA string  `dynamodbav:"TenantA" json:"tenant_a"`
+	TenantB string  `dynamodbav:"TenantB" json:"tenant_b"`
+	AToB    float64 `dynamodbav:"AToB" json:"a_to_b"`
+	BToA    float64 `dynamodbav:"BToA" json:"b_to_a"`
+	Payer   string  `dynamodbav:"Payer,omitempty" json:"payer,omitempty"`
+	Payee   string  `dynamodbav:"Payee,omitempty" json:"payee,omitempty"`
+	Net     float64 `dynamodbav:"Net" json:"net"`
+}
+
+// SettlementStatement is one tenant's view of a settlement run. Fees is the
+// part of GrossOut paid into other tenants' FEE_ACCOUNT and RevenueShare the
+// part of GrossIn received into its own; NetPosition is GrossIn - GrossOut,
+// positive when the tenant is owed money.
+type SettlementStatement struct {
+	TenantID     string  `dynamodbav:"TenantID" json:"tenant_id"`
+	GrossIn      float64 `dynamodbav:"GrossIn" json:"gross_in"`
+	GrossOut     float64 `dynamodbav:"GrossOut" json:"gross_out"`
+	Fees         float64 `dynamodbav:"Fees" json:"fees"`
+	RevenueShare float64 `dynamodbav:"RevenueShare" json:"revenue_share"`
+	NetPosition  float64 `dynamodbav:"NetPosition" json:"net_position"`
+	// Counterparties holds the net position towards each other tenant.
+	Counterparties map[string]float64 `dynamodbav:"Counterparties" json:"counterparties"`
+}
+
+// Settlement states. A run is stored as pending before any transaction is
+// marked with its SettlementID, so a run that fails midway can be resumed with
+// ResumeSettlement instead of leaving marked transactions behind no statement.
+// Runs stored before the status was recorded are completed.
+const (
+	SettlementPending   = "pending"
+	SettlementCompleted = "completed"
+)
+
+// Settlement is the result of a settlement run over the cross-tenant
+// transactions in Currency dated within [PeriodStart, PeriodEnd].
+type Settlement struct {
+	SettlementID     string                `dynamodbav:"SettlementID" json:"settlement_id"`
+	Status           string                `dynamodbav:"SettlementStatus,omitempty" json:"status,omitempty"`
+	PeriodStart      int64                 `dynamodbav:"PeriodStart" json:"period_start"`
+	PeriodEnd        int64                 `dynamodbav:"PeriodEnd" json:"period_end"`
+	CreatedAt        string                `dynamodbav:"CreatedAt" json:"created_at"`
+	Currency         string                `dynamodbav:"Currency" json:"currency"`
+	TransactionCount int                   `dynamodbav:"TransactionCount" json:"transaction_count"`
+	Positions        []SettlementPosition  `dynamodbav:"Positions" json:"positions"`
+	Statements       []SettlementStatement `dynamodbav:"Statements" json:"statements"`
+}
+
+// IsPending reports whether the run was interrupted before it completed.
+func (s Settlement) IsPending() bool {
+	return s.Status == SettlementPending
+}
+
+// Statement returns the statement of tenantID, if it took part in the run.
+func (s Settlement) Statement(tenantID string) (SettlementStatement, bool) {
+	for _, st := range s.Statements {
+		if st.TenantID == tenantID {
+			return st, true
+		}
+	}
+	return SettlementStatement{}, false
+}
+
+// crossTenantParties splits the combined "from:to" TenantID that
+// EscrowTransferCredits records cross-tenant movements under. Movements into
+// or out of the ESCROW_TENANT pseudo-tenant are not owed by anyone as recorded;
+// attributeEscrowLeg names the tenants of the escrow instead.
+func crossTenantParties(tenantID string) (from, to string, ok bool) {
+	from, to, ok = strings.Cut(tenantID, ":")
+	if !ok || from == "" || to == "" || from == to || from == ESCROW_TENANT || to == ESCROW_TENANT {
+		return "", "", false
+	}
+	return from, to, true
+}
+
+// attributeEscrowLeg returns tx as settlement sees it. Funds paid into the
+// escrow account are owed by nobody until they leave it, so tx is returned as
+// is. Funds paid out of the escrow account are owed by the escrow's sender to
+// the receiving tenant, so a refund nets to nothing; escrows is a cache of the
+// escrows by InitiatorUUID. ok is false when the escrow of tx is unknown.
+func attributeEscrowLeg(ctx context.Context, dbSvc *dynamodb.Client, tx TransactionEntry, escrows map[string]*EscrowTransaction) (TransactionEntry, bool, error) {
+	from, to, found := strings.Cut(tx.TenantID, ":")
+	if !found || from != ESCROW_TENANT {
+		return tx, true, nil
+	}
+	es, cached := escrows[tx.InitiatorUUID]
+	if !cached {
+		var err error
+		es, err = getEscrowByIdempotencyKey(ctx, dbSvc, tx.InitiatorUUID)
+		if err != nil {
+			return tx, false, err
+		}
+		escrows[tx.InitiatorUUID] = es
+	}
+	if es == nil {
+		return tx, false, nil
+	}
+	tx.TenantID = es.FromTenantID + ":" + to
+	tx.Currency = es.EscrowCurrency()
+	return tx, true, nil
+}
+
+// RunSettlement settles the successful cross-tenant transactions in currency,
+// DefaultCurrency when empty, dated within [start, end] that no earlier run
+// included. Transactions in other currencies are left for their own run.
+// Each transaction is marked with the new SettlementID before the statements
+// are built from the ones marked, so concurrent runs never settle a
+// transaction twice.
+func RunSettlement(ctx context.Context, dbSvc *dynamodb.Client, currency string, start, end int64) (*Settlement, error) {
+	if start > end {
+		return nil, fmt.Errorf("period start %d is after period end %d", start, end)
+	}
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	if _, err := GetCurrency(currency); err != nil {
+		return nil, err
+	}
+
+	pending := &Settlement{
+		SettlementID: ksuid.New().String(),
+		Status:       SettlementPending,
+		PeriodStart:  start,
+		PeriodEnd:    end,
+		CreatedAt:    getCurrentTimeZone(),
+		Currency:     currency,
+		Positions:    []SettlementPosition{},
+		Statements:   []SettlementStatement{},
+	}
+	item, err := attributevalue.MarshalMap(pending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal settlement: %w", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(SettlementsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(SettlementID)"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store settlement %s: %w", pending.SettlementID, err)
+	}
+	return completeSettlement(ctx, dbSvc, pending)
+}
+
+// ResumeSettlement completes a run that RunSettlement left pending. A
+// completed run is returned as stored.
+func ResumeSettlement(ctx context.Context, dbSvc *dynamodb.Client, settlementID string) (*Settlement, error) {
+	settlement, err := GetSettlement(ctx, dbSvc, settlementID)
+	if err != nil {
+		return nil, err
+	}
+	if !settlement.IsPending() {
+		return settlement, nil
+	}
+	return completeSettlement(ctx, dbSvc, settlement)
+}
+
+// completeSettlement marks the unsettled transactions of the pending run,
+// builds the run from every transaction marked with its SettlementID,
+// including ones marked by an earlier attempt, and stores it as completed.
+func completeSettlement(ctx context.Context, dbSvc *dynamodb.Client, pending *Settlement) (*Settlement, error) {
+	candidates, err := unsettledTransactions(ctx, dbSvc, pending.PeriodStart, pending.PeriodEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	escrows := map[string]*EscrowTransaction{}
+	for _, tx := range candidates {
+		attributed, ok, err := attributeEscrowLeg(ctx, dbSvc, tx, escrows)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Printf("transaction %s leaves the escrow account but its escrow %s was not found", tx.SystemTransactionID, tx.InitiatorUUID)
+			continue
+		}
+		if attributed.TransactionCurrency() != pending.Currency {
+			continue
+		}
+		err = markTransactionSettled(ctx, dbSvc, tx, pending.SettlementID)
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			log.Printf("transaction %s was settled by another run", tx.SystemTransactionID)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	marked, err := settledTransactions(ctx, dbSvc, pending.SettlementID)
+	if err != nil {
+		return nil, err
+	}
+	settled := make([]TransactionEntry, 0, len(marked))
+	for _, tx := range marked {
+		attributed, ok, err := attributeEscrowLeg(ctx, dbSvc, tx, escrows)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			settled = append(settled, attributed)
+		}
+	}
+
+	settlement := buildSettlement(pending.Currency, settled)
+	settlement.SettlementID = pending.SettlementID
+	settlement.Status = SettlementCompleted
+	settlement.PeriodStart = pending.PeriodStart
+	settlement.PeriodEnd = pending.PeriodEnd
+	settlement.CreatedAt = pending.CreatedAt
+
+	item, err := attributevalue.MarshalMap(settlement)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal settlement: %w", err)
+	}
+	_, err = dbSvc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(SettlementsTable),
+		Item:                     item,
+		ConditionExpression:      aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]string{"#status": "SettlementStatus"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: SettlementPending},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store settlement %s: %w", settlement.SettlementID, err)
+	}
+	return settlement, nil
+}
+
+// GetSettlement returns a stored settlement run.
+func GetSettlement(ctx context.Context, dbSvc *dynamodb.Client, settlementID string) (*Settlement, error) {
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(SettlementsTable),
+		Key: map[string]types.AttributeValue{
+			"SettlementID": &types.AttributeValueMemberS{Value: settlementID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get settlement: %w", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("settlement %s does not exist", settlementID)
+	}
+	var settlement Settlement
+	if err := attributevalue.UnmarshalMap(result.Item, &settlement); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal settlement: %w", err)
+	}
+	return &settlement, nil
+}
+
+// buildSettlement nets txs, all in currency and attributed with
+// attributeEscrowLeg, per tenant pair and per tenant.
+func buildSettlement(currency string, txs []TransactionEntry) *Settlement {
+	settlement := &Settlement{
+		Currency:   currency,
+		Positions:  []SettlementPosition{},
+		Statements: []SettlementStatement{},
+	}
+	round := roundCents
+	if c, err := GetCurrency(currency); err == nil {
+		round = c.Round
+	}
+	positions := map[[2]string]*SettlementPosition{}
+	statements := map[string]*SettlementStatement{}
+	statement := func(tenantID string) *SettlementStatement {
+		st, ok := statements[tenantID]
+		if !ok {
+			st = &SettlementStatement{TenantID: tenantID, Counterparties: map[string]float64{}}
+			statements[tenantID] = st
+		}
+		return st
+	}
+
+	for _, tx := range txs {
+		from, to, ok := crossTenantParties(tx.TenantID)
+		if !ok {
+			continue
+		}
+		settlement.TransactionCount++
+
+		a, b := from, to
+		if b < a {
+			a, b = b, a
+		}
+		pos, ok := positions[[2]string{a, b}]
+		if !ok {
+			pos = &SettlementPosition{TenantA: a, TenantB: b}
+			positions[[2]string{a, b}] = pos
+		}
+		if from == a {
+			pos.AToB += tx.Amount
+		} else {
+			pos.BToA += tx.Amount
+		}
+
+		payer, payee := statement(from), statement(to)
+		payer.GrossOut += tx.Amount
+		payer.Counterparties[to] -= tx.Amount
+		if tx.ToAccount == FEE_ACCOUNT {
+			payer.Fees += tx.Amount
+			payee.RevenueShare += tx.Amount
+		}
+		payee.GrossIn += tx.Amount
+		payee.Counterparties[from] += tx.Amount
+	}
+
+	for _, pos := range positions {
+		pos.AToB, pos.BToA = round(pos.AToB), round(pos.BToA)
+		net := round(pos.AToB - pos.BToA)
+		switch {
+		case net > 0:
+			pos.Payer, pos.Payee, pos.Net = pos.TenantA, pos.TenantB, net
+		case net < 0:
+			pos.Payer, pos.Payee, pos.Net = pos.TenantB, pos.TenantA, -net
+		}
+		settlement.Positions = append(settlement.Positions, *pos)
+	}
+	sort.Slice(settlement.Positions, func(i, j int) bool {
+		pi, pj := settlement.Positions[i], settlement.Positions[j]
+		if pi.TenantA != pj.TenantA {
+			return pi.TenantA < pj.TenantA
+		}
+		return pi.TenantB < pj.TenantB
+	})
+
+	for _, st := range statements {
+		st.GrossIn, st.GrossOut = round(st.GrossIn), round(st.GrossOut)
+		st.Fees, st.RevenueShare = round(st.Fees), round(st.RevenueShare)
+		st.NetPosition = round(st.GrossIn - st.GrossOut)
+		for tenant, amount := range st.Counterparties {
+			st.Counterparties[tenant] = round(amount)
+		}
+		settlement.Statements = append(settlement.Statements, *st)
+	}
+	sort.Slice(settlement.Statements, func(i, j int) bool {
+		return settlement.Statements[i].TenantID < settlement.Statements[j].TenantID
+	})
+	return settlement
+}
+
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// unsettledTransactions scans TransactionsTable for successful cross-tenant
+// transactions in the period that carry no SettlementID yet.
+func unsettledTransactions(ctx context.Context, dbSvc *dynamodb.Client, start, end int64) ([]TransactionEntry, error) {
+	return scanTransactions(ctx, dbSvc, &dynamodb.ScanInput{
+		TableName: aws.String(TransactionsTable),
+		FilterExpression: aws.String("contains(TenantID, :separator) AND TransactionDate BETWEEN :start AND :end" +
+			" AND TransactionStatus = :success AND attribute_not_exists(SettlementID)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":separator": &types.AttributeValueMemberS{Value: ":"},
+			":start":     &types.AttributeValueMemberN{Value: strconv.FormatInt(start, 10)},
+			":end":       &types.AttributeValueMemberN{Value: strconv.FormatInt(end, 10)},
+			":success":   &types.AttributeValueMemberN{Value: "0"},
+		},
+	})
+}
+
+// settledTransactions returns the transactions marked with settlementID.
+func settledTransactions(ctx context.Context, dbSvc *dynamodb.Client, settlementID string) ([]TransactionEntry, error) {
+	return scanTransactions(ctx, dbSvc, &dynamodb.ScanInput{
+		TableName:        aws.String(TransactionsTable),
+		FilterExpression: aws.String("SettlementID = :settlementID"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":settlementID": &types.AttributeValueMemberS{Value: settlementID},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+}
+
+func scanTransactions(ctx context.Context, dbSvc *dynamodb.Client, input *dynamodb.ScanInput) ([]TransactionEntry, error) {
+	var transactions []TransactionEntry
+	for {
+		result, err := dbSvc.Scan(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan transactions: %w", err)
+		}
+		var page []TransactionEntry
+		if err := attributevalue.UnmarshalListOfMaps(result.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal transactions: %w", err)
+		}
+		transactions = append(transactions, page...)
+
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	return transactions, nil
+}
+
+func markTransactionSettled(ctx context.Context, dbSvc *dynamodb.Client, tx TransactionEntry, settlementID string) error {
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(TransactionsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID":      &types.AttributeValueMemberS{Value: tx.TenantID},
+			"TransactionID": &types.AttributeValueMemberS{Value: tx.SystemTransactionID},
+		},
+		UpdateExpression:    aws.String("SET SettlementID = :settlementID"),
+		ConditionExpression: aws.String("attribute_exists(TransactionID) AND attribute_not_exists(SettlementID)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":settlementID": &types.AttributeValueMemberS{Value: settlementID},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark transaction %s settled: %w", tx.SystemTransactionID, err)
+	}
+	return nil
+}
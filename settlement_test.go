@@ -0,0 +1,137 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCrossTenantParties(t *testing.T) {
+	tests := []struct {
+		tenantID string
+		from, to string
+		ok       bool
+	}{
+		{"nonil:nil", "nonil", "nil", true},
+		{"nil", "", "", false},
+		{"nil:nil", "", "", false},
+		{":nil", "", "", false},
+		// escrow legs are settled once attributed to the escrow's tenants
+		{"nonil:" + ESCROW_TENANT, "", "", false},
+		{ESCROW_TENANT + ":nil", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tenantID, func(t *testing.T) {
+			from, to, ok := crossTenantParties(tt.tenantID)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.from, from)
+			assert.Equal(t, tt.to, to)
+		})
+	}
+}
+
+func TestBuildSettlement(t *testing.T) {
+	txs := []TransactionEntry{
+		{TenantID: "nonil:nil", SystemTransactionID: "1", ToAccount: "0965256869", Amount: 100},
+		{TenantID: "nonil:nil", SystemTransactionID: "2", ToAccount: FEE_ACCOUNT, Amount: 2.5},
+		{TenantID: "nil:nonil", SystemTransactionID: "3", ToAccount: "0111493885", Amount: 40},
+		{TenantID: "nil:bok", SystemTransactionID: "4", ToAccount: "0123", Amount: 10.1},
+		{TenantID: "bok:nil", SystemTransactionID: "5", ToAccount: "0456", Amount: 10.1},
+		// same-tenant transfers are not part of settlement
+		{TenantID: "nil", SystemTransactionID: "6", ToAccount: "0789", Amount: 500},
+	}
+
+	s := buildSettlement(DefaultCurrency, txs)
+	assert.Equal(t, 5, s.TransactionCount)
+	assert.Equal(t, DefaultCurrency, s.Currency)
+
+	assert.Equal(t, []SettlementPosition{
+		{TenantA: "bok", TenantB: "nil", AToB: 10.1, BToA: 10.1},
+		{TenantA: "nil", TenantB: "nonil", AToB: 40, BToA: 102.5, Payer: "nonil", Payee: "nil", Net: 62.5},
+	}, s.Positions)
+
+	nonil, ok := s.Statement("nonil")
+	assert.True(t, ok)
+	assert.Equal(t, SettlementStatement{
+		TenantID:       "nonil",
+		GrossIn:        40,
+		GrossOut:       102.5,
+		Fees:           2.5,
+		NetPosition:    -62.5,
+		Counterparties: map[string]float64{"nil": -62.5},
+	}, nonil)
+
+	nilStatement, ok := s.Statement("nil")
+	assert.True(t, ok)
+	assert.Equal(t, 62.5, nilStatement.NetPosition)
+	assert.Equal(t, 2.5, nilStatement.RevenueShare)
+	assert.Equal(t, map[string]float64{"nonil": 62.5, "bok": 0}, nilStatement.Counterparties)
+
+	_, ok = s.Statement("unknown")
+	assert.False(t, ok)
+
+	var total float64
+	for _, st := range s.Statements {
+		total += st.NetPosition
+	}
+	assert.InDelta(t, 0, total, amountEpsilon)
+}
+
+func TestAttributeEscrowLeg(t *testing.T) {
+	escrows := map[string]*EscrowTransaction{
+		"uuid-1": {InitiatorUUID: "uuid-1", FromTenantID: "nonil", ToTenantID: "nil"},
+		"uuid-2": {InitiatorUUID: "uuid-2", FromTenantID: "nonil", ToTenantID: "nil", Currency: "USD"},
+		"uuid-3": nil,
+	}
+	tests := []struct {
+		name     string
+		tx       TransactionEntry
+		tenantID string
+		currency string
+		ok       bool
+	}{
+		// rows as CreateEscrow and the escrow payouts write them
+		{"into escrow", TransactionEntry{TenantID: "nonil:" + ESCROW_TENANT, InitiatorUUID: "uuid-1"}, "nonil:" + ESCROW_TENANT, DefaultCurrency, true},
+		{"payout", TransactionEntry{TenantID: ESCROW_TENANT + ":nil", InitiatorUUID: "uuid-1"}, "nonil:nil", DefaultCurrency, true},
+		{"refund", TransactionEntry{TenantID: ESCROW_TENANT + ":nonil", InitiatorUUID: "uuid-1"}, "nonil:nonil", DefaultCurrency, true},
+		{"escrow currency", TransactionEntry{TenantID: ESCROW_TENANT + ":nil", InitiatorUUID: "uuid-2"}, "nonil:nil", "USD", true},
+		{"unknown escrow", TransactionEntry{TenantID: ESCROW_TENANT + ":nil", InitiatorUUID: "uuid-3"}, ESCROW_TENANT + ":nil", DefaultCurrency, false},
+		{"between tenants", TransactionEntry{TenantID: "nonil:nil"}, "nonil:nil", DefaultCurrency, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, ok, err := attributeEscrowLeg(context.TODO(), nil, tt.tx, escrows)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.tenantID, tx.TenantID)
+			assert.Equal(t, tt.currency, tx.TransactionCurrency())
+		})
+	}
+}
+
+func TestBuildSettlementEscrowLegs(t *testing.T) {
+	escrows := map[string]*EscrowTransaction{
+		"uuid-1": {InitiatorUUID: "uuid-1", FromTenantID: "nonil", ToTenantID: "nil"},
+	}
+	rows := []TransactionEntry{
+		{TenantID: "nonil:" + ESCROW_TENANT, SystemTransactionID: "1", ToAccount: ESCROW_ACCOUNT, Amount: 100, InitiatorUUID: "uuid-1"},
+		{TenantID: ESCROW_TENANT + ":nil", SystemTransactionID: "2", ToAccount: "0965256869", Amount: 60, InitiatorUUID: "uuid-1"},
+		{TenantID: ESCROW_TENANT + ":nonil", SystemTransactionID: "3", ToAccount: "0111493885", Amount: 40, InitiatorUUID: "uuid-1"},
+	}
+	var txs []TransactionEntry
+	for _, row := range rows {
+		tx, ok, err := attributeEscrowLeg(context.TODO(), nil, row, escrows)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		txs = append(txs, tx)
+	}
+
+	s := buildSettlement(DefaultCurrency, txs)
+	assert.Equal(t, 1, s.TransactionCount)
+	assert.Equal(t, []SettlementPosition{
+		{TenantA: "nil", TenantB: "nonil", BToA: 60, Payer: "nonil", Payee: "nil", Net: 60},
+	}, s.Positions)
+	_, ok := s.Statement(ESCROW_TENANT)
+	assert.False(t, ok)
+}
@@ -0,0 +1,356 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// System accounts every tenant may hold. They sit on the hot path of many
+// transactions, so like ESCROW_ACCOUNT they are sharded by default.
+const (
+	FEE_ACCOUNT      = "NIL_FEE_ACCOUNT"
+	TREASURY_ACCOUNT = "NIL_TREASURY_ACCOUNT"
+)
+
+// DefaultSystemAccountShards is the number of balance shards used for the
+// built-in system accounts.
+const DefaultSystemAccountShards = 8
+
+// A sharded account keeps its balance across N extra NilUsers items whose
+// AccountID is "<account>#<shard>" and whose ShardOf is the account. The shards
+// are opened with the account, see OpenAccountShards. Each credit picks a shard
+// at random, which removes the Version contention on the single hot item, and
+// each debit a shard that can cover it; balance reads add the shards to the
+// balance of the account item itself.
+var (
+	shardedAccountsMu sync.RWMutex
+	shardedAccounts   = map[string]int{
+		ESCROW_ACCOUNT:   DefaultSystemAccountShards,
+		FEE_ACCOUNT:      DefaultSystemAccountShards,
+		TREASURY_ACCOUNT: DefaultSystemAccountShards,
+	}
+)
+
+// RegisterShardedAccount spreads writes to accountID, in any tenant, across
+// shards balance shards. Zero shards turns sharding off; balances already held
+// in shards are still counted by GetShardedBalance only while registered, so
+// only lower the count after draining them. Raising the count requires opening
+// the new shards of existing accounts with OpenAccountShards first.
+func RegisterShardedAccount(accountID string, shards int) {
+	shardedAccountsMu.Lock()
+	defer shardedAccountsMu.Unlock()
+	if shards <= 0 {
+		delete(shardedAccounts, accountID)
+		return
+	}
+	shardedAccounts[accountID] = shards
+}
+
+// AccountShards returns the number of balance shards of accountID, or 0 if it
+// is not sharded.
+func AccountShards(accountID string) int {
+	shardedAccountsMu.RLock()
+	defer shardedAccountsMu.RUnlock()
+	return shardedAccounts[accountID]
+}
+
+func shardAccountID(accountID string, shard int) string {
+	return accountID + "#" + strconv.Itoa(shard)
+}
+
+// noShard debits the account item of a sharded account rather than a shard.
+const noShard = -1
+
+// shardBalanceUpdate redirects a balance update of a sharded account to one of
+// its shards, chosen at random. The shard must already be open, so a credit to
+// an account that does not exist in the tenant fails rather than creating a
+// stray shard; it is not version checked. Credits and unconditional updates, such as FX positions that
+// may go negative, are spread this way; a conditional debit is instead sent to
+// the account item with a check on the item's own balance, see shardDebitUpdate.
+// Updates of other accounts are returned unchanged.
+func shardBalanceUpdate(update *types.Update, tenantID, accountID, currency string, delta float64) *types.Update {
+	shards := AccountShards(accountID)
+	if shards == 0 {
+		return update
+	}
+	if delta < 0 && update != nil && update.ConditionExpression != nil {
+		return shardDebitUpdate(update, tenantID, accountID, currency, -delta, noShard)
+	}
+	return &types.Update{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantID},
+			"AccountID": &types.AttributeValueMemberS{Value: shardAccountID(accountID, rand.Intn(shards))},
+		},
+		UpdateExpression:    aws.String("SET Version = :newVersion ADD amount :delta"),
+		ConditionExpression: aws.String("ShardOf = :account"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":delta":      amountNumber(currency, delta),
+			":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
+			":account":    &types.AttributeValueMemberS{Value: accountID},
+		},
+	}
+}
+
+// openShardUpdates creates the missing shards of a sharded account with a zero
+// balance, leaving shards that already exist as they are. It returns nil for
+// accounts that are not sharded.
+func openShardUpdates(tenantID, accountID string) []*types.Update {
+	shards := AccountShards(accountID)
+	updates := make([]*types.Update, 0, shards)
+	for i := 0; i < shards; i++ {
+		updates = append(updates, &types.Update{
+			TableName: aws.String(NilUsers),
+			Key: map[string]types.AttributeValue{
+				"TenantID":  &types.AttributeValueMemberS{Value: tenantID},
+				"AccountID": &types.AttributeValueMemberS{Value: shardAccountID(accountID, i)},
+			},
+			UpdateExpression: aws.String("SET ShardOf = :account, amount = if_not_exists(amount, :zero), Version = if_not_exists(Version, :version)"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":account": &types.AttributeValueMemberS{Value: accountID},
+				":zero":    &types.AttributeValueMemberN{Value: "0"},
+				":version": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
+			},
+		})
+	}
+	return updates
+}
+
+// OpenAccountShards opens the balance shards of an existing sharded account.
+// OnboardTenant opens them for the system accounts of new tenants; accounts
+// created otherwise, such as ESCROW_ACCOUNT, and accounts whose shard count
+// was raised need this before they can be credited.
+func OpenAccountShards(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string) error {
+	updates := openShardUpdates(tenantID, accountID)
+	// a transaction holds at most 100 items, one is the account check
+	for start := 0; start < len(updates); start += 99 {
+		items := []types.TransactWriteItem{{ConditionCheck: &types.ConditionCheck{
+			TableName: aws.String(NilUsers),
+			Key: map[string]types.AttributeValue{
+				"TenantID":  &types.AttributeValueMemberS{Value: tenantID},
+				"AccountID": &types.AttributeValueMemberS{Value: accountID},
+			},
+			ConditionExpression: aws.String("attribute_exists(AccountID)"),
+		}}}
+		for _, update := range updates[start:min(start+99, len(updates))] {
+			items = append(items, types.TransactWriteItem{Update: update})
+		}
+		if _, err := dbSvc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items}); err != nil {
+			return fmt.Errorf("failed to open shards of %s: %w", accountID, err)
+		}
+	}
+	return nil
+}
+
+// shardDebitUpdate redirects a debit of amount from a sharded account to shard,
+// usually picked with pickDebitShard, conditioned on the shard holding at
+// least amount. With noShard the account item is debited by update, which
+// additionally requires the item itself to hold amount. Neither the shards nor
+// the account item can go negative, so concurrent debits cannot overdraw the
+// account even though each only checks a part of its balance.
+func shardDebitUpdate(update *types.Update, tenantID, accountID, currency string, amount float64, shard int) *types.Update {
+	if AccountShards(accountID) == 0 {
+		return update
+	}
+	debit := amountNumber(currency, amount)
+	if shard == noShard {
+		values := make(map[string]types.AttributeValue, len(update.ExpressionAttributeValues)+1)
+		for k, v := range update.ExpressionAttributeValues {
+			values[k] = v
+		}
+		values[":debit"] = debit
+		condition := "amount >= :debit"
+		if c := aws.ToString(update.ConditionExpression); c != "" {
+			condition = "(" + c + ") AND " + condition
+		}
+		checked := *update
+		checked.ConditionExpression = aws.String(condition)
+		checked.ExpressionAttributeValues = values
+		return &checked
+	}
+	return &types.Update{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantID},
+			"AccountID": &types.AttributeValueMemberS{Value: shardAccountID(accountID, shard)},
+		},
+		UpdateExpression:    aws.String("SET Version = :newVersion ADD amount :delta"),
+		ConditionExpression: aws.String("amount >= :debit"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":delta":      amountNumber(currency, -amount),
+			":debit":      debit,
+			":newVersion": &types.AttributeValueMemberN{Value: strconv.FormatInt(getCurrentTimestamp(), 10)},
+		},
+	}
+}
+
+// pickDebitShard picks, at random, a shard of accountID holding at least
+// amount. When no shard does, the account item is debited instead: if it does
+// not hold amount either but the account as a whole does, the shards are first
+// collected into the account item.
+func pickDebitShard(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string, amount float64) (int, error) {
+	if AccountShards(accountID) == 0 {
+		return noShard, nil
+	}
+	main, shards, err := shardBalances(ctx, dbSvc, tenantID, accountID)
+	if err != nil {
+		return noShard, err
+	}
+
+	var candidates []int
+	total := main
+	for i, balance := range shards {
+		if balance >= amount {
+			candidates = append(candidates, i)
+		}
+		total += balance
+	}
+	if len(candidates) > 0 {
+		return candidates[rand.Intn(len(candidates))], nil
+	}
+	if main < amount && total >= amount {
+		if err := collectShards(ctx, dbSvc, tenantID, accountID, shards); err != nil {
+			return noShard, err
+		}
+	}
+	return noShard, nil
+}
+
+// collectShards moves the positive shard balances read as shards into the
+// account item, each conditioned on the shard being unchanged.
+func collectShards(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string, shards []float64) error {
+	var items []types.TransactWriteItem
+	var total float64
+	for i, balance := range shards {
+		// a transaction holds at most 100 items, one is the account item
+		if balance <= 0 || len(items) == 99 {
+			continue
+		}
+		items = append(items, types.TransactWriteItem{Update: &types.Update{
+			TableName: aws.String(NilUsers),
+			Key: map[string]types.AttributeValue{
+				"TenantID":  &types.AttributeValueMemberS{Value: tenantID},
+				"AccountID": &types.AttributeValueMemberS{Value: shardAccountID(accountID, i)},
+			},
+			UpdateExpression:    aws.String("ADD amount :delta"),
+			ConditionExpression: aws.String("amount = :balance"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":delta":   numberValue(-balance),
+				":balance": numberValue(balance),
+			},
+		}})
+		total += balance
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	items = append(items, types.TransactWriteItem{Update: &types.Update{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantID},
+			"AccountID": &types.AttributeValueMemberS{Value: accountID},
+		},
+		UpdateExpression:    aws.String("ADD amount :delta"),
+		ConditionExpression: aws.String("attribute_exists(AccountID)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":delta": numberValue(total),
+		},
+	}})
+
+	if _, err := dbSvc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items}); err != nil {
+		return fmt.Errorf("failed to collect shards of %s: %w", accountID, err)
+	}
+	return nil
+}
+
+// shardBalanceUpdateItem is shardBalanceUpdate for a standalone UpdateItem call.
+func shardBalanceUpdateItem(input *dynamodb.UpdateItemInput, tenantID, accountID, currency string, delta float64) *dynamodb.UpdateItemInput {
+	update := shardBalanceUpdate(nil, tenantID, accountID, currency, delta)
+	if update == nil {
+		return input
+	}
+	return &dynamodb.UpdateItemInput{
+		TableName:                 update.TableName,
+		Key:                       update.Key,
+		UpdateExpression:          update.UpdateExpression,
+		ConditionExpression:       update.ConditionExpression,
+		ExpressionAttributeValues: update.ExpressionAttributeValues,
+	}
+}
+
+// GetShardedBalance returns the sum of the balances held in the shards of a
+// sharded account, not including the account item itself.
+func GetShardedBalance(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string) (float64, error) {
+	if AccountShards(accountID) == 0 {
+		return 0, nil
+	}
+	_, shards, err := shardBalances(ctx, dbSvc, tenantID, accountID)
+	if err != nil {
+		return 0, err
+	}
+	var total float64
+	for _, balance := range shards {
+		total += balance
+	}
+	return total, nil
+}
+
+// shardBalances reads the balance of the account item of a sharded account and
+// of each of its shards, indexed by shard number.
+func shardBalances(ctx context.Context, dbSvc *dynamodb.Client, tenantID, accountID string) (main float64, shards []float64, err error) {
+	count := AccountShards(accountID)
+	keys := make([]map[string]types.AttributeValue, 0, count+1)
+	index := make(map[string]int, count+1)
+	for i := noShard; i < count; i++ {
+		id := accountID
+		if i != noShard {
+			id = shardAccountID(accountID, i)
+		}
+		index[id] = i
+		keys = append(keys, map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantID},
+			"AccountID": &types.AttributeValueMemberS{Value: id},
+		})
+	}
+
+	shards = make([]float64, count)
+	// BatchGetItem takes at most 100 keys per call
+	for start := 0; start < len(keys); start += 100 {
+		request := map[string]types.KeysAndAttributes{
+			NilUsers: {
+				Keys:                 keys[start:min(start+100, len(keys))],
+				ProjectionExpression: aws.String("AccountID, amount"),
+			},
+		}
+		for len(request) > 0 {
+			result, err := dbSvc.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: request})
+			if err != nil {
+				return 0, nil, fmt.Errorf("failed to read shards of %s: %w", accountID, err)
+			}
+			for _, item := range result.Responses[NilUsers] {
+				var shard struct {
+					AccountID string  `dynamodbav:"AccountID"`
+					Amount    float64 `dynamodbav:"amount"`
+				}
+				if err := attributevalue.UnmarshalMap(item, &shard); err != nil {
+					return 0, nil, fmt.Errorf("failed to unmarshal shard of %s: %w", accountID, err)
+				}
+				if i := index[shard.AccountID]; i == noShard {
+					main = shard.Amount
+				} else {
+					shards[i] = shard.Amount
+				}
+			}
+			request = result.UnprocessedKeys
+		}
+	}
+	return main, shards, nil
+}
@@ -0,0 +1,97 @@
+package ledger
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterShardedAccount(t *testing.T) {
+	assert.Equal(t, DefaultSystemAccountShards, AccountShards(ESCROW_ACCOUNT))
+	assert.Equal(t, 0, AccountShards("249_ACCT_1"))
+
+	RegisterShardedAccount("HOT_ACCOUNT", 4)
+	assert.Equal(t, 4, AccountShards("HOT_ACCOUNT"))
+	RegisterShardedAccount("HOT_ACCOUNT", 0)
+	assert.Equal(t, 0, AccountShards("HOT_ACCOUNT"))
+}
+
+func TestShardBalanceUpdate(t *testing.T) {
+	plain := &types.Update{TableName: aws.String(NilUsers)}
+	assert.Same(t, plain, shardBalanceUpdate(plain, "nil", "249_ACCT_1", DefaultCurrency, 10))
+
+	tests := []struct {
+		name  string
+		delta float64
+		want  string
+	}{
+		{"credit", 10, "10.00"},
+		{"debit", -2.5, "-2.50"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := shardBalanceUpdate(plain, ESCROW_TENANT, ESCROW_ACCOUNT, DefaultCurrency, tt.delta)
+			assert.NotSame(t, plain, update)
+			// shards are opened with the account rather than by a credit
+			assert.Equal(t, "ShardOf = :account", aws.ToString(update.ConditionExpression))
+			accountID := update.Key["AccountID"].(*types.AttributeValueMemberS).Value
+			assert.True(t, strings.HasPrefix(accountID, ESCROW_ACCOUNT+"#"), accountID)
+			assert.Equal(t, tt.want, update.ExpressionAttributeValues[":delta"].(*types.AttributeValueMemberN).Value)
+		})
+	}
+
+	input := &dynamodb.UpdateItemInput{TableName: aws.String(NilUsers)}
+	assert.Same(t, input, shardBalanceUpdateItem(input, "nil", "249_ACCT_1", DefaultCurrency, 10))
+	sharded := shardBalanceUpdateItem(input, ESCROW_TENANT, ESCROW_ACCOUNT, DefaultCurrency, 10)
+	assert.NotSame(t, input, sharded)
+	assert.Equal(t, "ShardOf = :account", aws.ToString(sharded.ConditionExpression))
+}
+
+func TestOpenShardUpdates(t *testing.T) {
+	assert.Empty(t, openShardUpdates("nil", "249_ACCT_1"))
+
+	updates := openShardUpdates("bok", FEE_ACCOUNT)
+	assert.Len(t, updates, DefaultSystemAccountShards)
+	for i, update := range updates {
+		assert.Equal(t, shardAccountID(FEE_ACCOUNT, i), update.Key["AccountID"].(*types.AttributeValueMemberS).Value)
+		assert.Equal(t, "bok", update.Key["TenantID"].(*types.AttributeValueMemberS).Value)
+		assert.Equal(t, FEE_ACCOUNT, update.ExpressionAttributeValues[":account"].(*types.AttributeValueMemberS).Value)
+		// an open shard keeps its balance
+		assert.Contains(t, aws.ToString(update.UpdateExpression), "amount = if_not_exists(amount, :zero)")
+	}
+}
+
+func TestShardDebitUpdate(t *testing.T) {
+	debit := &types.Update{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: ESCROW_TENANT},
+			"AccountID": &types.AttributeValueMemberS{Value: ESCROW_ACCOUNT},
+		},
+		UpdateExpression:    aws.String("SET amount = amount - :amount, Version = :newVersion"),
+		ConditionExpression: aws.String("Version = :oldVersion"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":amount": &types.AttributeValueMemberN{Value: "5.00"},
+		},
+	}
+
+	// a conditional debit is never sent to a random, possibly empty, shard
+	update := shardBalanceUpdate(debit, ESCROW_TENANT, ESCROW_ACCOUNT, DefaultCurrency, -5)
+	assert.Equal(t, ESCROW_ACCOUNT, update.Key["AccountID"].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, "(Version = :oldVersion) AND amount >= :debit", aws.ToString(update.ConditionExpression))
+	assert.Equal(t, "5.00", update.ExpressionAttributeValues[":debit"].(*types.AttributeValueMemberN).Value)
+	// the caller's update is left alone
+	assert.Equal(t, "Version = :oldVersion", aws.ToString(debit.ConditionExpression))
+	assert.NotContains(t, debit.ExpressionAttributeValues, ":debit")
+
+	update = shardDebitUpdate(debit, ESCROW_TENANT, ESCROW_ACCOUNT, DefaultCurrency, 5, 3)
+	assert.Equal(t, ESCROW_ACCOUNT+"#3", update.Key["AccountID"].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, "amount >= :debit", aws.ToString(update.ConditionExpression))
+	assert.Equal(t, "-5.00", update.ExpressionAttributeValues[":delta"].(*types.AttributeValueMemberN).Value)
+
+	assert.Same(t, debit, shardDebitUpdate(debit, "nil", "249_ACCT_1", DefaultCurrency, 5, noShard))
+}
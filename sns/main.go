@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	_ "embed"
 
@@ -64,12 +65,12 @@ func sendWebhookNotification(transaction ledger.EscrowTransaction) error {
 
 	log.Printf("the transaction after conversion is: %+v", transaction)
 
-	entry, err := ledger.GetServiceProvider(context.TODO(), _dbSvc, transaction.ServiceProvider)
+	entry, err := ledger.ResolveServiceProvider(context.TODO(), _dbSvc, transaction)
 	if err != nil {
 		log.Printf("the error in lambda is: %v", err)
 	}
 	log.Printf("the entry is: %v", entry)
-	if entry.WebhookURL != "" {
+	if entry != nil && entry.WebhookURL != "" {
 		webhookURL = entry.WebhookURL
 	}
 
@@ -86,6 +87,14 @@ func sendWebhookNotification(transaction ledger.EscrowTransaction) error {
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Signature", nilSignature)
+	if entry != nil {
+		now := time.Now()
+		if keys := entry.WebhookSigningKeys(now); len(keys) > 0 {
+			timestamp, signature := ledger.SignWebhook(keys, payload, now)
+			req.Header.Set(ledger.WebhookTimestampHeader, timestamp)
+			req.Header.Set(ledger.WebhookSignatureHeader, signature)
+		}
+	}
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
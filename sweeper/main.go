@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/adonese/ledger"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+)
+
+// sweeperActor identifies this lambda in escrow transition histories.
+const sweeperActor = "escrow_sweeper"
+
+var _dbSvc *dynamodb.Client
+var _snsSvc *sns.Client
+
+func publishToSNSTopic(transaction ledger.EscrowTransaction) error {
+	message, err := json.Marshal(transaction)
+	if err != nil {
+		return err
+	}
+
+	input := &sns.PublishInput{
+		Message:  aws.String(string(message)),
+		TopicArn: aws.String(ledger.SNS_TOPIC),
+	}
+
+	_, err = _snsSvc.Publish(context.TODO(), input)
+	return err
+}
+
+// handleSweep refunds every escrow whose cashout provider did not settle it in
+// time and recovers QR codes stuck mid-payment. It runs on a schedule; each
+// escrow is handled independently so one failure does not block the rest.
+func handleSweep(ctx context.Context, event events.CloudWatchEvent) error {
+	expired, err := ledger.ExpiredEscrows(ctx, _dbSvc, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Printf("found %d expired escrows", len(expired))
+
+	var failed int
+	for _, transaction := range expired {
+		esTransaction, err := ledger.ExpireEscrow(ctx, _dbSvc, transaction, sweeperActor)
+		if err != nil {
+			log.Printf("failed to expire escrow %s: %v", transaction.SystemTransactionID, err)
+			failed++
+			if esTransaction.Status != ledger.StatusExpired {
+				continue
+			}
+			// refunded, only cancelling the provider's payout failed
+		}
+
+		if err := publishToSNSTopic(esTransaction); err != nil {
+			log.Printf("failed to publish to SNS topic: %v", err)
+		}
+	}
+
+	if err := recoverQRPayments(ctx); err != nil {
+		log.Printf("failed to recover QR payments: %v", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to expire %d of %d escrows", failed, len(expired))
+	}
+	return nil
+}
+
+// recoverQRPayments settles the QR codes a crashed payment left PROCESSING.
+func recoverQRPayments(ctx context.Context) error {
+	stuck, err := ledger.StuckQRPayments(ctx, _dbSvc, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Printf("found %d stuck QR payments", len(stuck))
+
+	for _, qrPayment := range stuck {
+		status, err := ledger.RecoverQRPayment(ctx, _dbSvc, qrPayment)
+		if err != nil {
+			log.Printf("failed to recover QR payment %s: %v", qrPayment.PaymentID, err)
+			continue
+		}
+		log.Printf("QR payment %s recovered as %s", qrPayment.PaymentID, status)
+	}
+	return nil
+}
+
+func init() {
+	log.Println("The escrow sweeper is launched")
+
+	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion("us-east-1"))
+	if err != nil {
+		log.Fatalf("unable to load SDK config, %v", err)
+	}
+
+	_dbSvc = dynamodb.NewFromConfig(cfg)
+	_snsSvc = sns.NewFromConfig(cfg)
+}
+
+func main() {
+	lambda.Start(handleSweep)
+}
@@ -0,0 +1,383 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const TenantsTable = "Tenants"
+
+var (
+	ErrTenantExists   = errors.New("tenant already exists")
+	ErrTenantNotFound = errors.New("tenant not found")
+	ErrTenantInactive = errors.New("tenant is not active")
+	ErrTenantLimit    = errors.New("amount is outside the tenant's transfer limits")
+)
+
+// TenantStatus is the lifecycle state of a tenant.
+type TenantStatus string
+
+const (
+	TenantActive    TenantStatus = "active"
+	TenantSuspended TenantStatus = "suspended"
+	TenantClosed    TenantStatus = "closed"
+)
+
+func (s TenantStatus) valid() bool {
+	switch s {
+	case TenantActive, TenantSuspended, TenantClosed:
+		return true
+	}
+	return false
+}
+
+// TenantLimits caps the amounts a tenant's accounts may move. A zero limit is
+// unbounded. MinTransfer and MaxTransfer bound every transfer and escrow the
+// tenant sends; DailyTransfer and MaxBalance are recorded for reporting only
+// and are not enforced.
+type TenantLimits struct {
+	MinTransfer   float64 `dynamodbav:"MinTransfer,omitempty" json:"min_transfer,omitempty"`
+	MaxTransfer   float64 `dynamodbav:"MaxTransfer,omitempty" json:"max_transfer,omitempty"`
+	DailyTransfer float64 `dynamodbav:"DailyTransfer,omitempty" json:"daily_transfer,omitempty"`
+	MaxBalance    float64 `dynamodbav:"MaxBalance,omitempty" json:"max_balance,omitempty"`
+}
+
+func (l TenantLimits) validate() error {
+	if l.MinTransfer < 0 || l.MaxTransfer < 0 || l.DailyTransfer < 0 || l.MaxBalance < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if l.MaxTransfer > 0 && l.MinTransfer > l.MaxTransfer {
+		return fmt.Errorf("min transfer %.2f is above max transfer %.2f", l.MinTransfer, l.MaxTransfer)
+	}
+	if l.DailyTransfer > 0 && l.MaxTransfer > l.DailyTransfer {
+		return fmt.Errorf("max transfer %.2f is above the daily limit %.2f", l.MaxTransfer, l.DailyTransfer)
+	}
+	return nil
+}
+
+// CheckTransfer fails when the tenant may not send amount in one transfer: it
+// is not active or amount is outside its MinTransfer and MaxTransfer.
+func (t Tenant) CheckTransfer(amount float64) error {
+	if err := t.checkActive(); err != nil {
+		return err
+	}
+	if t.Limits.MinTransfer > 0 && amount < t.Limits.MinTransfer {
+		return fmt.Errorf("%w: minimum transfer of %s is %.2f", ErrTenantLimit, t.TenantID, t.Limits.MinTransfer)
+	}
+	if t.Limits.MaxTransfer > 0 && amount > t.Limits.MaxTransfer {
+		return fmt.Errorf("%w: maximum transfer of %s is %.2f", ErrTenantLimit, t.TenantID, t.Limits.MaxTransfer)
+	}
+	return nil
+}
+
+func (t Tenant) checkActive() error {
+	if t.Status != "" && t.Status != TenantActive {
+		return fmt.Errorf("%w: %s is %s", ErrTenantInactive, t.TenantID, t.Status)
+	}
+	return nil
+}
+
+// FeePlan is the fee a tenant charges on escrows by default. Onboarding copies
+// it into every corridor that does not set a fee of its own. Like corridor
+// fees, it is kept when an escrow is refunded.
+type FeePlan struct {
+	Fee          float64       `dynamodbav:"Fee,omitempty" json:"fee,omitempty"`
+	FeeRate      float64       `dynamodbav:"FeeRate,omitempty" json:"fee_rate,omitempty"`
+	RevenueShare *RevenueShare `dynamodbav:"RevenueShare,omitempty" json:"revenue_share,omitempty"`
+}
+
+// apply returns corridors with the plan filled into those without a fee.
+func (p FeePlan) apply(corridors []EscrowCorridor) []EscrowCorridor {
+	planned := make([]EscrowCorridor, len(corridors))
+	for i, c := range corridors {
+		if c.Fee == 0 && c.FeeRate == 0 {
+			c.Fee, c.FeeRate = p.Fee, p.FeeRate
+			if c.RevenueShare == nil {
+				c.RevenueShare = p.RevenueShare
+			}
+		}
+		planned[i] = c
+	}
+	return planned
+}
+
+// Tenant is an item of TenantsTable. Tenants that predate the registry only
+// exist as the TenantID of their accounts, "nil" being the default one.
+type Tenant struct {
+	TenantID string       `dynamodbav:"TenantID" json:"tenant_id"`
+	Name     string       `dynamodbav:"Name" json:"name"`
+	Status   TenantStatus `dynamodbav:"Status" json:"status"`
+	// Currency is the default currency of the tenant's accounts.
+	Currency string       `dynamodbav:"Currency" json:"currency"`
+	Limits   TenantLimits `dynamodbav:"Limits" json:"limits"`
+	FeePlan  FeePlan      `dynamodbav:"FeePlan" json:"fee_plan"`
+	Webhook  string       `dynamodbav:"Webhook,omitempty" json:"webhook,omitempty"`
+	// EscrowAccount receives the escrows paid out to the tenant.
+	EscrowAccount string `dynamodbav:"EscrowAccount" json:"escrow_account"`
+	CreatedAt     string `dynamodbav:"CreatedAt" json:"created_at"`
+	UpdatedAt     string `dynamodbav:"UpdatedAt" json:"updated_at"`
+}
+
+// TenantOnboarding is everything OnboardTenant needs to set up a tenant.
+type TenantOnboarding struct {
+	Tenant         Tenant           `json:"tenant"`
+	AllowedTenants []string         `json:"allowed_tenants,omitempty"`
+	Corridors      []EscrowCorridor `json:"corridors,omitempty"`
+	// ProviderEmail identifies the tenant's ServiceProvider record.
+	ProviderEmail string `json:"provider_email"`
+	PublicKey     string `json:"public_key,omitempty"`
+	TailscaleURL  string `json:"tailscale_url,omitempty"`
+}
+
+// tenantSystemAccounts are the accounts onboarding opens in every tenant,
+// besides its escrow account.
+var tenantSystemAccounts = []string{FEE_ACCOUNT, TREASURY_ACCOUNT}
+
+// OnboardTenant registers a tenant together with its system accounts, its
+// EscrowMeta and its ServiceProvider record in one transaction, so either all
+// of them exist afterwards or none does. System accounts that already exist,
+// as they do for tenants predating the registry, are left untouched.
+func OnboardTenant(ctx context.Context, dbSvc *dynamodb.Client, req TenantOnboarding) (*Tenant, error) {
+	items, tenant, err := onboardingItems(req, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = dbSvc.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err != nil {
+		var canceled *types.TransactionCanceledException
+		if errors.As(err, &canceled) && len(canceled.CancellationReasons) == len(items) {
+			if aws.ToString(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+				return nil, fmt.Errorf("%w: %s", ErrTenantExists, tenant.TenantID)
+			}
+			if aws.ToString(canceled.CancellationReasons[len(items)-2].Code) == "ConditionalCheckFailed" {
+				return nil, fmt.Errorf("escrow meta of tenant %s already exists", tenant.TenantID)
+			}
+			if aws.ToString(canceled.CancellationReasons[len(items)-1].Code) == "ConditionalCheckFailed" {
+				return nil, fmt.Errorf("service provider with Email %s already exists", req.ProviderEmail)
+			}
+		}
+		return nil, fmt.Errorf("failed to onboard tenant %s: %w", tenant.TenantID, err)
+	}
+	return &tenant, nil
+}
+
+// onboardingItems validates req and builds the items of OnboardTenant: the
+// tenant, its system and escrow accounts with their balance shards, its
+// EscrowMeta and, last, its ServiceProvider.
+func onboardingItems(req TenantOnboarding, now time.Time) ([]types.TransactWriteItem, Tenant, error) {
+	tenant := req.Tenant
+	if tenant.TenantID == "" || tenant.Name == "" {
+		return nil, tenant, fmt.Errorf("tenantID and name are required")
+	}
+	if tenant.EscrowAccount == "" {
+		return nil, tenant, fmt.Errorf("escrowAccount is required")
+	}
+	if slices.Contains(tenantSystemAccounts, tenant.EscrowAccount) {
+		return nil, tenant, fmt.Errorf("escrowAccount may not be the system account %s", tenant.EscrowAccount)
+	}
+	if req.ProviderEmail == "" {
+		return nil, tenant, fmt.Errorf("provider email is required")
+	}
+	if tenant.Currency == "" {
+		tenant.Currency = DefaultCurrency
+	}
+	if _, err := GetCurrency(tenant.Currency); err != nil {
+		return nil, tenant, err
+	}
+	if tenant.Status == "" {
+		tenant.Status = TenantActive
+	}
+	if !tenant.Status.valid() {
+		return nil, tenant, fmt.Errorf("invalid tenant status %q", tenant.Status)
+	}
+	if err := tenant.Limits.validate(); err != nil {
+		return nil, tenant, err
+	}
+	if tenant.FeePlan.RevenueShare != nil {
+		if err := tenant.FeePlan.RevenueShare.Validate(); err != nil {
+			return nil, tenant, fmt.Errorf("fee plan: %w", err)
+		}
+	}
+	tenant.CreatedAt = now.UTC().Format(time.RFC3339)
+	tenant.UpdatedAt = tenant.CreatedAt
+
+	meta := EscrowMeta{
+		TenantID:       tenant.TenantID,
+		Webhook:        tenant.Webhook,
+		AllowedTenants: req.AllowedTenants,
+		Currency:       tenant.Currency,
+		Corridors:      tenant.FeePlan.apply(req.Corridors),
+	}
+	if err := meta.validate(); err != nil {
+		return nil, tenant, err
+	}
+	signingKey, err := newWebhookSigningKey()
+	if err != nil {
+		return nil, tenant, err
+	}
+	provider := ServiceProvider{
+		TenantID:          tenant.TenantID,
+		WebhookURL:        tenant.Webhook,
+		TailscaleURL:      req.TailscaleURL,
+		LastAccessed:      tenant.CreatedAt,
+		Currency:          tenant.Currency,
+		PublicKey:         req.PublicKey,
+		Email:             req.ProviderEmail,
+		EscrowAccount:     tenant.EscrowAccount,
+		WebhookSigningKey: signingKey,
+	}
+
+	tenantItem, err := attributevalue.MarshalMap(tenant)
+	if err != nil {
+		return nil, tenant, fmt.Errorf("failed to marshal tenant: %w", err)
+	}
+	metaItem, err := attributevalue.MarshalMap(meta)
+	if err != nil {
+		return nil, tenant, fmt.Errorf("failed to marshal escrow meta: %w", err)
+	}
+	providerItem, err := attributevalue.MarshalMap(provider)
+	if err != nil {
+		return nil, tenant, fmt.Errorf("failed to marshal service provider: %w", err)
+	}
+
+	items := []types.TransactWriteItem{{
+		Put: &types.Put{
+			TableName:           aws.String(TenantsTable),
+			Item:                tenantItem,
+			ConditionExpression: aws.String("attribute_not_exists(TenantID)"),
+		},
+	}}
+	for _, accountID := range append(slices.Clone(tenantSystemAccounts), tenant.EscrowAccount) {
+		items = append(items, types.TransactWriteItem{Update: openAccountUpdate(tenant.TenantID, accountID, tenant.Currency, now)})
+		for _, update := range openShardUpdates(tenant.TenantID, accountID) {
+			items = append(items, types.TransactWriteItem{Update: update})
+		}
+	}
+	items = append(items,
+		types.TransactWriteItem{Put: &types.Put{
+			TableName:           aws.String(EscrowMetaTable),
+			Item:                metaItem,
+			ConditionExpression: aws.String("attribute_not_exists(TenantID)"),
+		}},
+		types.TransactWriteItem{Put: &types.Put{
+			TableName:           aws.String(ServiceProvidersTable),
+			Item:                providerItem,
+			ConditionExpression: aws.String("attribute_not_exists(Email)"),
+		}},
+	)
+	return items, tenant, nil
+}
+
+// openAccountUpdate creates an empty account in currency unless the account
+// already exists, in which case it is left as it is.
+func openAccountUpdate(tenantID, accountID, currency string, now time.Time) *types.Update {
+	return &types.Update{
+		TableName: aws.String(NilUsers),
+		Key: map[string]types.AttributeValue{
+			"TenantID":  &types.AttributeValueMemberS{Value: tenantID},
+			"AccountID": &types.AttributeValueMemberS{Value: accountID},
+		},
+		UpdateExpression: aws.String("SET full_name = if_not_exists(full_name, :name), amount = if_not_exists(amount, :zero)," +
+			" currency = if_not_exists(currency, :currency), is_verified = if_not_exists(is_verified, :verified)," +
+			" created_at = if_not_exists(created_at, :createdAt), Version = if_not_exists(Version, :version)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":name":      &types.AttributeValueMemberS{Value: accountID},
+			":zero":      &types.AttributeValueMemberN{Value: "0"},
+			":currency":  &types.AttributeValueMemberS{Value: currency},
+			":verified":  &types.AttributeValueMemberBOOL{Value: true},
+			":createdAt": &types.AttributeValueMemberS{Value: now.Local().String()},
+			":version":   &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UTC().Unix(), 10)},
+		},
+	}
+}
+
+// GetTenant returns a registered tenant.
+func GetTenant(ctx context.Context, dbSvc *dynamodb.Client, tenantID string) (*Tenant, error) {
+	result, err := dbSvc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(TenantsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: tenantID},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tenant: %w", err)
+	}
+	if result.Item == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTenantNotFound, tenantID)
+	}
+	var tenant Tenant
+	if err := attributevalue.UnmarshalMap(result.Item, &tenant); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tenant: %w", err)
+	}
+	return &tenant, nil
+}
+
+// SetTenantStatus moves a registered tenant to status.
+func SetTenantStatus(ctx context.Context, dbSvc *dynamodb.Client, tenantID string, status TenantStatus) error {
+	if !status.valid() {
+		return fmt.Errorf("invalid tenant status %q", status)
+	}
+	_, err := dbSvc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(TenantsTable),
+		Key: map[string]types.AttributeValue{
+			"TenantID": &types.AttributeValueMemberS{Value: tenantID},
+		},
+		UpdateExpression:         aws.String("SET #status = :status, UpdatedAt = :updatedAt"),
+		ConditionExpression:      aws.String("attribute_exists(TenantID)"),
+		ExpressionAttributeNames: map[string]string{"#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status":    &types.AttributeValueMemberS{Value: string(status)},
+			":updatedAt": &types.AttributeValueMemberS{Value: getCurrentTimeZone()},
+		},
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return fmt.Errorf("%w: %s", ErrTenantNotFound, tenantID)
+		}
+		return fmt.Errorf("failed to update tenant %s: %w", tenantID, err)
+	}
+	return nil
+}
+
+// checkTenantTransfer fails when the registered tenant fromTenantID may not
+// send amount, or toTenantID may not receive it. Tenants predating the
+// registry are not restricted.
+func checkTenantTransfer(ctx context.Context, dbSvc *dynamodb.Client, fromTenantID, toTenantID string, amount float64) error {
+	from, err := GetTenant(ctx, dbSvc, fromTenantID)
+	if err == nil {
+		err = from.CheckTransfer(amount)
+	}
+	if err != nil && !errors.Is(err, ErrTenantNotFound) {
+		return err
+	}
+	if toTenantID == fromTenantID {
+		return nil
+	}
+	to, err := GetTenant(ctx, dbSvc, toTenantID)
+	if err == nil {
+		err = to.checkActive()
+	}
+	if err != nil && !errors.Is(err, ErrTenantNotFound) {
+		return err
+	}
+	return nil
+}
+
+// tenantTransferCode is the response code of a checkTenantTransfer failure.
+func tenantTransferCode(err error) string {
+	if errors.Is(err, ErrTenantInactive) {
+		return "tenant_inactive"
+	}
+	return "limit_exceeded"
+}
@@ -0,0 +1,137 @@
+package ledger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnboardingItems(t *testing.T) {
+	share := &RevenueShare{FromShare: 0.5, PlatformShare: 0.5}
+	req := TenantOnboarding{
+		Tenant: Tenant{
+			TenantID:      "bok",
+			Name:          "Bank of Khartoum",
+			FeePlan:       FeePlan{Fee: 2, RevenueShare: share},
+			Webhook:       "https://bok.example/webhook",
+			EscrowAccount: "0912141679",
+		},
+		AllowedTenants: []string{"nil"},
+		Corridors: []EscrowCorridor{
+			{ToTenantID: "nil"},
+			{ToTenantID: "cashi", FeeRate: 0.01},
+		},
+		ProviderEmail: "ops@bok.example",
+	}
+
+	items, tenant, err := onboardingItems(req, time.Unix(1700000000, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, TenantActive, tenant.Status)
+	assert.Equal(t, DefaultCurrency, tenant.Currency)
+	assert.Equal(t, "2023-11-14T22:13:20Z", tenant.CreatedAt)
+
+	// tenant, FEE_ACCOUNT and TREASURY_ACCOUNT each with their shards, escrow
+	// account, meta, provider
+	shards := DefaultSystemAccountShards
+	assert.Len(t, items, 6+2*shards)
+	assert.Equal(t, TenantsTable, aws.ToString(items[0].Put.TableName))
+	assert.Equal(t, "attribute_not_exists(TenantID)", aws.ToString(items[0].Put.ConditionExpression))
+	for i, account := range []string{FEE_ACCOUNT, TREASURY_ACCOUNT, "0912141679"} {
+		update := items[1+i*(shards+1)].Update
+		assert.Equal(t, NilUsers, aws.ToString(update.TableName))
+		assert.Equal(t, account, update.Key["AccountID"].(*types.AttributeValueMemberS).Value)
+		assert.Equal(t, "bok", update.Key["TenantID"].(*types.AttributeValueMemberS).Value)
+		assert.Contains(t, aws.ToString(update.UpdateExpression), "amount = if_not_exists(amount, :zero)")
+	}
+	for i := 0; i < shards; i++ {
+		update := items[3+shards+i].Update
+		assert.Equal(t, shardAccountID(TREASURY_ACCOUNT, i), update.Key["AccountID"].(*types.AttributeValueMemberS).Value)
+		assert.Equal(t, TREASURY_ACCOUNT, update.ExpressionAttributeValues[":account"].(*types.AttributeValueMemberS).Value)
+	}
+	meta, provider := items[len(items)-2], items[len(items)-1]
+	assert.Equal(t, EscrowMetaTable, aws.ToString(meta.Put.TableName))
+	assert.Equal(t, "attribute_not_exists(TenantID)", aws.ToString(meta.Put.ConditionExpression))
+	assert.Equal(t, "ops@bok.example", provider.Put.Item["Email"].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, "0912141679", provider.Put.Item["EscrowAccount"].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, "https://bok.example/webhook", provider.Put.Item["WebhookURL"].(*types.AttributeValueMemberS).Value)
+	assert.Regexp(t, "^whsec_[0-9a-f]{64}$", provider.Put.Item["WebhookSigningKey"].(*types.AttributeValueMemberS).Value)
+}
+
+func TestOnboardingItemsInvalid(t *testing.T) {
+	valid := TenantOnboarding{
+		Tenant:        Tenant{TenantID: "bok", Name: "Bank of Khartoum", EscrowAccount: "0912141679"},
+		ProviderEmail: "ops@bok.example",
+	}
+	tests := []struct {
+		name   string
+		modify func(*TenantOnboarding)
+	}{
+		{"missing tenant id", func(r *TenantOnboarding) { r.Tenant.TenantID = "" }},
+		{"missing escrow account", func(r *TenantOnboarding) { r.Tenant.EscrowAccount = "" }},
+		{"system escrow account", func(r *TenantOnboarding) { r.Tenant.EscrowAccount = FEE_ACCOUNT }},
+		{"missing provider email", func(r *TenantOnboarding) { r.ProviderEmail = "" }},
+		{"unsupported currency", func(r *TenantOnboarding) { r.Tenant.Currency = "XYZ" }},
+		{"invalid status", func(r *TenantOnboarding) { r.Tenant.Status = "pending" }},
+		{"min above max", func(r *TenantOnboarding) { r.Tenant.Limits = TenantLimits{MinTransfer: 10, MaxTransfer: 5} }},
+		{"invalid fee plan", func(r *TenantOnboarding) {
+			r.Tenant.FeePlan.RevenueShare = &RevenueShare{FromShare: 0.5}
+		}},
+		{"invalid corridor", func(r *TenantOnboarding) {
+			r.Corridors = []EscrowCorridor{{ToTenantID: "nil", MinAmount: 10, MaxAmount: 5}}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid
+			tt.modify(&req)
+			_, _, err := onboardingItems(req, time.Now())
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestFeePlanApply(t *testing.T) {
+	share := &RevenueShare{ToShare: 1}
+	plan := FeePlan{Fee: 1, FeeRate: 0.02, RevenueShare: share}
+	corridors := []EscrowCorridor{
+		{ToTenantID: "nil"},
+		{ToTenantID: "bok", Fee: 5},
+	}
+
+	planned := plan.apply(corridors)
+	assert.Equal(t, EscrowCorridor{ToTenantID: "nil", Fee: 1, FeeRate: 0.02, RevenueShare: share}, planned[0])
+	assert.Equal(t, EscrowCorridor{ToTenantID: "bok", Fee: 5}, planned[1])
+	// the caller's corridors are not modified
+	assert.Equal(t, EscrowCorridor{ToTenantID: "nil"}, corridors[0])
+}
+
+func TestTenantCheckTransfer(t *testing.T) {
+	limits := TenantLimits{MinTransfer: 10, MaxTransfer: 1000, DailyTransfer: 1500}
+	tests := []struct {
+		name   string
+		tenant Tenant
+		amount float64
+		err    error
+	}{
+		{"within limits", Tenant{TenantID: "bok", Status: TenantActive, Limits: limits}, 500, nil},
+		{"at the maximum", Tenant{TenantID: "bok", Status: TenantActive, Limits: limits}, 1000, nil},
+		{"below the minimum", Tenant{TenantID: "bok", Status: TenantActive, Limits: limits}, 5, ErrTenantLimit},
+		{"above the maximum", Tenant{TenantID: "bok", Status: TenantActive, Limits: limits}, 1000.01, ErrTenantLimit},
+		{"unbounded", Tenant{TenantID: "bok", Status: TenantActive}, 1e9, nil},
+		{"suspended", Tenant{TenantID: "bok", Status: TenantSuspended}, 100, ErrTenantInactive},
+		{"closed", Tenant{TenantID: "bok", Status: TenantClosed}, 100, ErrTenantInactive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.tenant.CheckTransfer(tt.amount)
+			if tt.err == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
@@ -347,6 +347,16 @@ resource "aws_dynamodb_table" "qr_payments_table" {
     type = "S"
   }
 
+  attribute {
+    name = "ParentPaymentID"
+    type = "S"
+  }
+
+  attribute {
+    name = "CreatorAccountID"
+    type = "S"
+  }
+
   global_secondary_index {
     name               = "UUIDIndex"
     hash_key           = "TenantID"
@@ -373,9 +383,149 @@ resource "aws_dynamodb_table" "qr_payments_table" {
     read_capacity      = 5
     write_capacity     = 5
   }
+
+  global_secondary_index {
+    name               = "ParentPaymentIDIndex"
+    hash_key           = "TenantID"
+    range_key          = "ParentPaymentID"
+    projection_type    = "ALL"
+    read_capacity      = 5
+    write_capacity     = 5
+  }
+
+  global_secondary_index {
+    name               = "CreatorAccountIDIndex"
+    hash_key           = "TenantID"
+    range_key          = "CreatorAccountID"
+    projection_type    = "ALL"
+    read_capacity      = 5
+    write_capacity     = 5
+  }
+}
+
+
+# public keys tenants sign their QR payloads with
+resource "aws_dynamodb_table" "tenant_keys" {
+  name           = "TenantKeys"
+  billing_mode   = "PROVISIONED"
+  read_capacity  = 5
+  write_capacity = 5
+  hash_key       = "TenantID"
+
+  attribute {
+    name = "TenantID"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "exchange_rates" {
+  name           = "ExchangeRates"
+  billing_mode   = "PROVISIONED"
+  read_capacity  = 5
+  write_capacity = 5
+  hash_key       = "Pair"
+
+  attribute {
+    name = "Pair"
+    type = "S"
+  }
 }
 
+resource "aws_dynamodb_table" "rate_quotes" {
+  name           = "RateQuotes"
+  billing_mode   = "PROVISIONED"
+  read_capacity  = 5
+  write_capacity = 5
+  hash_key       = "QuoteID"
 
+  attribute {
+    name = "QuoteID"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "ExpiresAt"
+    enabled        = true
+  }
+}
+
+resource "aws_dynamodb_table" "settlements" {
+  name           = "Settlements"
+  billing_mode   = "PROVISIONED"
+  read_capacity  = 5
+  write_capacity = 5
+  hash_key       = "SettlementID"
+
+  attribute {
+    name = "SettlementID"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "tenants" {
+  name           = "Tenants"
+  billing_mode   = "PROVISIONED"
+  read_capacity  = 5
+  write_capacity = 5
+  hash_key       = "TenantID"
+
+  attribute {
+    name = "TenantID"
+    type = "S"
+  }
+}
+
+# disputes raised against InProgress escrows, keyed by the escrow's TransactionID
+resource "aws_dynamodb_table" "escrow_disputes" {
+  name           = "EscrowDisputes"
+  billing_mode   = "PROVISIONED"
+  read_capacity  = 5
+  write_capacity = 5
+  hash_key       = "TransactionID"
+  range_key      = "DisputeID"
+
+  attribute {
+    name = "TransactionID"
+    type = "S"
+  }
+
+  attribute {
+    name = "DisputeID"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "escrow_idempotency_keys" {
+  name           = "EscrowIdempotencyKeys"
+  billing_mode   = "PROVISIONED"
+  read_capacity  = 5
+  write_capacity = 5
+  hash_key       = "UUID"
+
+  attribute {
+    name = "UUID"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "escrow_payment_references" {
+  name           = "EscrowPaymentReferences"
+  billing_mode   = "PROVISIONED"
+  read_capacity  = 5
+  write_capacity = 5
+  hash_key       = "ServiceProvider"
+  range_key      = "PaymentReference"
+
+  attribute {
+    name = "ServiceProvider"
+    type = "S"
+  }
+
+  attribute {
+    name = "PaymentReference"
+    type = "S"
+  }
+}
 
 # Escrow data 
 resource "aws_dynamodb_table" "escrow_meta" {
@@ -449,6 +599,17 @@ resource "aws_dynamodb_table" "escrow_transactions" {
     name = "ToTenantID"
     type = "S"
   }
+
+  attribute {
+    name = "ServiceProvider"
+    type = "S"
+  }
+
+  attribute {
+    name = "PaymentReference"
+    type = "S"
+  }
+
   global_secondary_index {
     name               = "FromAccountIndex"
     hash_key           = "UUID"
@@ -504,6 +665,16 @@ resource "aws_dynamodb_table" "escrow_transactions" {
     write_capacity     = 7
   }
 
+  # escrows created before EscrowPaymentReferences recorded their reference
+  global_secondary_index {
+    name               = "PaymentReferenceIndex"
+    hash_key           = "ServiceProvider"
+    range_key          = "PaymentReference"
+    projection_type    = "ALL"
+    read_capacity      = 7
+    write_capacity     = 7
+  }
+
   stream_enabled = true
   stream_view_type = "NEW_AND_OLD_IMAGES"
 
@@ -730,6 +901,35 @@ resource "aws_lambda_function" "webhook_notifier" {
   source_code_hash = filebase64sha256("sns/bootstrap.zip")
 }
 
+# refunds escrows that external cashout providers did not settle in time
+resource "aws_lambda_function" "escrow_sweeper" {
+  filename         = "sweeper/bootstrap.zip"
+  function_name    = "escrow_sweeper"
+  role             = aws_iam_role.lambda_exec_role.arn
+  handler          = "bootstrap"
+  runtime          = "provided.al2023"
+  timeout          = 300
+  source_code_hash = filebase64sha256("sweeper/bootstrap.zip")
+}
+
+resource "aws_cloudwatch_event_rule" "escrow_sweeper_schedule" {
+  name                = "escrow-sweeper-schedule"
+  schedule_expression = "rate(15 minutes)"
+}
+
+resource "aws_cloudwatch_event_target" "escrow_sweeper_target" {
+  rule = aws_cloudwatch_event_rule.escrow_sweeper_schedule.name
+  arn  = aws_lambda_function.escrow_sweeper.arn
+}
+
+resource "aws_lambda_permission" "allow_escrow_sweeper_schedule" {
+  statement_id  = "AllowExecutionFromEventBridge"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.escrow_sweeper.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.escrow_sweeper_schedule.arn
+}
+
 
 resource "aws_dynamodb_table" "service_providers" {
   name           = "ServiceProviders"
@@ -742,6 +942,33 @@ resource "aws_dynamodb_table" "service_providers" {
     name = "Email"
     type = "S"
   }
+
+  attribute {
+    name = "TenantID"
+    type = "S"
+  }
+
+  attribute {
+    name = "EscrowAccount"
+    type = "S"
+  }
+
+  global_secondary_index {
+    name               = "TenantIDIndex"
+    hash_key           = "TenantID"
+    projection_type    = "ALL"
+    read_capacity      = 7
+    write_capacity     = 7
+  }
+
+  global_secondary_index {
+    name               = "EscrowAccountIndex"
+    hash_key           = "EscrowAccount"
+    range_key          = "TenantID"
+    projection_type    = "ALL"
+    read_capacity      = 7
+    write_capacity     = 7
+  }
 }
 
 
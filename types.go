@@ -12,6 +12,10 @@ import (
 
 const SNS_TOPIC = "arn:aws:sns:us-east-1:767397764981:TransactionNotifications"
 
+// DefaultCurrency is the currency of accounts created without one, and of
+// accounts stored before currencies were recorded.
+const DefaultCurrency = "SDG"
+
 // SMS defines the structure for sending SMS notifications.
 // It includes the API key, sender information, recipient mobile number, message content,
 // and the SMS gateway URL.
@@ -52,9 +56,11 @@ type User struct {
 	Amount            float64 `dynamodbav:"amount" json:"amount,omitempty"`
 	Currency          string  `dynamodbav:"currency" json:"currency,omitempty"`
 	Version           int64   `dynamodbav:"Version" json:"version,omitempty"`
-	PublicKey         string  `json:"public_key,omitempty"`
-	TenantID          string  `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
-	Email             string  `dynamodbav:"Email" json:"email,omitempty"`
+	// ShardOf names the sharded account a balance shard item belongs to.
+	ShardOf   string `dynamodbav:"ShardOf,omitempty" json:"-"`
+	PublicKey string `json:"public_key,omitempty"`
+	TenantID  string `dynamodbav:"TenantID" json:"tenant_id,omitempty"`
+	Email     string `dynamodbav:"Email" json:"email,omitempty"`
 }
 
 func NewDefaultAccount(accountId, mobileNumber, name, pubkey, tenantId string) User {
@@ -76,7 +82,7 @@ func NewDefaultAccount(accountId, mobileNumber, name, pubkey, tenantId string) U
 		IDNumber:          "",
 		PicIDCard:         "",
 		Amount:            0,
-		Currency:          "SDG",
+		Currency:          DefaultCurrency,
 		TenantID:          tenantId,
 	}
 }
@@ -113,6 +119,8 @@ type TransactionEntry struct {
 	InitiatorUUID       string  `dynamodbav:"UUID" json:"uuid,omitempty"`
 	Timestamp           string  `dynamodbav:"timestamp" json:"timestamp,omitempty"`
 	SignedUUID          string  `dynamodbav:"signed_uuid" json:"signed_uuid,omitempty"`
+	SettlementID        string  `dynamodbav:"SettlementID,omitempty" json:"settlement_id,omitempty"`
+	Currency            string  `dynamodbav:"Currency,omitempty" json:"currency,omitempty"`
 }
 
 // Create a new transacton entry and populate it with default time and status of 1, using the current time.
@@ -169,6 +177,10 @@ type data struct {
 	Amount        float64 `json:"amount,omitempty"`
 	SignedUUID    string  `json:"signed_uuid,omitempty"`
 	Currency      string  `json:"currency,omitempty"`
+	// set by conversion transfers
+	ToCurrency      string  `json:"to_currency,omitempty"`
+	ConvertedAmount float64 `json:"converted_amount,omitempty"`
+	Rate            float64 `json:"rate,omitempty"`
 }
 
 type Beneficiary struct {
@@ -180,32 +192,44 @@ type Beneficiary struct {
 	BranchName string `dynamodbav:"BranchName" json:"branch_name,omitempty"`
 }
 type EscrowTransaction struct {
-	SystemTransactionID string      `dynamodbav:"TransactionID" json:"transaction_id,omitempty"`
-	FromAccount         string      `dynamodbav:"FromAccount" json:"from_account,omitempty"`
-	ToAccount           string      `dynamodbav:"ToAccount" json:"to_account,omitempty"`
-	Amount              float64     `dynamodbav:"Amount" json:"amount"`
-	Comment             string      `dynamodbav:"Comment" json:"comment,omitempty"`
-	TransactionDate     int64       `dynamodbav:"TransactionDate" json:"time,omitempty"`
-	Status              Status      `dynamodbav:"TransactionStatus" json:"status,omitempty"`
-	FromTenantID        string      `dynamodbav:"FromTenantID" json:"from_tenant_id,omitempty"`
-	ToTenantID          string      `dynamodbav:"ToTenantID" json:"to_tenant_id,omitempty"`
-	InitiatorUUID       string      `dynamodbav:"UUID" json:"uuid,omitempty"`
-	Timestamp           string      `dynamodbav:"timestamp" json:"timestamp,omitempty"`
-	SignedUUID          string      `dynamodbav:"signed_uuid" json:"signed_uuid,omitempty"`
-	CashoutProvider     string      `dynamodbav:"CashoutProvider" json:"cashout_provider,omitempty"`
-	Beneficiary         Beneficiary `dynamodbav:"Beneficiary" json:"beneficiary,omitempty"`
-	TransientAccount    string      `dynamodbav:"TransientAccount" json:"transient_account,omitempty"`
-	TransientTenant     string      `dynamodbav:"TransientTenant" json:"transient_tenant,omitempty"`
-	ServiceProvider     string      `dynamodbav:"ServiceProvider" json:"service_provider,omitempty"`
-	PaymentReference    string      `dynamodbav:"PaymentReference" json:"service_provider_transaction_id,omitempty"`
+	SystemTransactionID string             `dynamodbav:"TransactionID" json:"transaction_id,omitempty"`
+	FromAccount         string             `dynamodbav:"FromAccount" json:"from_account,omitempty"`
+	ToAccount           string             `dynamodbav:"ToAccount" json:"to_account,omitempty"`
+	Amount              float64            `dynamodbav:"Amount" json:"amount"`
+	Comment             string             `dynamodbav:"Comment" json:"comment,omitempty"`
+	TransactionDate     int64              `dynamodbav:"TransactionDate" json:"time,omitempty"`
+	Status              Status             `dynamodbav:"TransactionStatus" json:"status,omitempty"`
+	FromTenantID        string             `dynamodbav:"FromTenantID" json:"from_tenant_id,omitempty"`
+	ToTenantID          string             `dynamodbav:"ToTenantID" json:"to_tenant_id,omitempty"`
+	InitiatorUUID       string             `dynamodbav:"UUID" json:"uuid,omitempty"`
+	Timestamp           string             `dynamodbav:"timestamp" json:"timestamp,omitempty"`
+	SignedUUID          string             `dynamodbav:"signed_uuid" json:"signed_uuid,omitempty"`
+	CashoutProvider     string             `dynamodbav:"CashoutProvider" json:"cashout_provider,omitempty"`
+	Beneficiary         Beneficiary        `dynamodbav:"Beneficiary" json:"beneficiary,omitempty"`
+	TransientAccount    string             `dynamodbav:"TransientAccount" json:"transient_account,omitempty"`
+	TransientTenant     string             `dynamodbav:"TransientTenant" json:"transient_tenant,omitempty"`
+	ServiceProvider     string             `dynamodbav:"ServiceProvider,omitempty" json:"service_provider,omitempty"`
+	PaymentReference    string             `dynamodbav:"PaymentReference,omitempty" json:"service_provider_transaction_id,omitempty"`
+	History             []EscrowTransition `dynamodbav:"TransitionHistory,omitempty" json:"transition_history,omitempty"`
+	ExpiresAt           int64              `dynamodbav:"ExpiresAt,omitempty" json:"expires_at,omitempty"`
+	ReleasedAmount      float64            `dynamodbav:"ReleasedAmount,omitempty" json:"released_amount,omitempty"`
+	RefundedAmount      float64            `dynamodbav:"RefundedAmount,omitempty" json:"refunded_amount,omitempty"`
+	Releases            []EscrowRelease    `dynamodbav:"Releases,omitempty" json:"releases,omitempty"`
+	// Fee is charged on top of Amount when the escrow is created and is not
+	// refunded; FeeSplit records how it was shared.
+	Fee      float64   `dynamodbav:"Fee,omitempty" json:"fee,omitempty"`
+	FeeSplit *FeeSplit `dynamodbav:"FeeSplit,omitempty" json:"fee_split,omitempty"`
+	// Currency is the sender's account currency, which the escrow is held and
+	// paid out in.
+	Currency string `dynamodbav:"Currency,omitempty" json:"currency,omitempty"`
 }
 
 type EscrowMeta struct {
-	TenantID           string   `dynamodbav:"TenantID" json:"from_tenant_id,omitempty"`
-	Webhook            string   `dynamodbav:"Webhook" json:"webhook,omitempty"`
-	AllowedTenants     []string `dynamodbav:"AllowedTenants" json:"allowed_tenants,omitempty"`
-	Currency           string   `dynamodbav:"Currency" json:"currency,omitempty"`
-	SupportsConversion bool     `dynamodbav:"SupportsConversion" json:"supports_conversion,omitempty"`
+	TenantID       string           `dynamodbav:"TenantID" json:"from_tenant_id,omitempty"`
+	Webhook        string           `dynamodbav:"Webhook,omitempty" json:"webhook,omitempty"`
+	AllowedTenants []string         `dynamodbav:"AllowedTenants" json:"allowed_tenants,omitempty"`
+	Currency       string           `dynamodbav:"Currency" json:"currency,omitempty"`
+	Corridors      []EscrowCorridor `dynamodbav:"Corridors,omitempty" json:"corridors,omitempty"`
 }
 
 type EscrowEntry struct {
@@ -226,15 +250,26 @@ type EscrowEntry struct {
 }
 
 type ServiceProvider struct {
-	TenantID          string `dynamodbav:"TenantID" json:"tenant_id"`
-	WebhookURL        string `dynamodbav:"WebhookURL" json:"webhook_url"`
-	TailscaleURL      string `dynamodbav:"TailscaleURL" json:"tailscale_url"`
-	LastAccessed      string `dynamodbav:"LastAccessed" json:"last_accessed"`
-	Currency          string `dynamodbav:"Currency" json:"currency"`
-	PublicKey         string `dynamodbav:"PublicKey" json:"public_key"`
-	Email             string `dynamodbav:"Email" json:"email"`
-	EscrowAccount     string `dynamodbav:"EscrowAccount" json:"escrow_account"`
-	WebhookSigningKey string `dynamodbav:"WebhookSigningKey" json:"webhook_signing_key"`
+	TenantID      string `dynamodbav:"TenantID" json:"tenant_id"`
+	WebhookURL    string `dynamodbav:"WebhookURL" json:"webhook_url"`
+	TailscaleURL  string `dynamodbav:"TailscaleURL" json:"tailscale_url"`
+	LastAccessed  string `dynamodbav:"LastAccessed" json:"last_accessed"`
+	Currency      string `dynamodbav:"Currency" json:"currency"`
+	PublicKey     string `dynamodbav:"PublicKey" json:"public_key"`
+	Email         string `dynamodbav:"Email" json:"email"`
+	EscrowAccount string `dynamodbav:"EscrowAccount" json:"escrow_account"`
+	// WebhookSigningKey is generated when the provider is created and never
+	// serialized to JSON; it reaches the provider out of band.
+	WebhookSigningKey string `dynamodbav:"WebhookSigningKey" json:"-"`
+	// PreviousWebhookSigningKey also signs webhooks until
+	// PreviousWebhookKeyExpiresAt (unix seconds); see RotateWebhookSigningKey.
+	PreviousWebhookSigningKey   string `dynamodbav:"PreviousWebhookSigningKey,omitempty" json:"-"`
+	PreviousWebhookKeyExpiresAt int64  `dynamodbav:"PreviousWebhookKeyExpiresAt,omitempty" json:"previous_webhook_key_expires_at,omitempty"`
+	WebhookKeyRotatedAt         string `dynamodbav:"WebhookKeyRotatedAt,omitempty" json:"webhook_key_rotated_at,omitempty"`
+	// Deactivated providers receive no new escrows; see DeactivateServiceProvider.
+	Deactivated        bool   `dynamodbav:"Deactivated,omitempty" json:"deactivated,omitempty"`
+	DeactivatedAt      string `dynamodbav:"DeactivatedAt,omitempty" json:"deactivated_at,omitempty"`
+	DeactivationReason string `dynamodbav:"DeactivationReason,omitempty" json:"deactivation_reason,omitempty"`
 }
 
 // Status represents the status of a transaction
@@ -246,6 +281,8 @@ const (
 	StatusCompleted
 	StatusFailed
 	StatusInProgress
+	StatusExpired
+	StatusDisputed
 )
 
 // Map from string to Status
@@ -254,6 +291,8 @@ var statusStringToEnum = map[string]Status{
 	"Completed":  StatusCompleted,
 	"Failed":     StatusFailed,
 	"InProgress": StatusInProgress,
+	"Expired":    StatusExpired,
+	"Disputed":   StatusDisputed,
 }
 
 // Map from Status to string (optional, for marshalling)
@@ -262,6 +301,8 @@ var statusEnumToString = map[Status]string{
 	StatusCompleted:  "Completed",
 	StatusFailed:     "Failed",
 	StatusInProgress: "InProgress",
+	StatusExpired:    "Expired",
+	StatusDisputed:   "Disputed",
 }
 
 // UnmarshalDynamoDBAttributeValue implements custom unmarshalling for Status
@@ -285,6 +326,16 @@ func (s *Status) UnmarshalDynamoDBAttributeValue(av types.AttributeValue) error
 	}
 }
 
+// MarshalDynamoDBAttributeValue stores a Status by name. This is the canonical
+// representation; numeric values are still accepted when reading legacy rows.
+func (s Status) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	str, ok := statusEnumToString[s]
+	if !ok {
+		return nil, fmt.Errorf("unknown status: %d", s)
+	}
+	return &types.AttributeValueMemberS{Value: str}, nil
+}
+
 // String returns the string representation of the Status
 func (s Status) String() string {
 	if str, ok := statusEnumToString[s]; ok {
@@ -0,0 +1,159 @@
+package ledger
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Headers of a signed webhook. The signature header holds one "v1=<hex>"
+// entry per active signing key, comma separated, each an HMAC-SHA256 of
+// "<timestamp>.<body>". Receivers accept the request if any entry verifies
+// with their key and the timestamp is recent, which rejects replays.
+const (
+	WebhookTimestampHeader = "X-Nil-Timestamp"
+	WebhookSignatureHeader = "X-Nil-Signature"
+	webhookSignatureScheme = "v1"
+)
+
+// DefaultWebhookKeyGrace is how long the previous signing key stays active
+// after a rotation, so providers can switch keys without missing webhooks.
+const DefaultWebhookKeyGrace = 24 * time.Hour
+
+// DefaultWebhookTolerance is the clock skew VerifyWebhookSignature accepts.
+const DefaultWebhookTolerance = 5 * time.Minute
+
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// WebhookSigningKeys returns the keys webhooks to the provider are signed
+// with at now: the current key and, until its grace period ends, the previous.
+func (sp ServiceProvider) WebhookSigningKeys(now time.Time) []string {
+	var keys []string
+	if sp.WebhookSigningKey != "" {
+		keys = append(keys, sp.WebhookSigningKey)
+	}
+	if sp.PreviousWebhookSigningKey != "" && now.Unix() < sp.PreviousWebhookKeyExpiresAt {
+		keys = append(keys, sp.PreviousWebhookSigningKey)
+	}
+	return keys
+}
+
+// SignWebhook returns the timestamp and signature headers for body, signed
+// with every key in keys.
+func SignWebhook(keys []string, body []byte, now time.Time) (timestamp, signature string) {
+	timestamp = strconv.FormatInt(now.Unix(), 10)
+	entries := make([]string, 0, len(keys))
+	for _, key := range keys {
+		entries = append(entries, webhookSignatureScheme+"="+webhookHMAC(key, timestamp, body))
+	}
+	return timestamp, strings.Join(entries, ",")
+}
+
+// VerifyWebhookSignature checks the headers of a webhook against key, as the
+// receiving provider would. A zero tolerance uses DefaultWebhookTolerance.
+func VerifyWebhookSignature(key string, body []byte, timestamp, signature string, now time.Time, tolerance time.Duration) error {
+	if tolerance == 0 {
+		tolerance = DefaultWebhookTolerance
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp %q", ErrInvalidWebhookSignature, timestamp)
+	}
+	if skew := now.Sub(time.Unix(ts, 0)); skew > tolerance || skew < -tolerance {
+		return fmt.Errorf("%w: timestamp is %s off", ErrInvalidWebhookSignature, skew.Round(time.Second))
+	}
+
+	expected := webhookHMAC(key, timestamp, body)
+	for _, entry := range strings.Split(signature, ",") {
+		scheme, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if ok && scheme == webhookSignatureScheme && hmac.Equal([]byte(value), []byte(expected)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no signature matches the key", ErrInvalidWebhookSignature)
+}
+
+func webhookHMAC(key, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookSigningKey returns a random 256-bit key, hex encoded.
+func newWebhookSigningKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// RotateWebhookSigningKey gives a provider a new signing key and returns it.
+// The replaced key keeps signing webhooks alongside the new one for grace,
+// DefaultWebhookKeyGrace when zero; a key still in its grace period from an
+// earlier rotation is dropped.
+func RotateWebhookSigningKey(ctx context.Context, dbSvc *dynamodb.Client, email string, grace time.Duration) (string, error) {
+	if grace == 0 {
+		grace = DefaultWebhookKeyGrace
+	}
+	provider, err := GetServiceProvider(ctx, dbSvc, email)
+	if err != nil {
+		return "", err
+	}
+	key, err := newWebhookSigningKey()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = dbSvc.UpdateItem(ctx, rotateWebhookKeyInput(*provider, key, time.Now().Add(grace)))
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return "", fmt.Errorf("signing key of %s was changed concurrently, retry the rotation", email)
+		}
+		return "", fmt.Errorf("failed to rotate signing key of %s: %w", email, err)
+	}
+	return key, nil
+}
+
+// rotateWebhookKeyInput replaces the current key of sp with key. The update is
+// conditional on the current key being unchanged since sp was read, so two
+// rotations racing cannot both succeed and lose a key.
+func rotateWebhookKeyInput(sp ServiceProvider, key string, previousExpiresAt time.Time) *dynamodb.UpdateItemInput {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(ServiceProvidersTable),
+		Key: map[string]types.AttributeValue{
+			"Email": &types.AttributeValueMemberS{Value: sp.Email},
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":key":       &types.AttributeValueMemberS{Value: key},
+			":rotatedAt": &types.AttributeValueMemberS{Value: getCurrentTimeZone()},
+		},
+	}
+	if sp.WebhookSigningKey == "" {
+		input.UpdateExpression = aws.String("SET WebhookSigningKey = :key, WebhookKeyRotatedAt = :rotatedAt" +
+			" REMOVE PreviousWebhookSigningKey, PreviousWebhookKeyExpiresAt")
+		input.ConditionExpression = aws.String("attribute_exists(Email) AND (attribute_not_exists(WebhookSigningKey) OR WebhookSigningKey = :empty)")
+		input.ExpressionAttributeValues[":empty"] = &types.AttributeValueMemberS{Value: ""}
+		return input
+	}
+	input.UpdateExpression = aws.String("SET WebhookSigningKey = :key, WebhookKeyRotatedAt = :rotatedAt," +
+		" PreviousWebhookSigningKey = :previous, PreviousWebhookKeyExpiresAt = :expiresAt")
+	input.ConditionExpression = aws.String("WebhookSigningKey = :previous")
+	input.ExpressionAttributeValues[":previous"] = &types.AttributeValueMemberS{Value: sp.WebhookSigningKey}
+	input.ExpressionAttributeValues[":expiresAt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(previousExpiresAt.Unix(), 10)}
+	return input
+}
@@ -0,0 +1,91 @@
+package ledger
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSigningKeys(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	sp := ServiceProvider{
+		WebhookSigningKey:           "new",
+		PreviousWebhookSigningKey:   "old",
+		PreviousWebhookKeyExpiresAt: now.Add(time.Hour).Unix(),
+	}
+	assert.Equal(t, []string{"new", "old"}, sp.WebhookSigningKeys(now))
+	assert.Equal(t, []string{"new"}, sp.WebhookSigningKeys(now.Add(time.Hour)))
+	assert.Empty(t, ServiceProvider{}.WebhookSigningKeys(now))
+}
+
+func TestSignAndVerifyWebhook(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"transaction_id":"2kT3FZyVVUGn2j75pgzX4UA0lPL","amount":4}`)
+	timestamp, signature := SignWebhook([]string{"new", "old"}, body, now)
+	assert.Equal(t, "1700000000", timestamp)
+	assert.Len(t, strings.Split(signature, ","), 2)
+
+	tests := []struct {
+		name      string
+		key       string
+		body      []byte
+		timestamp string
+		at        time.Time
+		wantErr   bool
+	}{
+		{"current key", "new", body, timestamp, now, false},
+		{"previous key during rotation", "old", body, timestamp, now, false},
+		{"within tolerance", "new", body, timestamp, now.Add(4 * time.Minute), false},
+		{"unknown key", "other", body, timestamp, now, true},
+		{"tampered body", "new", []byte(`{"amount":400}`), timestamp, now, true},
+		{"tampered timestamp", "new", body, "1700000001", now, true},
+		{"replayed late", "new", body, timestamp, now.Add(10 * time.Minute), true},
+		{"invalid timestamp", "new", body, "yesterday", now, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyWebhookSignature(tt.key, tt.body, tt.timestamp, signature, tt.at, 0)
+			if tt.wantErr {
+				assert.True(t, errors.Is(err, ErrInvalidWebhookSignature), "got %v", err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestNewWebhookSigningKey(t *testing.T) {
+	a, err := newWebhookSigningKey()
+	assert.NoError(t, err)
+	b, err := newWebhookSigningKey()
+	assert.NoError(t, err)
+	assert.NotEqual(t, a, b)
+	assert.True(t, strings.HasPrefix(a, "whsec_"))
+	assert.Len(t, a, len("whsec_")+64)
+}
+
+func TestServiceProviderJSONHidesSigningKeys(t *testing.T) {
+	body, err := json.Marshal(ServiceProvider{Email: "ops@bok.example", WebhookSigningKey: "whsec_current", PreviousWebhookSigningKey: "whsec_previous"})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(body), "whsec_")
+}
+
+func TestRotateWebhookKeyInput(t *testing.T) {
+	expires := time.Unix(1700086400, 0)
+
+	first := rotateWebhookKeyInput(ServiceProvider{Email: "oss@pynil.com"}, "whsec_new", expires)
+	assert.Contains(t, aws.ToString(first.UpdateExpression), "REMOVE PreviousWebhookSigningKey")
+	assert.NotContains(t, first.ExpressionAttributeValues, ":previous")
+
+	rotated := rotateWebhookKeyInput(ServiceProvider{Email: "oss@pynil.com", WebhookSigningKey: "whsec_old"}, "whsec_new", expires)
+	assert.Equal(t, "WebhookSigningKey = :previous", aws.ToString(rotated.ConditionExpression))
+	assert.Contains(t, aws.ToString(rotated.UpdateExpression), "PreviousWebhookSigningKey = :previous")
+	assert.Equal(t, "whsec_old", rotated.ExpressionAttributeValues[":previous"].(*types.AttributeValueMemberS).Value)
+	assert.Equal(t, "whsec_new", rotated.ExpressionAttributeValues[":key"].(*types.AttributeValueMemberS).Value)
+}